@@ -0,0 +1,82 @@
+// 运维接口的鉴权
+package raft
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/kylin-ops/raft/http/httpserver/tools"
+)
+
+var ErrUnauthorized = errors.New("没有权限访问运维接口")
+
+// Authorizer 运维接口(get_info、成员变更、leader转移)的鉴权, 返回error时拒绝请求
+// 成员之间的接口不经过Authorizer, 由TLS和ClusterSecret保护
+type Authorizer interface {
+	Authorize(req *http.Request) error
+}
+
+// AuthorizerFunc 把函数转换为Authorizer
+type AuthorizerFunc func(req *http.Request) error
+
+func (f AuthorizerFunc) Authorize(req *http.Request) error {
+	return f(req)
+}
+
+// BasicAuth 使用http basic认证
+type BasicAuth struct {
+	Username string
+	Password string
+}
+
+func (a *BasicAuth) Authorize(req *http.Request) error {
+	username, password, ok := req.BasicAuth()
+	if !ok {
+		return ErrUnauthorized
+	}
+	// 用户名和密码都比较完, 不根据耗时泄露哪一个错误
+	userOk := subtle.ConstantTimeCompare([]byte(username), []byte(a.Username)) == 1
+	passOk := subtle.ConstantTimeCompare([]byte(password), []byte(a.Password)) == 1
+	if !userOk || !passOk {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+// BearerToken 使用Authorization: Bearer <token>认证, 任意一个token匹配即可, 方便轮换token
+type BearerToken struct {
+	Tokens []string
+}
+
+func (a *BearerToken) Authorize(req *http.Request) error {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ErrUnauthorized
+	}
+	token := []byte(strings.TrimPrefix(auth, "Bearer "))
+	for _, t := range a.Tokens {
+		if t != "" && subtle.ConstantTimeCompare(token, []byte(t)) == 1 {
+			return nil
+		}
+	}
+	return ErrUnauthorized
+}
+
+// 运维接口先经过Authorizer, 没有配置Authorizer时不鉴权
+func (r *Raft) authorize(handler http.HandlerFunc) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		if r.Authorizer != nil {
+			if err := r.Authorizer.Authorize(req); err != nil {
+				r.logWith(LogHTTP).Warnf("拒绝%s访问运维接口%s:%s", req.RemoteAddr, req.URL.Path, err.Error())
+				if _, ok := r.Authorizer.(*BasicAuth); ok {
+					resp.Header().Set("WWW-Authenticate", `Basic realm="raft"`)
+				}
+				tools.ApiResponse(resp, http.StatusUnauthorized, nil, err.Error())
+				return
+			}
+		}
+		handler(resp, req)
+	}
+}
@@ -0,0 +1,56 @@
+package raft
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthorizeAdminRoutes(t *testing.T) {
+	basic := &BasicAuth{Username: "admin", Password: "pass"}
+	bearer := &BearerToken{Tokens: []string{"old", "new"}}
+	rotated := &BearerToken{Tokens: []string{"new"}}
+	denyAll := AuthorizerFunc(func(req *http.Request) error { return errors.New("只允许内网访问") })
+	cases := []struct {
+		name       string
+		authorizer Authorizer
+		path       string
+		setup      func(req *http.Request)
+		status     int
+		challenge  string // 期望的WWW-Authenticate响应头
+	}{
+		{"没有配置鉴权", nil, "/api/v1/get_info", nil, 200, ""},
+		{"basic正确的密码", basic, "/api/v1/get_info", func(req *http.Request) { req.SetBasicAuth("admin", "pass") }, 200, ""},
+		{"basic错误的密码", basic, "/api/v1/get_info", func(req *http.Request) { req.SetBasicAuth("admin", "wrong") }, 401, `Basic realm="raft"`},
+		{"basic错误的用户名", basic, "/api/v1/get_info", func(req *http.Request) { req.SetBasicAuth("root", "pass") }, 401, `Basic realm="raft"`},
+		{"basic没有认证信息", basic, "/api/v1/get_info", nil, 401, `Basic realm="raft"`},
+		{"bearer旧token", bearer, "/api/v1/get_info", func(req *http.Request) { req.Header.Set("Authorization", "Bearer old") }, 200, ""},
+		{"bearer新token", bearer, "/api/v1/get_info", func(req *http.Request) { req.Header.Set("Authorization", "Bearer new") }, 200, ""},
+		{"bearer轮换后的旧token", rotated, "/api/v1/get_info", func(req *http.Request) { req.Header.Set("Authorization", "Bearer old") }, 401, ""},
+		{"bearer错误的前缀", bearer, "/api/v1/get_info", func(req *http.Request) { req.Header.Set("Authorization", "Basic new") }, 401, ""},
+		{"bearer没有token", bearer, "/api/v1/get_info", nil, 401, ""},
+		{"AuthorizerFunc拒绝", denyAll, "/api/v1/transfer_leader", nil, 401, ""},
+		{"成员之间的接口不鉴权", denyAll, "/api/v1/election", nil, 200, ""},
+	}
+	for _, tc := range cases {
+		r := newTestNode(t, func(o *Options) { o.Authorizer = tc.authorizer })
+		ts := httptest.NewServer(r.Handler())
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+tc.path, nil)
+		if tc.setup != nil {
+			tc.setup(req)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		ts.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err.Error())
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Fatalf("%s: 响应状态%d,应该是%d", tc.name, resp.StatusCode, tc.status)
+		}
+		if got := resp.Header.Get("WWW-Authenticate"); got != tc.challenge {
+			t.Fatalf("%s: WWW-Authenticate是%q", tc.name, got)
+		}
+	}
+}
@@ -2,6 +2,7 @@
 package raft
 
 import (
+	"context"
 	"math/rand"
 	"time"
 )
@@ -10,11 +11,18 @@ import (
 func (r *Raft) BackendElection() {
 	for {
 		rand.Seed(time.Now().UnixNano())
-		if r.Role != "candidate" || r.NoElection {
-			time.Sleep(time.Second)
+		r.Mu.Lock()
+		campaign := r.Role == RoleCandidate && !r.NoElection && r.Health.Healthy
+		r.Mu.Unlock()
+		if !campaign {
+			if !r.sleep(time.Second) {
+				return
+			}
 			continue
 		}
-		time.Sleep(time.Duration(rand.Intn(150)+150) * time.Millisecond)
+		if !r.sleep(time.Duration(rand.Intn(150)+150) * time.Millisecond) {
+			return
+		}
 		r.sendElectionToALLMembers()
 	}
 }
@@ -22,89 +30,114 @@ func (r *Raft) BackendElection() {
 // 后台有leader发生心跳信息
 func (r *Raft) BackendHeatbeat() {
 	for {
-		if r.Role == "leader" && r.CurrentLeader == r.Id && len(r.Members)/2 < r.VotedCount {
-			r.Logger.Debugf("send heatbert")
+		r.Mu.Lock()
+		leader := r.Role == RoleLeader && r.CurrentLeader == r.Id
+		r.Mu.Unlock()
+		if leader {
+			r.logWith(LogHeartbeat, "role", RoleLeader).Debugf("send heatbert")
 			r.sendHeartbeatToAllMembers()
+			r.checkQuorum()
 		}
 		// else {
 		// 	r.Logger.Debugf("heartbeat - 节点%s的角色是%s,当前的leader是%s,选票有%d", r.Id, r.Role, r.CurrentLeader, r.VotedCount)
 		// }
-		time.Sleep(time.Second)
+		// 有新日志需要复制时不等待下一次心跳
+		select {
+		case <-r.replicateCh:
+		case <-time.After(time.Second):
+		case <-r.done:
+			return
+		}
 	}
 }
 
+// 默认leader只是偏好, 和其他成员一样需要赢得多数派的选票才能成为leader
+// 其他成员是leader时, 等默认leader心跳在线、健康且追上全部日志后把leader转移给它
 func (r *Raft) BackendDefaultLeader() {
-	for {
-		time.Sleep(time.Second * 1)
-		if r.DefaultLeader == r.Id {
-			if r.Role != "leader" || r.VotedFor != r.Id {
-				r.Mu.Lock()
-				if r.Role != "leader" {
-					r.Role = "leader"
-				}
-				if r.VotedFor != r.Id {
-					r.VotedFor = r.Id
-				}
-				r.CurrentLeader = r.Id
-				r.VotedCount = len(r.Members)
-				r.Mu.Unlock()
+	for r.sleep(time.Second * 1) {
+		r.Mu.Lock()
+		target := r.DefaultLeader
+		ready := r.Role == RoleLeader && target != r.Id && r.transferee == "" && r.defaultLeaderReady()
+		r.Mu.Unlock()
+		if !ready {
+			continue
+		}
+		r.logWith(LogElection).Infof("默认leader %s已经追上日志,把leader转移给它", target)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(r.Timeout)*time.Second)
+		err := r.TransferLeadership(ctx, target)
+		cancel()
+		if err != nil {
+			r.logWith(LogElection).Warnf("把leader转移给默认leader %s错误:%s", target, err.Error())
+			// 转移失败时等待一个超时时间再重试, 避免反复打断正常的leader
+			if !r.sleep(time.Duration(r.Timeout) * time.Second) {
+				return
 			}
 		}
 	}
 }
 
+// 默认leader是否可以接收leader转移: 有投票权、心跳在线、健康检查正常且日志已经追上, 调用方需持有锁
+func (r *Raft) defaultLeaderReady() bool {
+	m, ok := r.Members[r.DefaultLeader]
+	if !ok || m.Learner || m.Unhealthy || m.HeartbeatStatus != "online" {
+		return false
+	}
+	return r.matchIndex[r.DefaultLeader] >= r.log.lastIndex()
+}
+
 // leader 联系失败，重新选举
 func (r *Raft) BackendReCandidate() {
-	go func() {
-		for {
-			time.Sleep(time.Second * 1)
-			if r.DefaultLeader == r.Id {
-				continue
-			}
-
-			members := r.GetMembers()
-			if r.Role == "candidate" {
-				for _, m := range members {
-					if time.Now().Unix()-m.LastHeartbeatTime > r.Timeout {
-						r.Mu.Lock()
-						for id := range r.Members {
-							r.Members[id].ElectionStatus = ""
-						}
-						r.Mu.Unlock()
-					}
+	r.goBackend(func() {
+		for r.sleep(time.Second * 1) {
+			r.Mu.Lock()
+			if r.Role == RoleCandidate {
+				// 新一轮选举重新统计各成员的拉票结果
+				for id := range r.Members {
+					r.Members[id].ElectionStatus = ""
 				}
-				r.VotedFor = ""
-				r.VotedCount = 0
-				r.Logger.Debugf("初始化 - 锁定选票超时, 节点可投新的选票")
 			}
-			if r.Role == "candidate" || r.LastHeartbeatTime == 0 {
+			if r.Role == RoleCandidate || r.LastHeartbeatTime == 0 {
+				r.Mu.Unlock()
 				continue
 			}
-			if time.Now().Unix()-r.LastHeartbeatTime > r.Timeout {
-				r.Mu.Lock()
+			if r.Role == RoleFollower && time.Now().Unix()-r.LastHeartbeatTime > r.Timeout {
+				// 选票在本任期内仍然有效, 只清理leader信息
 				r.CurrentLeader = ""
-				r.VotedFor = ""
 				for id := range r.Members {
 					r.Members[id].LeaderId = ""
 					r.Members[id].Role = ""
 					r.Members[id].ElectionStatus = ""
 				}
-				r.Mu.Unlock()
-				r.Logger.Debugf("初始化 - 心跳超时，节点初始化重新参与选举")
+				r.logWith(LogElection, "term", r.CurrentTerm, "role", r.Role).Debugf("初始化 - 心跳超时，节点初始化重新参与选举")
 			}
+			r.Mu.Unlock()
 		}
-	}()
+	})
 
-	go func() {
-		for {
-			time.Sleep(time.Second * 3)
-			if r.Role == "candidate" || r.LastHeartbeatTime == 0 {
-				continue
-			}
-			if time.Now().Unix()-r.LastHeartbeatTime > r.Timeout {
-				r.Role = "candidate"
+	r.goBackend(func() {
+		for r.sleep(time.Second * 3) {
+			r.Mu.Lock()
+			if r.Role == RoleFollower && r.LastHeartbeatTime != 0 && time.Now().Unix()-r.LastHeartbeatTime > r.Timeout {
+				r.Role = RoleCandidate
 				r.VotedCount = 0
 			}
+			r.Mu.Unlock()
+		}
+	})
+}
+
+// 后台把已提交的日志应用到状态机
+func (r *Raft) BackendApply() {
+	for {
+		select {
+		case <-r.applyCh:
+		case <-time.After(time.Second):
+		case <-r.done:
+			return
 		}
-	}()
+		r.applyMu.Lock()
+		r.applyCommitted()
+		r.maybeSnapshot()
+		r.applyMu.Unlock()
+	}
 }
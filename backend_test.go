@@ -0,0 +1,38 @@
+package raft
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDefaultLeaderTakesOverAfterCatchingUp(t *testing.T) {
+	c := newTestCluster(t, 3, func(o *Options) {
+		o.DefaultLeader = "n3"
+	})
+	c.waitFor("选出leader", 20*time.Second, func() bool { return c.leader() != nil })
+
+	// 默认leader被隔离时其他成员照常选出leader, 默认leader不能单独成为leader
+	n3 := c.nodes[2]
+	c.net.Isolate(n3.Address)
+	c.waitFor("其他成员选出leader", 20*time.Second, func() bool {
+		l := c.leader(c.nodes[0], c.nodes[1])
+		return l != nil && c.leader() == l
+	})
+	c.propose("while_isolated")
+
+	// 恢复后默认leader追上日志, leader转移给它
+	c.net.Heal()
+	c.waitFor("默认leader成为leader", 20*time.Second, func() bool {
+		if c.leader() != n3 {
+			return false
+		}
+		n3.Mu.Lock()
+		defer n3.Mu.Unlock()
+		return n3.CommitIndex > 0 && n3.log.termAt(n3.CommitIndex) == n3.CurrentTerm
+	})
+	c.propose("after")
+	c.waitFor("全部节点应用相同的日志", 20*time.Second, c.converged)
+	if cmds := c.fsms[2].commands(); !containsString(cmds, "while_isolated") {
+		t.Fatalf("默认leader没有隔离期间提交的命令:%v", cmds)
+	}
+}
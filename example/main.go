@@ -1,7 +1,12 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/kylin-ops/raft"
 	"github.com/kylin-ops/raft/health"
@@ -18,10 +23,16 @@ func main() {
 	var Id string
 	var leader string
 	var noElection bool
+	var dataDir string
+	var preVote bool
+	var lease int64
 	flag.StringVar(&addr, "addr", "0.0.0.0:8080", "服务端口号")
 	flag.StringVar(&Id, "id", "id-1", "成员id")
 	flag.StringVar(&leader, "leader", "", "默认leader")
 	flag.BoolVar(&noElection, "no_election", false, "不参加选取")
+	flag.StringVar(&dataDir, "data_dir", "", "数据目录")
+	flag.BoolVar(&preVote, "pre_vote", false, "开启预投票")
+	flag.Int64Var(&lease, "leader_lease", 0, "leader租约(秒)")
 	flag.Parse()
 
 	r := raft.NewRaft(&raft.Options{
@@ -31,6 +42,15 @@ func main() {
 		NoElection: noElection,
 		Members: members,
 		HealthChecker: &health.Default{},
+		DataDir: dataDir,
+		PreVote: preVote,
+		LeaderLease: lease,
+		TransferOnShutdown: true,
 	})
-	r.Start()
+	// 收到退出信号后停止节点, leader先把leader转移给其他成员
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := r.Run(ctx); err != nil {
+		log.Fatalln(err.Error())
+	}
 }
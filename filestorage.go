@@ -0,0 +1,495 @@
+// 基于文件的持久化存储
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var ErrStorageClosed = errors.New("存储已经关闭")
+
+// 段文件末尾写了一半的记录, 只有这种损坏在打开时自动截断
+var errTornRecord = errors.New("记录没有写完整")
+
+const (
+	metaFileName       = "meta.json"
+	snapshotFileName   = "snapshot"
+	walDirName         = "wal"
+	walSuffix          = ".wal"
+	defaultSegmentSize = 64 * 1024 * 1024
+)
+
+// FileStorage 文件存储, 任期和投票保存在fsync过的元数据文件中,
+// 日志按顺序写入预写日志段文件, 每个段文件以第一条日志的索引命名
+// 段文件中每条记录的格式: 4字节长度 + 4字节crc32校验 + json编码的日志
+// 快照保存在一个文件中, 第一行是json编码的快照元数据, 之后是状态机数据
+type FileStorage struct {
+	Dir         string // 数据目录
+	SegmentSize int64  // 单个段文件超过这个大小后写入新的段文件
+
+	mu       sync.Mutex
+	opened   bool
+	closed   bool  // Close之后不能再使用, 需要重新创建
+	failed   error // 写入失败且无法回滚, 文件内容和内存中的段信息可能不一致, 之后的操作都返回这个错误
+	segments []*segment
+	file     *os.File // 最后一个段文件, 新日志写入这里
+}
+
+// 预写日志段文件
+type segment struct {
+	path    string
+	first   int64   // 第一条日志的索引
+	offsets []int64 // 每条日志记录在文件中的偏移
+	size    int64
+}
+
+type metaState struct {
+	Term     int64  `json:"term"`
+	VotedFor string `json:"voted_for"`
+}
+
+func NewFileStorage(dir string) *FileStorage {
+	return &FileStorage{Dir: dir, SegmentSize: defaultSegmentSize}
+}
+
+// 打开数据目录, 校验全部段文件, 调用方需持有锁
+func (s *FileStorage) open() error {
+	if s.closed {
+		return ErrStorageClosed
+	}
+	if s.failed != nil {
+		return s.failed
+	}
+	if s.opened {
+		return nil
+	}
+	walDir := filepath.Join(s.Dir, walDirName)
+	if err := os.MkdirAll(walDir, 0755); err != nil {
+		return err
+	}
+	infos, err := ioutil.ReadDir(walDir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasSuffix(info.Name(), walSuffix) {
+			names = append(names, info.Name())
+		}
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		seg := &segment{path: filepath.Join(walDir, name)}
+		if _, err := fmt.Sscanf(name, "%d"+walSuffix, &seg.first); err != nil {
+			return fmt.Errorf("日志段文件名%s错误:%s", name, err.Error())
+		}
+		entries, offsets, size, err := readSegment(seg.path)
+		if err != nil {
+			// 只有最后一个段文件末尾写了一半的记录可以截掉, 其他损坏截断会丢失已经提交的日志
+			if err != errTornRecord || i != len(names)-1 {
+				return fmt.Errorf("日志段文件%s损坏:%s", seg.path, err.Error())
+			}
+			if err := os.Truncate(seg.path, size); err != nil {
+				return err
+			}
+		}
+		if len(entries) > 0 && entries[0].Index != seg.first {
+			return fmt.Errorf("日志段文件%s的第一条日志索引是%d", seg.path, entries[0].Index)
+		}
+		if last := s.lastIndex(); len(s.segments) > 0 && seg.first != last+1 {
+			return fmt.Errorf("日志段文件%s不连续,上一条日志索引是%d", seg.path, last)
+		}
+		seg.offsets = offsets
+		seg.size = size
+		s.segments = append(s.segments, seg)
+	}
+	if len(s.segments) > 0 {
+		f, err := os.OpenFile(s.segments[len(s.segments)-1].path, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		s.file = f
+	}
+	s.opened = true
+	return nil
+}
+
+// 读取段文件中的全部日志, 遇到损坏的记录时返回已经读到的日志和有效长度
+// 文件末尾不完整的记录, 或者正好到文件末尾但校验失败的记录返回errTornRecord
+func readSegment(path string) ([]*Entry, []int64, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	var entries []*Entry
+	var offsets []int64
+	var offset int64
+	reader := bufio.NewReader(f)
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err == io.EOF {
+				return entries, offsets, offset, nil
+			}
+			if err == io.ErrUnexpectedEOF {
+				err = errTornRecord
+			}
+			return entries, offsets, offset, err
+		}
+		length := int64(binary.BigEndian.Uint32(header[:4]))
+		end := offset + int64(len(header)) + length
+		if end > info.Size() {
+			return entries, offsets, offset, errTornRecord
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return entries, offsets, offset, err
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+			if end == info.Size() {
+				return entries, offsets, offset, errTornRecord
+			}
+			return entries, offsets, offset, fmt.Errorf("偏移%d的记录校验失败", offset)
+		}
+		var e Entry
+		if err := json.Unmarshal(payload, &e); err != nil {
+			return entries, offsets, offset, err
+		}
+		entries = append(entries, &e)
+		offsets = append(offsets, offset)
+		offset = end
+	}
+}
+
+// 最后一条日志的索引, 没有日志时返回0, 调用方需持有锁
+func (s *FileStorage) lastIndex() int64 {
+	if len(s.segments) == 0 {
+		return 0
+	}
+	seg := s.segments[len(s.segments)-1]
+	return seg.first + int64(len(seg.offsets)) - 1
+}
+
+func (s *FileStorage) LoadState() (int64, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.open(); err != nil {
+		return 0, "", err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(s.Dir, metaFileName))
+	if os.IsNotExist(err) {
+		return 0, "", nil
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	var meta metaState
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return 0, "", fmt.Errorf("元数据文件损坏:%s", err.Error())
+	}
+	return meta.Term, meta.VotedFor, nil
+}
+
+// 先写临时文件再改名, 保证元数据文件不会只写了一半
+func (s *FileStorage) SaveState(term int64, votedFor string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.open(); err != nil {
+		return err
+	}
+	data, _ := json.Marshal(metaState{Term: term, VotedFor: votedFor})
+	path := filepath.Join(s.Dir, metaFileName)
+	if err := writeFileSync(path+".tmp", data); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	return syncDir(s.Dir)
+}
+
+func (s *FileStorage) LoadEntries() ([]*Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	var all []*Entry
+	for _, seg := range s.segments {
+		entries, _, _, err := readSegment(seg.path)
+		if err != nil {
+			return nil, fmt.Errorf("读取日志段文件%s错误:%s", seg.path, err.Error())
+		}
+		all = append(all, entries...)
+	}
+	return all, nil
+}
+
+func (s *FileStorage) AppendEntries(entries []*Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.open(); err != nil {
+		return err
+	}
+	if last := s.lastIndex(); len(s.segments) > 0 && entries[0].Index != last+1 {
+		return fmt.Errorf("追加的日志索引%d不连续,最后一条日志索引是%d", entries[0].Index, last)
+	}
+	if len(s.segments) == 0 || s.segments[len(s.segments)-1].size >= s.SegmentSize {
+		if err := s.newSegment(entries[0].Index); err != nil {
+			return err
+		}
+	}
+	seg := s.segments[len(s.segments)-1]
+	var buf bytes.Buffer
+	var offsets []int64
+	for _, e := range entries {
+		payload, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		header := make([]byte, 8)
+		binary.BigEndian.PutUint32(header[:4], uint32(len(payload)))
+		binary.BigEndian.PutUint32(header[4:], crc32.ChecksumIEEE(payload))
+		offsets = append(offsets, seg.size+int64(buf.Len()))
+		buf.Write(header)
+		buf.Write(payload)
+	}
+	if _, err := s.file.Write(buf.Bytes()); err != nil {
+		return s.rollback(seg, err)
+	}
+	if err := s.file.Sync(); err != nil {
+		return s.rollback(seg, err)
+	}
+	seg.offsets = append(seg.offsets, offsets...)
+	seg.size += int64(buf.Len())
+	return nil
+}
+
+// 追加失败时截掉可能已经写入的部分记录, 截断失败时之后的操作都返回错误, 调用方需持有锁
+func (s *FileStorage) rollback(seg *segment, err error) error {
+	if terr := os.Truncate(seg.path, seg.size); terr != nil {
+		s.failed = fmt.Errorf("追加日志失败:%s,回滚日志段文件%s失败:%s", err.Error(), seg.path, terr.Error())
+		return s.failed
+	}
+	if serr := s.file.Sync(); serr != nil {
+		s.failed = fmt.Errorf("追加日志失败:%s,回滚日志段文件%s失败:%s", err.Error(), seg.path, serr.Error())
+		return s.failed
+	}
+	return err
+}
+
+// 创建以first命名的新段文件并切换写入, 调用方需持有锁
+func (s *FileStorage) newSegment(first int64) error {
+	path := filepath.Join(s.Dir, walDirName, fmt.Sprintf("%020d%s", first, walSuffix))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		f.Close()
+		return err
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file = f
+	s.segments = append(s.segments, &segment{path: path, first: first})
+	return nil
+}
+
+func (s *FileStorage) TruncateSuffix(index int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.open(); err != nil {
+		return err
+	}
+	for len(s.segments) > 0 {
+		seg := s.segments[len(s.segments)-1]
+		if seg.first >= index {
+			// 整个段文件都需要删除
+			s.file.Close()
+			s.file = nil
+			if err := os.Remove(seg.path); err != nil {
+				return err
+			}
+			s.segments = s.segments[:len(s.segments)-1]
+			if len(s.segments) > 0 {
+				f, err := os.OpenFile(s.segments[len(s.segments)-1].path, os.O_WRONLY|os.O_APPEND, 0644)
+				if err != nil {
+					return err
+				}
+				s.file = f
+			}
+			continue
+		}
+		if n := index - seg.first; n < int64(len(seg.offsets)) {
+			if err := s.file.Truncate(seg.offsets[n]); err != nil {
+				return err
+			}
+			if err := s.file.Sync(); err != nil {
+				return err
+			}
+			seg.size = seg.offsets[n]
+			seg.offsets = seg.offsets[:n]
+		}
+		break
+	}
+	return syncDir(filepath.Join(s.Dir, walDirName))
+}
+
+func (s *FileStorage) TruncatePrefix(index int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.open(); err != nil {
+		return err
+	}
+	// 只删除全部日志都不大于index的段文件, 段文件中剩下的旧日志在加载时跳过
+	for len(s.segments) > 0 {
+		seg := s.segments[0]
+		if seg.first+int64(len(seg.offsets))-1 > index {
+			break
+		}
+		if len(s.segments) == 1 {
+			s.file.Close()
+			s.file = nil
+		}
+		if err := os.Remove(seg.path); err != nil {
+			return err
+		}
+		s.segments = s.segments[1:]
+	}
+	return syncDir(filepath.Join(s.Dir, walDirName))
+}
+
+func (s *FileStorage) SaveSnapshot(meta *SnapshotMeta, data io.Reader) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.open(); err != nil {
+		return err
+	}
+	path := filepath.Join(s.Dir, snapshotFileName)
+	f, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	header, _ := json.Marshal(meta)
+	w := bufio.NewWriter(f)
+	_, _ = w.Write(append(header, '\n'))
+	if _, err := io.Copy(w, data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	return syncDir(s.Dir)
+}
+
+func (s *FileStorage) LoadSnapshot() (*SnapshotMeta, io.ReadCloser, error) {
+	s.mu.Lock()
+	closed := s.closed
+	s.mu.Unlock()
+	if closed {
+		return nil, nil, ErrStorageClosed
+	}
+	f, err := os.Open(filepath.Join(s.Dir, snapshotFileName))
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	reader := bufio.NewReader(f)
+	header, err := reader.ReadBytes('\n')
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("快照文件损坏:%s", err.Error())
+	}
+	var meta SnapshotMeta
+	if err := json.Unmarshal(header, &meta); err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("快照文件损坏:%s", err.Error())
+	}
+	return &meta, &snapshotFile{Reader: reader, file: f}, nil
+}
+
+// 读取快照数据部分, 关闭时关闭快照文件
+type snapshotFile struct {
+	*bufio.Reader
+	file *os.File
+}
+
+func (f *snapshotFile) Close() error {
+	return f.file.Close()
+}
+
+func (s *FileStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	if s.file != nil {
+		err = s.file.Close()
+		s.file = nil
+	}
+	s.segments = nil
+	s.opened = false
+	s.closed = true
+	return err
+}
+
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// 同步目录, 保证文件的创建、删除和改名落盘
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,284 @@
+package raft
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func testEntries(first, last, term int64) []*Entry {
+	var entries []*Entry
+	for i := first; i <= last; i++ {
+		entries = append(entries, &Entry{Index: i, Term: term, Type: EntryCommand, Data: []byte(fmt.Sprintf("cmd%d", i))})
+	}
+	return entries
+}
+
+// 检查日志的索引是first到last
+func checkEntries(t *testing.T, s Storage, first, last int64) {
+	t.Helper()
+	entries, err := s.LoadEntries()
+	if err != nil {
+		t.Fatalf("读取日志错误:%s", err.Error())
+	}
+	if int64(len(entries)) != last-first+1 {
+		t.Fatalf("读取到%d条日志,应该是%d到%d", len(entries), first, last)
+	}
+	for i, e := range entries {
+		if e.Index != first+int64(i) || string(e.Data) != fmt.Sprintf("cmd%d", e.Index) {
+			t.Fatalf("第%d条日志错误:%+v", i, e)
+		}
+	}
+}
+
+func walSegments(t *testing.T, dir string) []string {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, walDirName, "*"+walSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestFileStorageState(t *testing.T) {
+	dir := t.TempDir()
+	s := NewFileStorage(dir)
+	term, votedFor, err := s.LoadState()
+	if err != nil || term != 0 || votedFor != "" {
+		t.Fatalf("新的数据目录任期%d投票%q错误%v", term, votedFor, err)
+	}
+	if err := s.SaveState(3, "n2"); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s = NewFileStorage(dir)
+	defer s.Close()
+	term, votedFor, err = s.LoadState()
+	if err != nil || term != 3 || votedFor != "n2" {
+		t.Fatalf("重新打开后任期%d投票%q错误%v", term, votedFor, err)
+	}
+}
+
+func TestFileStorageAppendTruncateReopen(t *testing.T) {
+	dir := t.TempDir()
+	s := NewFileStorage(dir)
+	// 每个段文件只放几条日志, 截断时跨越多个段文件
+	s.SegmentSize = 200
+	for _, e := range testEntries(1, 10, 1) {
+		if err := s.AppendEntries([]*Entry{e}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(walSegments(t, dir)); n < 3 {
+		t.Fatalf("只有%d个段文件", n)
+	}
+	if err := s.AppendEntries(testEntries(12, 12, 1)); err == nil {
+		t.Fatal("追加不连续的日志应该返回错误")
+	}
+	if err := s.TruncateSuffix(6); err != nil {
+		t.Fatal(err)
+	}
+	checkEntries(t, s, 1, 5)
+	s.Close()
+
+	s = NewFileStorage(dir)
+	s.SegmentSize = 200
+	checkEntries(t, s, 1, 5)
+	if err := s.AppendEntries(testEntries(6, 7, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.TruncatePrefix(3); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := s.LoadEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 段文件中剩下的旧日志由raftLog加载时跳过
+	if len(entries) == 0 || entries[0].Index > 4 || entries[len(entries)-1].Index != 7 {
+		t.Fatalf("删除索引3之前的日志后剩下%d条日志", len(entries))
+	}
+	s.Close()
+}
+
+func TestFileStorageTornTail(t *testing.T) {
+	cases := []struct {
+		name    string
+		last    int64 // 重新打开后最后一条日志的索引
+		corrupt func(t *testing.T, path string)
+	}{
+		{"partial_header", 3, func(t *testing.T, path string) {
+			appendFile(t, path, []byte{0, 0, 0})
+		}},
+		{"partial_record", 3, func(t *testing.T, path string) {
+			// 记录头声明100字节, 只写入了10字节
+			appendFile(t, path, append([]byte{0, 0, 0, 100, 1, 2, 3, 4}, bytes.Repeat([]byte("x"), 10)...))
+		}},
+		{"bad_checksum", 2, func(t *testing.T, path string) {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data[len(data)-2] ^= 0xff
+			if err := ioutil.WriteFile(path, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := NewFileStorage(dir)
+			if err := s.AppendEntries(testEntries(1, 3, 1)); err != nil {
+				t.Fatal(err)
+			}
+			s.Close()
+			segments := walSegments(t, dir)
+			tc.corrupt(t, segments[len(segments)-1])
+
+			// 写了一半或者校验失败的记录被截掉, 之前的日志完整
+			s = NewFileStorage(dir)
+			checkEntries(t, s, 1, tc.last)
+			if err := s.AppendEntries(testEntries(tc.last+1, tc.last+2, 2)); err != nil {
+				t.Fatalf("截断后追加日志错误:%s", err.Error())
+			}
+			s.Close()
+
+			s = NewFileStorage(dir)
+			defer s.Close()
+			checkEntries(t, s, 1, tc.last+2)
+		})
+	}
+}
+
+func TestFileStorageCorruptSegment(t *testing.T) {
+	dir := t.TempDir()
+	s := NewFileStorage(dir)
+	s.SegmentSize = 200
+	for _, e := range testEntries(1, 10, 1) {
+		if err := s.AppendEntries([]*Entry{e}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Close()
+	// 不是最后一个段文件的损坏不能自动截断, 否则会丢失之后的日志
+	appendFile(t, walSegments(t, dir)[0], []byte{0, 0, 0})
+	s = NewFileStorage(dir)
+	defer s.Close()
+	if _, err := s.LoadEntries(); err == nil {
+		t.Fatal("中间的段文件损坏时应该返回错误")
+	}
+}
+
+func TestFileStorageCorruptRecordBeforeTail(t *testing.T) {
+	dir := t.TempDir()
+	s := NewFileStorage(dir)
+	if err := s.AppendEntries(testEntries(1, 3, 1)); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	// 最后一个段文件中间的记录校验失败不是写了一半, 不能截掉之后的日志
+	path := walSegments(t, dir)[0]
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[10] ^= 0xff
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	s = NewFileStorage(dir)
+	defer s.Close()
+	if _, err := s.LoadEntries(); err == nil {
+		t.Fatal("中间的记录校验失败时应该返回错误")
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() != int64(len(data)) {
+		t.Fatalf("打开失败时不能截断段文件:%v", err)
+	}
+}
+
+func TestFileStorageAppendRollback(t *testing.T) {
+	dir := t.TempDir()
+	s := NewFileStorage(dir)
+	if err := s.AppendEntries(testEntries(1, 3, 1)); err != nil {
+		t.Fatal(err)
+	}
+	path := walSegments(t, dir)[0]
+	// 模拟只写入了一部分记录之后写入失败
+	appendFile(t, path, []byte{0, 0, 0, 100, 1, 2})
+	file := s.file
+	readonly, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer readonly.Close()
+	s.file = readonly
+	if err := s.AppendEntries(testEntries(4, 4, 1)); err == nil {
+		t.Fatal("写入失败时应该返回错误")
+	}
+	s.file = file
+
+	// 写了一半的记录已经截掉, 之后的日志接着写入
+	if err := s.AppendEntries(testEntries(4, 5, 1)); err != nil {
+		t.Fatalf("回滚后追加日志错误:%s", err.Error())
+	}
+	s.Close()
+	s = NewFileStorage(dir)
+	defer s.Close()
+	checkEntries(t, s, 1, 5)
+}
+
+func TestFileStorageAppendFailed(t *testing.T) {
+	s := NewFileStorage(t.TempDir())
+	defer s.Close()
+	if err := s.AppendEntries(testEntries(1, 1, 1)); err != nil {
+		t.Fatal(err)
+	}
+	// 文件已经关闭, 写入失败后也无法同步回滚的结果
+	s.file.Close()
+	if err := s.AppendEntries(testEntries(2, 2, 1)); err == nil {
+		t.Fatal("写入失败时应该返回错误")
+	}
+	if s.failed == nil {
+		t.Fatal("回滚失败后应该标记存储失败")
+	}
+	if _, err := s.LoadEntries(); err != s.failed {
+		t.Fatalf("存储失败后读取日志返回%v", err)
+	}
+}
+
+func TestFileStorageClosed(t *testing.T) {
+	s := NewFileStorage(t.TempDir())
+	if err := s.SaveState(1, "n1"); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if _, _, err := s.LoadState(); err != ErrStorageClosed {
+		t.Fatalf("关闭后读取任期返回%v", err)
+	}
+	if err := s.AppendEntries(testEntries(1, 1, 1)); err != ErrStorageClosed {
+		t.Fatalf("关闭后追加日志返回%v", err)
+	}
+	if _, _, err := s.LoadSnapshot(); err != ErrStorageClosed {
+		t.Fatalf("关闭后读取快照返回%v", err)
+	}
+}
+
+func appendFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,136 @@
+// 状态机
+package raft
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+var ErrLeadershipLost = errors.New("命令提交前leader发生了变化")
+
+// StateMachine 业务状态机, 已提交的命令在每个节点上按日志顺序应用且只应用一次
+type StateMachine interface {
+	// 应用一条已提交的命令, 返回值交给leader上等待该命令的ProposeAndWait
+	Apply(entry *Entry) interface{}
+	// 生成状态机当前状态的快照, 返回的数据需要是调用时刻的状态
+	Snapshot() (io.Reader, error)
+	// 用快照数据替换状态机的全部状态
+	Restore(reader io.Reader) error
+}
+
+// 不保存任何状态的状态机, 只需要选主时使用
+type NopStateMachine struct{}
+
+func (*NopStateMachine) Apply(*Entry) interface{} {
+	return nil
+}
+
+func (*NopStateMachine) Snapshot() (io.Reader, error) {
+	return &emptyReader{}, nil
+}
+
+func (*NopStateMachine) Restore(io.Reader) error {
+	return nil
+}
+
+type emptyReader struct{}
+
+func (*emptyReader) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
+// 等待应用结果的命令
+type proposal struct {
+	term int64
+	done chan applyResult
+}
+
+type applyResult struct {
+	data interface{}
+	err  error
+}
+
+// ProposeAndWait 在leader上提交一条命令, 等待命令在本节点应用到状态机后返回Apply的结果
+func (r *Raft) ProposeAndWait(ctx context.Context, cmd []byte) (interface{}, error) {
+	r.Mu.Lock()
+	if r.Role != RoleLeader {
+		r.Mu.Unlock()
+		return nil, ErrNotLeader
+	}
+	e, err := r.appendEntry(EntryCommand, cmd)
+	if err != nil {
+		r.Mu.Unlock()
+		return nil, err
+	}
+	p := r.addProposal(e)
+	r.Mu.Unlock()
+	return r.waitProposal(ctx, e.Index, p)
+}
+
+// 登记等待应用结果的日志, 调用方需持有锁
+func (r *Raft) addProposal(e *Entry) *proposal {
+	p := &proposal{term: e.Term, done: make(chan applyResult, 1)}
+	r.proposals[e.Index] = p
+	return p
+}
+
+// 等待日志应用到状态机
+func (r *Raft) waitProposal(ctx context.Context, index int64, p *proposal) (interface{}, error) {
+	select {
+	case res := <-p.done:
+		return res.data, res.err
+	case <-ctx.Done():
+		r.Mu.Lock()
+		delete(r.proposals, index)
+		r.Mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// 通知后台应用新提交的日志
+func (r *Raft) notifyApply() {
+	select {
+	case r.applyCh <- struct{}{}:
+	default:
+	}
+}
+
+// 失败所有等待中的命令, leader退位时调用, 调用方需持有锁
+func (r *Raft) failProposals(err error) {
+	for index, p := range r.proposals {
+		p.done <- applyResult{err: err}
+		delete(r.proposals, index)
+	}
+}
+
+// 把LastApplied之后已提交的日志按顺序应用到状态机, 调用方需持有applyMu
+func (r *Raft) applyCommitted() {
+	r.Mu.Lock()
+	entries := r.log.slice(r.LastApplied+1, int(r.CommitIndex-r.LastApplied))
+	r.Mu.Unlock()
+
+	for _, e := range entries {
+		var data interface{}
+		if e.Type == EntryCommand {
+			data = r.StateMachine.Apply(e)
+		}
+		r.Mu.Lock()
+		if e.Index != r.LastApplied+1 {
+			// 应用期间安装了快照
+			r.Mu.Unlock()
+			return
+		}
+		r.LastApplied = e.Index
+		r.appliedBytes += int64(len(e.Data))
+		if p, ok := r.proposals[e.Index]; ok {
+			delete(r.proposals, e.Index)
+			if p.term == e.Term {
+				p.done <- applyResult{data: data}
+			} else {
+				p.done <- applyResult{err: ErrLeadershipLost}
+			}
+		}
+		r.Mu.Unlock()
+	}
+}
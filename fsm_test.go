@@ -0,0 +1,61 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestProposeAndWaitReturnsApplyResult(t *testing.T) {
+	c := newTestCluster(t, 3, nil)
+	c.waitFor("选出leader", 20*time.Second, func() bool { return c.leader() != nil })
+	leader := c.leader()
+	var fsm *testFSM
+	for i, r := range c.nodes {
+		if r == leader {
+			fsm = c.fsms[i]
+		}
+	}
+	for i := 1; i <= 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		res, err := leader.ProposeAndWait(ctx, []byte(fmt.Sprintf("cmd%d", i)))
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// testFSM.Apply返回已经应用的命令数
+		if res != len(fsm.commands()) {
+			t.Fatalf("第%d条命令的结果是%v,状态机有%d条命令", i, res, len(fsm.commands()))
+		}
+	}
+	c.waitFor("全部节点应用相同的日志", 20*time.Second, c.converged)
+	for i, f := range c.fsms {
+		if got := fmt.Sprint(f.commands()); got != "[cmd1 cmd2 cmd3]" {
+			t.Fatalf("n%d按顺序应用的命令是%s", i+1, got)
+		}
+	}
+}
+
+func TestProposeAndWaitContextCanceled(t *testing.T) {
+	c := newTestCluster(t, 3, nil)
+	c.waitFor("选出leader", 20*time.Second, func() bool { return c.leader() != nil })
+	leader := c.leader()
+	for _, r := range c.nodes {
+		if r != leader {
+			c.net.Isolate(r.Address)
+		}
+	}
+	// 命令无法提交, 等待到超时返回, 不再登记等待的结果
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if _, err := leader.ProposeAndWait(ctx, []byte("x")); err != context.DeadlineExceeded {
+		t.Fatalf("超时后返回%v", err)
+	}
+	leader.Mu.Lock()
+	n := len(leader.proposals)
+	leader.Mu.Unlock()
+	if n != 0 {
+		t.Fatalf("超时后还有%d个等待中的命令", n)
+	}
+}
@@ -0,0 +1,171 @@
+//go:build go1.24
+// +build go1.24
+
+package health
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// GRPC 使用gRPC健康检查协议(grpc.health.v1.Health/Check), 服务状态为SERVING时为passing
+// 不依赖gRPC库, 用net/http发送HTTP/2请求(h2c), 配置TLSConfig时使用TLS; 需要Go 1.24及以上
+type GRPC struct {
+	Address   string      // host:port
+	Service   string      // 服务名称, 为空时检查整个服务器
+	TLSConfig *tls.Config `json:"-"`
+}
+
+// grpc.health.v1.HealthCheckResponse.ServingStatus
+var grpcServingStatus = map[uint64]string{
+	0: "UNKNOWN",
+	1: "SERVING",
+	2: "NOT_SERVING",
+	3: "SERVICE_UNKNOWN",
+}
+
+const grpcServing = 1
+
+func (g *GRPC) Check(ctx context.Context) Result {
+	status, err := g.check(ctx)
+	if err != nil {
+		return Critical(err.Error())
+	}
+	name, ok := grpcServingStatus[status]
+	if !ok {
+		name = fmt.Sprintf("STATUS(%d)", status)
+	}
+	if status != grpcServing {
+		return Critical(name)
+	}
+	return Passing(name)
+}
+
+func (g *GRPC) check(ctx context.Context) (uint64, error) {
+	// 不使用TLS时用h2c(HTTP/2 prior knowledge)
+	protocols := new(http.Protocols)
+	transport := &http.Transport{Protocols: protocols}
+	defer transport.CloseIdleConnections()
+	scheme := "http"
+	if g.TLSConfig != nil {
+		protocols.SetHTTP2(true)
+		transport.TLSClientConfig = g.TLSConfig.Clone()
+		scheme = "https"
+	} else {
+		protocols.SetUnencryptedHTTP2(true)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, scheme+"://"+g.Address+"/grpc.health.v1.Health/Check",
+		bytes.NewReader(grpcHealthRequest(g.Service)))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("content-type", "application/grpc")
+	req.Header.Set("te", "trailers")
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("gRPC健康检查响应状态%s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return 0, err
+	}
+	// 读完响应体后才有trailer, 只有响应头的错误响应把grpc-status放在响应头中
+	code, message := resp.Trailer.Get("grpc-status"), resp.Trailer.Get("grpc-message")
+	if code == "" {
+		code, message = resp.Header.Get("grpc-status"), resp.Header.Get("grpc-message")
+	}
+	if code != "" && code != "0" {
+		if m, err := url.PathUnescape(message); err == nil {
+			message = m
+		}
+		return 0, fmt.Errorf("gRPC健康检查错误,grpc-status %s:%s", code, message)
+	}
+	msg, ok := grpcMessage(body)
+	if !ok {
+		return 0, errors.New("gRPC健康检查响应不完整")
+	}
+	return parseHealthCheckResponse(msg)
+}
+
+// 健康检查响应只有一个枚举字段, 读取响应体时的上限
+const maxResponseSize = 64 * 1024
+
+// gRPC消息: 1字节压缩标志和4字节长度, 后面是HealthCheckRequest{string service = 1}
+func grpcHealthRequest(service string) []byte {
+	var msg []byte
+	if service != "" {
+		var l [binary.MaxVarintLen64]byte
+		n := binary.PutUvarint(l[:], uint64(len(service)))
+		msg = append(msg, 0x0a)
+		msg = append(msg, l[:n]...)
+		msg = append(msg, service...)
+	}
+	b := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(b[1:], uint32(len(msg)))
+	return append(b, msg...)
+}
+
+// 从gRPC数据中取出第一条完整的消息
+func grpcMessage(data []byte) ([]byte, bool) {
+	if len(data) < 5 {
+		return nil, false
+	}
+	n := binary.BigEndian.Uint32(data[1:5])
+	if uint64(len(data)-5) < uint64(n) {
+		return nil, false
+	}
+	return data[5 : 5+int(n)], true
+}
+
+// 解析HealthCheckResponse{ServingStatus status = 1}, 字段为默认值0时消息为空
+func parseHealthCheckResponse(msg []byte) (uint64, error) {
+	var status uint64
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return 0, errors.New("gRPC健康检查响应格式错误")
+		}
+		msg = msg[n:]
+		switch tag & 7 {
+		case 0:
+			v, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return 0, errors.New("gRPC健康检查响应格式错误")
+			}
+			msg = msg[n:]
+			if tag>>3 == 1 {
+				status = v
+			}
+		case 1, 5:
+			size := 8
+			if tag&7 == 5 {
+				size = 4
+			}
+			if len(msg) < size {
+				return 0, errors.New("gRPC健康检查响应格式错误")
+			}
+			msg = msg[size:]
+		case 2:
+			l, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < l {
+				return 0, errors.New("gRPC健康检查响应格式错误")
+			}
+			msg = msg[n+int(l):]
+		default:
+			return 0, errors.New("gRPC健康检查响应格式错误")
+		}
+	}
+	return status, nil
+}
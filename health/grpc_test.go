@@ -0,0 +1,126 @@
+//go:build go1.24
+// +build go1.24
+
+package health
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// h2c的gRPC健康检查服务, 按请求的服务名称返回不同的响应
+func newGRPCServer(t *testing.T) string {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/grpc.health.v1.Health/Check", func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		msg, _ := grpcMessage(body)
+		service := ""
+		if len(msg) > 2 {
+			service = string(msg[2:])
+		}
+		if req.ProtoMajor != 2 || req.Header.Get("content-type") != "application/grpc" {
+			http.Error(w, "不是gRPC请求", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("content-type", "application/grpc")
+		switch service {
+		case "unknown":
+			// 只有响应头的错误响应
+			w.Header().Set("grpc-status", "5")
+			w.Header().Set("grpc-message", "unknown%20service")
+			w.WriteHeader(http.StatusOK)
+		case "truncated":
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte{0, 0, 0, 0, 9, 0x08})
+		default:
+			status := map[string]byte{"": 1, "serving": 1, "stopped": 2, "default": 0}[service]
+			w.Header().Set("Trailer", "grpc-status")
+			w.WriteHeader(http.StatusOK)
+			if status == 0 {
+				_, _ = w.Write([]byte{0, 0, 0, 0, 0})
+			} else {
+				_, _ = w.Write([]byte{0, 0, 0, 0, 2, 0x08, status})
+			}
+			w.Header().Set("grpc-status", "0")
+		}
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	srv := &http.Server{Handler: mux, Protocols: protocols}
+	go func() { _ = srv.Serve(ln) }()
+	t.Cleanup(func() { _ = srv.Close() })
+	return ln.Addr().String()
+}
+
+func TestGRPCCheck(t *testing.T) {
+	address := newGRPCServer(t)
+	cases := []struct {
+		service string
+		status  Status
+		output  string
+	}{
+		{"", StatusPassing, "SERVING"},
+		{"serving", StatusPassing, "SERVING"},
+		{"stopped", StatusCritical, "NOT_SERVING"},
+		{"default", StatusCritical, "UNKNOWN"},
+		{"unknown", StatusCritical, "grpc-status 5:unknown service"},
+		{"truncated", StatusCritical, "响应不完整"},
+	}
+	for _, tc := range cases {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		result := (&GRPC{Address: address, Service: tc.service}).Check(ctx)
+		cancel()
+		if result.Status != tc.status || !strings.Contains(result.Output, tc.output) {
+			t.Fatalf("服务%q的检查结果是%+v", tc.service, result)
+		}
+	}
+	// 不是gRPC服务的地址
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address = ln.Addr().String()
+	ln.Close()
+	if result := (&GRPC{Address: address}).Check(context.Background()); result.Status != StatusCritical {
+		t.Fatalf("连接失败时检查结果是%+v", result)
+	}
+}
+
+func TestGRPCHealthRequest(t *testing.T) {
+	if got := grpcHealthRequest(""); string(got) != "\x00\x00\x00\x00\x00" {
+		t.Fatalf("空服务名的请求是%q", got)
+	}
+	msg, ok := grpcMessage(grpcHealthRequest("raft"))
+	if !ok || string(msg) != "\x0a\x04raft" {
+		t.Fatalf("请求消息是%q", msg)
+	}
+	cases := []struct {
+		msg    []byte
+		status uint64
+		ok     bool
+	}{
+		{nil, 0, true},
+		{[]byte{0x08, 0x02}, 2, true},
+		// 未知字段跳过
+		{[]byte{0x12, 0x01, 'x', 0x19, 1, 2, 3, 4, 5, 6, 7, 8, 0x08, 0x01}, 1, true},
+		{[]byte{0x08}, 0, false},
+		{[]byte{0x12, 0x05, 'x'}, 0, false},
+		{[]byte{0x0b}, 0, false},
+	}
+	for _, tc := range cases {
+		status, err := parseHealthCheckResponse(tc.msg)
+		if status != tc.status || (err == nil) != tc.ok {
+			t.Fatalf("解析%x得到%d %v", tc.msg, status, err)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package health
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"os/exec"
@@ -11,30 +12,40 @@ import (
 	"github.com/kylin-ops/raft/http/httpclient/grequest"
 )
 
-type Checker interface{
-	Do()error
+type Checker interface {
+	Do() error
 }
 
-type Default struct {}
+type Default struct{}
 
-func(*Default)Do()error{
+func (*Default) Do() error {
 	return nil
 }
 
+func (*Default) Check(ctx context.Context) Result {
+	return Passing("")
+}
+
 type Http struct {
-	Addr   string
-	Method string
+	Addr    string
+	Method  string
 	Options *grequest.RequestOptions
 }
 
-func (h *Http)Do()error{
-	if h.Options.Timeout == 0 {
-		h.Options.Timeout = time.Second
+// 使用Options的副本, 不修改调用方的配置
+func (h *Http) Do() error {
+	var options grequest.RequestOptions
+	if h.Options != nil {
+		options = *h.Options
+	}
+	if options.Timeout == 0 {
+		options.Timeout = time.Second
 	}
-	if h.Method == "" {
-		h.Method = "GET"
+	method := h.Method
+	if method == "" {
+		method = "GET"
 	}
-	resp, err := grequest.Request(h.Addr, strings.ToUpper(h.Method), h.Options)
+	resp, err := grequest.Request(h.Addr, strings.ToUpper(method), &options)
 	if err != nil {
 		return err
 	}
@@ -48,26 +59,50 @@ func (h *Http)Do()error{
 type Command struct {
 	Command string
 	Params  []string
-	Timeout time.Duration
+	Timeout time.Duration // 为0时不限制执行时间
+}
+
+func (c *Command) Do() error {
+	ctx := context.Background()
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	return c.Check(ctx).Err()
 }
 
-func (c *Command)Do()error{
+// Check 执行命令, 退出码不为0时为critical, 输出为命令的标准输出和标准错误
+// ctx结束时杀掉命令所在的进程组
+func (c *Command) Check(ctx context.Context) Result {
+	var out bytes.Buffer
 	cmd := exec.Command(c.Command, c.Params...)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 	if err := cmd.Start(); err != nil {
-		return err
+		return Critical(err.Error())
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		err = ctx.Err()
 	}
-	ctx, cancel := context.WithCancel(context.Background())
-	time.AfterFunc(c.Timeout, func ()  {
-		select{
-		case <- ctx.Done():
-			return
-		default:
-			_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	output := strings.TrimSpace(out.String())
+	if err != nil {
+		if output != "" {
+			output = err.Error() + ": " + output
+		} else {
+			output = err.Error()
 		}
-	})
-	err := cmd.Wait()
-	cancel()
-	
-	return err
-}
\ No newline at end of file
+		return Critical(output)
+	}
+	return Passing(output)
+}
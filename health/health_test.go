@@ -0,0 +1,114 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckers(t *testing.T) {
+	dir := t.TempDir()
+	exists := filepath.Join(dir, "exists")
+	if err := ioutil.WriteFile(exists, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	pidFile := filepath.Join(dir, "pid")
+	_ = ioutil.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+	badPidFile := filepath.Join(dir, "bad_pid")
+	_ = ioutil.WriteFile(badPidFile, []byte("abc"), 0644)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closedAddress := closed.Addr().String()
+	closed.Close()
+	self, _ := ioutil.ReadFile("/proc/self/comm")
+
+	cases := []struct {
+		name    string
+		checker CheckerV2
+		status  Status
+	}{
+		{"Default", &Default{}, StatusPassing},
+		{"文件存在", &File{Path: exists}, StatusPassing},
+		{"文件不存在", &File{Path: filepath.Join(dir, "missing")}, StatusCritical},
+		{"维护开关文件存在", &File{Path: exists, Absent: true}, StatusCritical},
+		{"维护开关文件不存在", &File{Path: filepath.Join(dir, "missing"), Absent: true}, StatusPassing},
+		{"TCP连接成功", &TCP{Address: ln.Addr().String()}, StatusPassing},
+		{"TCP连接失败", &TCP{Address: closedAddress}, StatusCritical},
+		{"pid文件中的进程存在", &Process{PidFile: pidFile}, StatusPassing},
+		{"pid文件不存在", &Process{PidFile: filepath.Join(dir, "missing")}, StatusCritical},
+		{"pid文件内容错误", &Process{PidFile: badPidFile}, StatusCritical},
+		{"按名称查找进程", &Process{Name: strings.TrimSpace(string(self))}, StatusPassing},
+		{"进程名称不存在", &Process{Name: "no-such-process"}, StatusCritical},
+		{"磁盘空间不检查阈值", &DiskFree{Path: dir}, StatusPassing},
+		{"磁盘剩余比例低于警告阈值", &DiskFree{Path: dir, WarnFreePercent: 101}, StatusWarning},
+		{"磁盘剩余比例低于最低阈值", &DiskFree{Path: dir, MinFreePercent: 101, WarnFreePercent: 101}, StatusCritical},
+		{"磁盘剩余字节低于最低阈值", &DiskFree{Path: dir, MinFreeBytes: 1 << 62}, StatusCritical},
+		{"磁盘路径不存在", &DiskFree{Path: filepath.Join(dir, "missing")}, StatusCritical},
+		{"命令成功", &Command{Command: "true"}, StatusPassing},
+		{"命令失败", &Command{Command: "false"}, StatusCritical},
+		{"命令不存在", &Command{Command: filepath.Join(dir, "missing")}, StatusCritical},
+		{"Func返回nil", Func(func(ctx context.Context) error { return nil }), StatusPassing},
+		{"Func返回错误", Func(func(ctx context.Context) error { return errors.New("失败") }), StatusCritical},
+		{"CheckerFunc返回警告", CheckerFunc(func(ctx context.Context) Result { return Warning("慢") }), StatusWarning},
+		{"适配Checker", Adapt(&Command{Command: "false"}), StatusCritical},
+	}
+	for _, tc := range cases {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		result := tc.checker.Check(ctx)
+		cancel()
+		if result.Status != tc.status {
+			t.Fatalf("%s: 检查结果是%+v,应该是%s", tc.name, result, tc.status)
+		}
+		if (result.Err() != nil) != (tc.status == StatusCritical) {
+			t.Fatalf("%s: 检查结果%s的Err是%v", tc.name, result.Status, result.Err())
+		}
+	}
+}
+
+func TestCommandKilledOnTimeout(t *testing.T) {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	// sh启动的子进程在同一个进程组, 一起被杀掉
+	result := (&Command{Command: "sh", Params: []string{"-c", "sleep 10; echo done"}}).Check(ctx)
+	if result.Status != StatusCritical || time.Since(start) > 5*time.Second {
+		t.Fatalf("超时的命令%s后返回%+v", time.Since(start), result)
+	}
+	if err := (&Command{Command: "sleep", Params: []string{"10"}, Timeout: 100 * time.Millisecond}).Do(); err == nil {
+		t.Fatal("Do超时后应该返回错误")
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	// 不响应ctx的检查, Run不等待它返回
+	result := Run(ctx, Func(func(ctx context.Context) error {
+		<-block
+		return nil
+	}))
+	if result.Status != StatusCritical || result.Latency < 100*time.Millisecond || result.Latency > 5*time.Second {
+		t.Fatalf("超时的检查结果是%+v", result)
+	}
+	result = Run(context.Background(), CheckerFunc(func(ctx context.Context) Result { return Passing("ok") }))
+	if result.Status != StatusPassing || result.Output != "ok" {
+		t.Fatalf("检查结果是%+v", result)
+	}
+	// 已经实现CheckerV2的Checker直接使用
+	if _, ok := Adapt(&Default{}).(*Default); !ok {
+		t.Fatal("Default应该直接作为CheckerV2")
+	}
+}
@@ -0,0 +1,64 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// TCP 能建立TCP连接时为passing
+type TCP struct {
+	Address string // host:port
+}
+
+func (t *TCP) Check(ctx context.Context) Result {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", t.Address)
+	if err != nil {
+		return Critical(err.Error())
+	}
+	_ = conn.Close()
+	return Passing("连接" + t.Address + "成功")
+}
+
+// DNS 能解析出地址时为passing
+type DNS struct {
+	Name   string // 需要解析的域名
+	Server string // DNS服务器host:port, 为空时使用系统配置
+	// 解析结果需要包含的地址, 为空时不检查
+	Expect []string
+}
+
+func (d *DNS) Check(ctx context.Context) Result {
+	resolver := net.DefaultResolver
+	if d.Server != "" {
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, d.Server)
+			},
+		}
+	}
+	addrs, err := resolver.LookupHost(ctx, d.Name)
+	if err != nil {
+		return Critical(err.Error())
+	}
+	if len(addrs) == 0 {
+		return Critical(fmt.Sprintf("%s没有解析出地址", d.Name))
+	}
+	for _, expect := range d.Expect {
+		found := false
+		for _, addr := range addrs {
+			if addr == expect {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return Critical(fmt.Sprintf("%s的解析结果%s不包含%s", d.Name, strings.Join(addrs, ","), expect))
+		}
+	}
+	return Passing(strings.Join(addrs, ","))
+}
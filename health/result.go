@@ -0,0 +1,112 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Status 检查结果的状态
+type Status string
+
+const (
+	StatusPassing  Status = "passing"  // 正常
+	StatusWarning  Status = "warning"  // 需要关注, 节点仍然算作健康
+	StatusCritical Status = "critical" // 不正常
+)
+
+// Result 检查结果
+type Result struct {
+	Status  Status        `json:"status"`
+	Output  string        `json:"output"`  // 检查的输出或者错误信息
+	Latency time.Duration `json:"latency"` // 检查耗时, 由Run填写
+}
+
+// Err critical时返回Output作为错误, 否则返回nil
+func (r Result) Err() error {
+	if r.Status != StatusCritical {
+		return nil
+	}
+	if r.Output == "" {
+		return errors.New("健康检查失败")
+	}
+	return errors.New(r.Output)
+}
+
+func Passing(output string) Result {
+	return Result{Status: StatusPassing, Output: output}
+}
+
+func Warning(output string) Result {
+	return Result{Status: StatusWarning, Output: output}
+}
+
+func Critical(output string) Result {
+	return Result{Status: StatusCritical, Output: output}
+}
+
+// 根据error返回passing或者critical
+func fromError(err error, output string) Result {
+	if err != nil {
+		return Critical(err.Error())
+	}
+	return Passing(output)
+}
+
+// CheckerV2 支持context的健康检查, ctx结束时应该尽快返回
+type CheckerV2 interface {
+	Check(ctx context.Context) Result
+}
+
+// CheckerFunc 把函数作为CheckerV2, 可以返回warning
+type CheckerFunc func(ctx context.Context) Result
+
+func (f CheckerFunc) Check(ctx context.Context) Result {
+	return f(ctx)
+}
+
+// Func 把返回error的函数作为CheckerV2, 返回error时为critical
+type Func func(ctx context.Context) error
+
+func (f Func) Check(ctx context.Context) Result {
+	return fromError(f(ctx), "")
+}
+
+// Run 执行检查并填写耗时, ctx结束时不等待检查返回
+func Run(ctx context.Context, c CheckerV2) Result {
+	start := time.Now()
+	ch := make(chan Result, 1)
+	go func() {
+		ch <- c.Check(ctx)
+	}()
+	var result Result
+	select {
+	case result = <-ch:
+	case <-ctx.Done():
+		result = Critical("健康检查超时:" + ctx.Err().Error())
+	}
+	result.Latency = time.Since(start)
+	return result
+}
+
+// Adapt 把Checker适配为CheckerV2, Do返回error时为critical; c已经实现了CheckerV2时直接返回
+// Do不支持取消, ctx结束时Run不再等待它返回
+func Adapt(c Checker) CheckerV2 {
+	if v2, ok := c.(CheckerV2); ok {
+		return v2
+	}
+	return &adapter{Checker: c}
+}
+
+type adapter struct {
+	Checker Checker
+}
+
+func (a *adapter) Check(ctx context.Context) Result {
+	return fromError(a.Checker.Do(), "")
+}
+
+func (a *adapter) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.Checker)
+}
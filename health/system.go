@@ -0,0 +1,110 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// File 文件存在时为passing
+type File struct {
+	Path string
+	// 为true时文件存在为critical, 可以作为维护开关: 创建文件后节点变为不健康, leader转移给其他成员
+	Absent bool
+}
+
+func (f *File) Check(ctx context.Context) Result {
+	_, err := os.Stat(f.Path)
+	exists := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return Critical(err.Error())
+	}
+	switch {
+	case exists && f.Absent:
+		return Critical("文件" + f.Path + "存在")
+	case !exists && !f.Absent:
+		return Critical("文件" + f.Path + "不存在")
+	}
+	return Passing("")
+}
+
+// Process 进程存在时为passing, 配置PidFile时检查文件中的进程id, 否则按进程名称在/proc中查找
+type Process struct {
+	Name    string // 进程名称, 即/proc/<pid>/comm, 超过15个字符时只比较前15个字符
+	PidFile string
+}
+
+func (p *Process) Check(ctx context.Context) Result {
+	if p.PidFile != "" {
+		d, err := ioutil.ReadFile(p.PidFile)
+		if err != nil {
+			return Critical(err.Error())
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(d)))
+		if err != nil || pid <= 0 {
+			return Critical(fmt.Sprintf("%s中的进程id不正确", p.PidFile))
+		}
+		// 发送0信号只检查进程是否存在, 没有权限时进程也存在
+		if err := syscall.Kill(pid, 0); err != nil && err != syscall.EPERM {
+			return Critical(fmt.Sprintf("进程%d不存在:%s", pid, err.Error()))
+		}
+		return Passing(fmt.Sprintf("进程%d存在", pid))
+	}
+	name := p.Name
+	if len(name) > 15 {
+		name = name[:15]
+	}
+	comms, err := filepath.Glob("/proc/[0-9]*/comm")
+	if err != nil {
+		return Critical(err.Error())
+	}
+	for _, comm := range comms {
+		if ctx.Err() != nil {
+			return Critical(ctx.Err().Error())
+		}
+		d, err := ioutil.ReadFile(comm)
+		if err != nil {
+			continue
+		}
+		if strings.TrimSpace(string(d)) == name {
+			return Passing(fmt.Sprintf("进程%s存在", filepath.Base(filepath.Dir(comm))))
+		}
+	}
+	return Critical(fmt.Sprintf("进程%s不存在", p.Name))
+}
+
+// DiskFree 检查Path所在文件系统的剩余空间
+// 剩余空间低于MinFreeBytes或者MinFreePercent时为critical, 低于WarnFreePercent时为warning, 为0的条件不检查
+type DiskFree struct {
+	Path            string
+	MinFreeBytes    uint64
+	MinFreePercent  float64
+	WarnFreePercent float64
+}
+
+func (d *DiskFree) Check(ctx context.Context) Result {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(d.Path, &st); err != nil {
+		return Critical(err.Error())
+	}
+	free := uint64(st.Bavail) * uint64(st.Bsize)
+	total := uint64(st.Blocks) * uint64(st.Bsize)
+	percent := 100.0
+	if total > 0 {
+		percent = float64(free) / float64(total) * 100
+	}
+	output := fmt.Sprintf("%s剩余%d字节(%.1f%%)", d.Path, free, percent)
+	switch {
+	case d.MinFreeBytes > 0 && free < d.MinFreeBytes,
+		d.MinFreePercent > 0 && percent < d.MinFreePercent:
+		return Critical(output)
+	case d.WarnFreePercent > 0 && percent < d.WarnFreePercent:
+		return Warning(output)
+	}
+	return Passing(output)
+}
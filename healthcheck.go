@@ -0,0 +1,198 @@
+// 本节点的健康检查
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/kylin-ops/raft/health"
+)
+
+// HealthResult 一次健康检查的结果
+type HealthResult struct {
+	Healthy bool          `json:"healthy"` // critical时为false, warning仍然算作健康
+	Status  health.Status `json:"status"`  // passing/warning/critical
+	Latency float64       `json:"latency"` // 耗时(毫秒)
+	Message string        `json:"message"` // 检查的输出或者错误信息
+	Time    time.Time     `json:"time"`    // 开始检查的时间
+}
+
+// HealthStatus 本节点的健康检查状态
+type HealthStatus struct {
+	Healthy   bool           `json:"healthy"`
+	Successes int64          `json:"successes"` // 连续成功的次数
+	Failures  int64          `json:"failures"`  // 连续失败的次数
+	History   []HealthResult `json:"history"`   // 最近的检查结果, 最新的在最后
+}
+
+// 后台定时执行健康检查, 健康状态变化时发出事件
+// 连续失败HealthCheckFall次变为不健康, 连续成功HealthCheckRise次恢复健康, 避免偶尔一次失败导致leader切换
+// 健康检查失败的节点不参与选举, leader把leader转移给健康的成员后退位
+func (r *Raft) BackendHealthCheck() {
+	var pending chan health.Result
+	for {
+		pending = r.checkHealth(pending)
+		if !r.sleep(time.Duration(r.HealthCheckInterval) * time.Second) {
+			return
+		}
+	}
+}
+
+// 执行一次健康检查并记录结果, 返回仍在执行的超时检查
+func (r *Raft) checkHealth(pending chan health.Result) chan health.Result {
+	start := time.Now()
+	pending, check := r.runHealthChecker(pending)
+	select {
+	case <-r.done:
+		return pending
+	default:
+	}
+	latency := time.Since(start)
+	r.Metrics.ObserveHistogram(MetricHealthCheckDuration, nil, latency.Seconds())
+	err := check.Err()
+	result := HealthResult{
+		Healthy: err == nil,
+		Status:  check.Status,
+		Latency: float64(latency) / float64(time.Millisecond),
+		Message: check.Output,
+		Time:    start,
+	}
+	if err != nil {
+		r.Metrics.IncCounter(MetricHealthCheckFailures, nil)
+	}
+
+	r.Mu.Lock()
+	changed := r.recordHealth(result)
+	healthy := r.Health.Healthy
+	failures := r.Health.Failures
+	if m, ok := r.Members[r.Id]; ok {
+		m.Unhealthy = !healthy
+	}
+	leader := r.Role == RoleLeader
+	if changed && healthy {
+		r.emit(EventHealthy, "")
+	} else if changed {
+		r.emit(EventUnhealthy, "")
+	}
+	r.Mu.Unlock()
+
+	log := r.logWith(LogHealth)
+	if changed && healthy {
+		log.Infof("健康检查连续成功%d次,恢复正常,重新参与选举", r.HealthCheckRise)
+	}
+	if check.Status == health.StatusWarning {
+		log.Debugf("健康检查警告:%s", check.Output)
+	}
+	if err != nil {
+		d, _ := json.Marshal(r.HealthCheckerV2)
+		if changed {
+			log.Warnf("健康检查连续错误%d次,不再参与选举,执行信息:%s 错误信息:%s", failures, string(d), err.Error())
+		} else {
+			log.Debugf("健康检查错误(连续%d次),执行信息:%s 错误信息:%s", failures, string(d), err.Error())
+		}
+	}
+	if !healthy && leader {
+		r.stepDownUnhealthy()
+	}
+	return pending
+}
+
+// 在单独的goroutine中执行检查, ctx在HealthCheckTimeout后结束, 超时没有返回时记为失败
+// 不支持取消的检查超时后仍在执行时不启动新的检查, 继续等待它的结果, 避免检查堆积
+func (r *Raft) runHealthChecker(pending chan health.Result) (chan health.Result, health.Result) {
+	timeout := time.Duration(r.HealthCheckTimeout) * time.Second
+	if pending == nil {
+		pending = make(chan health.Result, 1)
+		go func(ch chan health.Result) {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			ch <- r.HealthCheckerV2.Check(ctx)
+		}(pending)
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case result := <-pending:
+		return nil, result
+	case <-timer.C:
+		return pending, health.Critical(fmt.Sprintf("健康检查超过%d秒没有返回", r.HealthCheckTimeout))
+	case <-r.done:
+		return pending, health.Result{}
+	}
+}
+
+// 记录检查结果并更新健康状态, 返回健康状态是否变化, 调用方需持有锁
+func (r *Raft) recordHealth(result HealthResult) bool {
+	h := &r.Health
+	if result.Healthy {
+		h.Successes++
+		h.Failures = 0
+	} else {
+		h.Failures++
+		h.Successes = 0
+	}
+	h.History = append(h.History, result)
+	if n := len(h.History) - int(r.HealthCheckHistory); n > 0 {
+		copy(h.History, h.History[n:])
+		h.History = h.History[:len(h.History)-n]
+	}
+	if h.Healthy && h.Failures >= r.HealthCheckFall {
+		h.Healthy = false
+		return true
+	}
+	if !h.Healthy && h.Successes >= r.HealthCheckRise {
+		h.Healthy = true
+		return true
+	}
+	return false
+}
+
+// HealthStatus 返回本节点的健康状态、连续成功或者失败的次数和最近的检查结果
+func (r *Raft) HealthStatus() HealthStatus {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	status := r.Health
+	status.History = append([]HealthResult(nil), r.Health.History...)
+	return status
+}
+
+// 健康检查失败的leader把leader转移给心跳在线、健康且日志最新的成员
+// 没有这样的成员或者转移失败时直接退位, 等其他健康的成员发起选举
+func (r *Raft) stepDownUnhealthy() {
+	r.Mu.Lock()
+	target := r.transferTarget()
+	r.Mu.Unlock()
+	if target != "" {
+		r.logWith(LogElection).Warnf("本节点健康检查错误,把leader转移给%s", target)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(r.Timeout)*time.Second)
+		err := r.TransferLeadership(ctx, target)
+		cancel()
+		if err == nil {
+			return
+		}
+		r.logWith(LogElection).Warnf("把leader转移给%s错误:%s", target, err.Error())
+	}
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	if r.Role != RoleLeader || r.Health.Healthy {
+		return
+	}
+	r.logWith(LogElection).Warnf("本节点健康检查错误,leader退位")
+	r.becomeFollower(r.CurrentTerm, "")
+}
+
+// 选择leader转移的目标: 心跳在线、健康检查正常且日志最新的有投票权的成员, 调用方需持有锁
+func (r *Raft) transferTarget() string {
+	var target string
+	for id, m := range r.Members {
+		if id == r.Id || m.Learner || m.Unhealthy || m.HeartbeatStatus != "online" {
+			continue
+		}
+		if target == "" || r.matchIndex[id] > r.matchIndex[target] {
+			target = id
+		}
+	}
+	return target
+}
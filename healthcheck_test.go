@@ -0,0 +1,214 @@
+package raft
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kylin-ops/raft/health"
+)
+
+// 可以在测试中切换结果的健康检查
+type switchChecker struct {
+	mu      sync.Mutex
+	failing bool
+}
+
+func (c *switchChecker) Check(ctx context.Context) health.Result {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failing {
+		return health.Critical("模拟的检查失败")
+	}
+	return health.Passing("")
+}
+
+func (c *switchChecker) set(failing bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failing = failing
+}
+
+// 每个节点使用单独的健康检查, 连续失败或者成功一次就改变健康状态
+func newHealthCluster(t *testing.T) (*testCluster, map[string]*switchChecker) {
+	checkers := map[string]*switchChecker{}
+	c := newTestCluster(t, 3, func(o *Options) {
+		checkers[o.Id] = &switchChecker{}
+		o.HealthCheckerV2 = checkers[o.Id]
+		o.HealthCheckRise = 1
+		o.HealthCheckFall = 1
+	})
+	return c, checkers
+}
+
+func TestUnhealthyLeaderTransfersLeadership(t *testing.T) {
+	c, checkers := newHealthCluster(t)
+	c.waitFor("选出leader", 20*time.Second, func() bool { return c.leader() != nil })
+	c.propose("a")
+	old := c.leader()
+	c.waitFor("follower心跳在线", 10*time.Second, func() bool {
+		old.Mu.Lock()
+		defer old.Mu.Unlock()
+		for id, m := range old.Members {
+			if id != old.Id && m.HeartbeatStatus != "online" {
+				return false
+			}
+		}
+		return true
+	})
+	observer := &testObserver{}
+	old.Observe(observer.observe)
+
+	// leader健康检查失败后把leader转移给健康的成员, 自己不再参与选举
+	checkers[old.Id].set(true)
+	c.waitFor("leader转移给健康的成员", 20*time.Second, func() bool {
+		l := c.leader()
+		return l != nil && l != old
+	})
+	if !observer.has(EventUnhealthy, nil) {
+		t.Fatal("没有收到unhealthy事件")
+	}
+	leader := c.leader()
+	c.waitFor("新leader知道原leader不健康", 10*time.Second, func() bool {
+		leader.Mu.Lock()
+		defer leader.Mu.Unlock()
+		return leader.Members[old.Id].Unhealthy
+	})
+	c.propose("b")
+	c.waitFor("全部节点应用相同的日志", 20*time.Second, c.converged)
+	old.Mu.Lock()
+	role := old.Role
+	old.Mu.Unlock()
+	if role == RoleLeader {
+		t.Fatal("不健康的节点仍然是leader")
+	}
+
+	// 恢复后重新参与选举
+	checkers[old.Id].set(false)
+	c.waitFor("原leader恢复健康", 10*time.Second, func() bool {
+		return observer.has(EventHealthy, nil) && old.HealthStatus().Healthy
+	})
+}
+
+func TestUnhealthyLeaderStepsDownWithoutTarget(t *testing.T) {
+	c, checkers := newHealthCluster(t)
+	c.waitFor("选出leader", 20*time.Second, func() bool { return c.leader() != nil })
+	c.propose("a")
+	// 全部节点都不健康, leader没有可以转移的成员, 直接退位, 也没有节点发起选举
+	for _, checker := range checkers {
+		checker.set(true)
+	}
+	c.waitFor("leader退位", 20*time.Second, func() bool { return c.leader() == nil })
+	time.Sleep(3 * time.Second)
+	if l := c.leader(); l != nil {
+		t.Fatalf("不健康的%s成为了leader", l.Id)
+	}
+	for _, checker := range checkers {
+		checker.set(false)
+	}
+	c.waitFor("恢复后选出leader", 20*time.Second, func() bool { return c.leader() != nil })
+}
+
+func TestLeaderRefreshesOwnMemberStatus(t *testing.T) {
+	c := newTestCluster(t, 3, nil)
+	c.waitFor("选出leader", 20*time.Second, func() bool { return c.leader() != nil })
+	leader := c.leader()
+	c.waitFor("leader更新自己的成员状态", 10*time.Second, func() bool {
+		leader.Mu.Lock()
+		defer leader.Mu.Unlock()
+		self := leader.Members[leader.Id]
+		return self.Role == RoleLeader && self.LeaderId == leader.Id && self.HeartbeatStatus == "online" &&
+			time.Now().Unix()-self.LastHeartbeatTime <= 1 && time.Now().Unix()-leader.LastHeartbeatTime <= 1
+	})
+	// follower从心跳中看到leader的状态
+	for _, r := range c.nodes {
+		if r == leader {
+			continue
+		}
+		c.waitFor("follower同步leader的状态", 10*time.Second, func() bool {
+			r.Mu.Lock()
+			defer r.Mu.Unlock()
+			m := r.Members[leader.Id]
+			return m.Role == RoleLeader && m.HeartbeatStatus == "online"
+		})
+	}
+}
+
+func TestRecordHealthRiseAndFall(t *testing.T) {
+	r := newTestNode(t, func(o *Options) {
+		o.HealthCheckRise = 2
+		o.HealthCheckFall = 3
+		o.HealthCheckHistory = 4
+	})
+	steps := []struct {
+		healthy   bool // 本次检查的结果
+		changed   bool
+		status    bool // 记录后的健康状态
+		successes int64
+		failures  int64
+	}{
+		{false, false, true, 0, 1},
+		{false, false, true, 0, 2},
+		{true, false, true, 1, 0}, // 成功一次清零连续失败的次数
+		{false, false, true, 0, 1},
+		{false, false, true, 0, 2},
+		{false, true, false, 0, 3}, // 连续失败3次变为不健康
+		{false, false, false, 0, 4},
+		{true, false, false, 1, 0},
+		{true, true, true, 2, 0}, // 连续成功2次恢复健康
+		{true, false, true, 3, 0},
+	}
+	for i, step := range steps {
+		r.Mu.Lock()
+		changed := r.recordHealth(HealthResult{Healthy: step.healthy, Message: string(rune('a' + i))})
+		h := r.Health
+		r.Mu.Unlock()
+		if changed != step.changed || h.Healthy != step.status || h.Successes != step.successes || h.Failures != step.failures {
+			t.Fatalf("第%d次检查后变化%v状态%+v", i+1, changed, h)
+		}
+	}
+	// 只保留最近4次的结果, 最新的在最后
+	status := r.HealthStatus()
+	var messages string
+	for _, result := range status.History {
+		messages += result.Message
+	}
+	if messages != "ghij" {
+		t.Fatalf("保留的检查结果是%q", messages)
+	}
+	status.History[0].Message = "x"
+	if r.HealthStatus().History[0].Message != "g" {
+		t.Fatal("HealthStatus返回的结果和节点共用了数组")
+	}
+}
+
+func TestHealthCheckTimeout(t *testing.T) {
+	release := make(chan struct{})
+	calls := 0
+	var mu sync.Mutex
+	r := newTestNode(t, func(o *Options) {
+		o.HealthCheckTimeout = 1
+		// 不响应ctx的检查
+		o.HealthCheckerV2 = health.CheckerFunc(func(ctx context.Context) health.Result {
+			mu.Lock()
+			calls++
+			mu.Unlock()
+			<-release
+			return health.Passing("")
+		})
+	})
+	pending, result := r.runHealthChecker(nil)
+	if pending == nil || result.Status != health.StatusCritical {
+		t.Fatalf("超时的检查返回%+v", result)
+	}
+	// 上一次检查还没有返回时继续等待它, 不启动新的检查
+	close(release)
+	pending, result = r.runHealthChecker(pending)
+	mu.Lock()
+	n := calls
+	mu.Unlock()
+	if pending != nil || result.Status != health.StatusPassing || n != 1 {
+		t.Fatalf("等待上一次检查返回%+v,检查执行了%d次", result, n)
+	}
+}
@@ -35,6 +35,8 @@ type RequestOptions struct {
 	Params   Param
 	Timeout  time.Duration
 	BashAuth BaseAuth
+	// 为空时使用http.DefaultTransport
+	Transport http.RoundTripper
 }
 
 type responseBody struct {
@@ -71,7 +73,7 @@ func Request(url, method string, options ...*RequestOptions) (resp *Response, er
 	var r *http.Request
 	var response Response
 	var params []string
-	client := http.Client{Timeout: option.Timeout}
+	client := http.Client{Timeout: option.Timeout, Transport: option.Transport}
 	// 设置params
 	for k, v := range option.Params {
 		params = append(params, k+"="+v)
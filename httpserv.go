@@ -2,45 +2,171 @@
 package raft
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"time"
 
 	"github.com/kylin-ops/raft/http/httpserver/tools"
+	"github.com/kylin-ops/raft/logger"
 )
 
-func (r *Raft) httpServer() {
-	http.HandleFunc("/api/v1/election", r.electionRequest)
-	http.HandleFunc("/api/v1/heartbeat", r.heartbeatRequest)
-	http.HandleFunc("/api/v1/get_info", r.getRaftInfo)
-	if err := http.ListenAndServe(r.Address, nil); err != nil {
-		log.Fatalln(err.Error())
+// Handler 返回集群通信和管理接口的http.Handler, 路由带有RoutePrefix前缀
+// 配置DisableListen时把它挂载到应用自己的http服务中, 集群成员的Address需要指向应用的http服务
+func (r *Raft) Handler() http.Handler {
+	return r.handler
+}
+
+// PeerHandler 只包含成员之间通信接口的http.Handler, 由TLS和ClusterSecret保护
+func (r *Raft) PeerHandler() http.Handler {
+	return r.peerHandler
+}
+
+// AdminHandler 只包含运维接口(get_info、成员变更、leader转移)的http.Handler, 由Authorizer保护
+// 可以挂载到只在内网或者本机监听的http服务中, 和成员之间的接口分开保护
+func (r *Raft) AdminHandler() http.Handler {
+	return r.adminHandler
+}
+
+// 集群通信和管理接口的路由, 分别返回成员之间的接口、运维接口和全部接口
+func (r *Raft) routes() (peer, admin, all *http.ServeMux) {
+	peer, admin, all = http.NewServeMux(), http.NewServeMux(), http.NewServeMux()
+	prefix := r.RoutePrefix
+	handlePeer := func(path string, handler http.HandlerFunc) {
+		peer.HandleFunc(prefix+path, handler)
+		all.HandleFunc(prefix+path, handler)
+	}
+	handleAdmin := func(path string, handler http.HandlerFunc) {
+		admin.HandleFunc(prefix+path, r.authorize(handler))
+		all.HandleFunc(prefix+path, r.authorize(handler))
 	}
+	handlePeer("/api/v1/election", r.electionRequest)
+	handlePeer("/api/v1/heartbeat", r.heartbeatRequest)
+	handlePeer("/api/v1/install_snapshot", r.installSnapshotRequest)
+	handlePeer("/api/v1/timeout_now", r.timeoutNowRequest)
+	handlePeer("/api/v1/read_index", r.readIndexRequest)
+	handlePeer("/api/v1/stream", r.streamRequest)
+	handleAdmin("/api/v1/get_info", r.getRaftInfo)
+	handleAdmin("/api/v1/add_member", r.addMemberRequest)
+	handleAdmin("/api/v1/remove_member", r.removeMemberRequest)
+	handleAdmin("/api/v1/replace_member", r.replaceMemberRequest)
+	handleAdmin("/api/v1/add_learner", r.addLearnerRequest)
+	handleAdmin("/api/v1/promote_learner", r.promoteLearnerRequest)
+	handleAdmin("/api/v1/transfer_leader", r.transferLeaderRequest)
+	handleAdmin("/api/v1/log_level", r.logLevelRequest)
+	if handler, ok := r.Metrics.(http.Handler); ok {
+		handleAdmin("/metrics", handler.ServeHTTP)
+	}
+	return peer, admin, all
 }
 
 func (r *Raft) electionRequest(resp http.ResponseWriter, req *http.Request) {
 	var body Leader
 	data, _ := ioutil.ReadAll(req.Body)
 	_ = json.Unmarshal(data, &body)
-	if err := r.ElectionResponse(&body); err != nil {
-		r.Logger.Warnf("response election - %s", err.Error())
-		tools.ApiResponse(resp, 201, "", err.Error())
+	if !r.authorizePeer(resp, req, r.checkRequest(req, data, body.LeaderId)) {
 		return
 	}
-	tools.ApiResponse(resp, 200, "", "")
+	reply, err := r.ElectionResponse(&body)
+	if err != nil {
+		r.logWith(LogHTTP).Warnf("response election - %s", err.Error())
+		tools.ApiResponse(resp, 201, reply, err.Error())
+		return
+	}
+	tools.ApiResponse(resp, 200, reply, "")
 }
 
 func (r *Raft) heartbeatRequest(resp http.ResponseWriter, req *http.Request) {
 	var body HeartbeatBody
 	data, _ := ioutil.ReadAll(req.Body)
 	_ = json.Unmarshal(data, &body)
-	if err := r.HeartbeatResponse(&body); err != nil {
-		r.Logger.Warnf("response heartbeat - %s", err.Error())
-		tools.ApiResponse(resp, 201, "", err.Error())
+	if !r.authorizePeer(resp, req, r.checkRequest(req, data, body.Leader)) {
 		return
 	}
-	tools.ApiResponse(resp, 200, "", "")
+	reply, err := r.HeartbeatResponse(&body)
+	if err != nil {
+		r.logWith(LogHTTP).Warnf("response heartbeat - %s", err.Error())
+		tools.ApiResponse(resp, 201, reply, err.Error())
+		return
+	}
+	tools.ApiResponse(resp, 200, reply, "")
+}
+
+func (r *Raft) installSnapshotRequest(resp http.ResponseWriter, req *http.Request) {
+	var body InstallSnapshotBody
+	data, _ := ioutil.ReadAll(req.Body)
+	_ = json.Unmarshal(data, &body)
+	if !r.authorizePeer(resp, req, r.checkRequest(req, data, body.Leader)) {
+		return
+	}
+	reply, err := r.InstallSnapshotResponse(&body)
+	if err != nil {
+		r.logWith(LogHTTP).Warnf("response install snapshot - %s", err.Error())
+		tools.ApiResponse(resp, 201, reply, err.Error())
+		return
+	}
+	tools.ApiResponse(resp, 200, reply, "")
+}
+
+func (r *Raft) timeoutNowRequest(resp http.ResponseWriter, req *http.Request) {
+	var body TimeoutNowBody
+	data, _ := ioutil.ReadAll(req.Body)
+	_ = json.Unmarshal(data, &body)
+	if !r.authorizePeer(resp, req, r.checkRequest(req, data, body.Leader)) {
+		return
+	}
+	reply, err := r.TimeoutNowResponse(&body)
+	if err != nil {
+		r.logWith(LogHTTP).Warnf("response timeout now - %s", err.Error())
+		tools.ApiResponse(resp, 201, reply, err.Error())
+		return
+	}
+	tools.ApiResponse(resp, 200, reply, "")
+}
+
+// follower转发的读索引请求, 只在leader上处理, 不再继续转发
+func (r *Raft) readIndexRequest(resp http.ResponseWriter, req *http.Request) {
+	data, _ := ioutil.ReadAll(req.Body)
+	if !r.authorizePeer(resp, req, r.checkRequest(req, data, "")) {
+		return
+	}
+	ctx, cancel := r.stopContext(req.Context(), time.Duration(r.Timeout)*time.Second)
+	defer cancel()
+	index, err := r.readIndex(ctx)
+	if err != nil {
+		r.logWith(LogHTTP).Warnf("response read index - %s", err.Error())
+		r.Mu.Lock()
+		leader := r.CurrentLeader
+		r.Mu.Unlock()
+		tools.ApiResponse(resp, 201, map[string]string{"leader": leader}, err.Error())
+		return
+	}
+	tools.ApiResponse(resp, 200, &ReadIndexReply{Index: index}, "")
+}
+
+// 校验集群内部请求的发送方, 客户端证书和签名都需要属于成员id, id为空时属于任意成员
+func (r *Raft) checkRequest(req *http.Request, body []byte, id string) error {
+	var err error
+	if id == "" {
+		err = r.checkMemberPeer(req)
+	} else {
+		err = r.checkPeer(req, id)
+	}
+	if err != nil {
+		return err
+	}
+	return r.checkSignature(req, body, id)
+}
+
+// 集群内部请求的发送方校验失败时返回403, 对方按请求失败处理
+func (r *Raft) authorizePeer(resp http.ResponseWriter, req *http.Request, err error) bool {
+	if err == nil {
+		return true
+	}
+	r.logWith(LogHTTP).Warnf("拒绝%s的请求%s:%s", req.RemoteAddr, req.URL.Path, err.Error())
+	tools.ApiResponse(resp, http.StatusForbidden, nil, err.Error())
+	return false
 }
 
 func (r *Raft) getRaftInfo(resp http.ResponseWriter, req *http.Request) {
@@ -49,3 +175,95 @@ func (r *Raft) getRaftInfo(resp http.ResponseWriter, req *http.Request) {
 	tools.ApiResponse(resp, 200, r, "")
 	r.Mu.Unlock()
 }
+
+func (r *Raft) addMemberRequest(resp http.ResponseWriter, req *http.Request) {
+	r.memberChangeRequest(resp, req, func(ctx context.Context, body *MemberChangeBody) error {
+		return r.AddMember(ctx, body.Id, body.Address)
+	})
+}
+
+func (r *Raft) removeMemberRequest(resp http.ResponseWriter, req *http.Request) {
+	r.memberChangeRequest(resp, req, func(ctx context.Context, body *MemberChangeBody) error {
+		return r.RemoveMember(ctx, body.Id)
+	})
+}
+
+func (r *Raft) replaceMemberRequest(resp http.ResponseWriter, req *http.Request) {
+	r.memberChangeRequest(resp, req, func(ctx context.Context, body *MemberChangeBody) error {
+		return r.ReplaceMember(ctx, body.OldId, body.Id, body.Address)
+	})
+}
+
+func (r *Raft) addLearnerRequest(resp http.ResponseWriter, req *http.Request) {
+	r.memberChangeRequest(resp, req, func(ctx context.Context, body *MemberChangeBody) error {
+		return r.AddLearner(ctx, body.Id, body.Address)
+	})
+}
+
+func (r *Raft) promoteLearnerRequest(resp http.ResponseWriter, req *http.Request) {
+	r.memberChangeRequest(resp, req, func(ctx context.Context, body *MemberChangeBody) error {
+		return r.PromoteLearner(ctx, body.Id)
+	})
+}
+
+func (r *Raft) transferLeaderRequest(resp http.ResponseWriter, req *http.Request) {
+	r.memberChangeRequest(resp, req, func(ctx context.Context, body *MemberChangeBody) error {
+		return r.TransferLeadership(ctx, body.Id)
+	})
+}
+
+// 成员变更和leader转移只能在leader上执行, 失败时返回当前的leader方便调用方重试
+// 只接受POST请求, 请求体错误或者缺少成员id和地址时返回400
+func (r *Raft) memberChangeRequest(resp http.ResponseWriter, req *http.Request, change func(context.Context, *MemberChangeBody) error) {
+	if req.Method != http.MethodPost {
+		resp.Header().Set("Allow", http.MethodPost)
+		tools.ApiResponse(resp, http.StatusMethodNotAllowed, nil, "只支持POST请求")
+		return
+	}
+	var body MemberChangeBody
+	data, err := ioutil.ReadAll(req.Body)
+	if err == nil {
+		err = json.Unmarshal(data, &body)
+	}
+	if err != nil {
+		tools.ApiResponse(resp, http.StatusBadRequest, nil, "请求体错误:"+err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), time.Duration(r.Timeout)*time.Second)
+	defer cancel()
+	if err := change(ctx, &body); err != nil {
+		r.logWith(LogHTTP).Warnf("response member change - %s", err.Error())
+		if err == ErrInvalidMember {
+			tools.ApiResponse(resp, http.StatusBadRequest, nil, err.Error())
+			return
+		}
+		r.Mu.Lock()
+		leader := r.CurrentLeader
+		r.Mu.Unlock()
+		tools.ApiResponse(resp, 201, map[string]string{"leader": leader}, err.Error())
+		return
+	}
+	tools.ApiResponse(resp, 200, "", "")
+}
+
+// GET返回每个子系统的日志级别, POST临时修改一个子系统的日志级别
+func (r *Raft) logLevelRequest(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("content-type", "application/json")
+	if req.Method == http.MethodPost {
+		var body LogLevelBody
+		data, _ := ioutil.ReadAll(req.Body)
+		if err := json.Unmarshal(data, &body); err != nil {
+			tools.ApiResponse(resp, 201, nil, err.Error())
+			return
+		}
+		level, err := logger.ParseLevel(body.Level)
+		if err == nil {
+			err = r.SetLogLevel(body.Name, level, time.Duration(body.Duration)*time.Second)
+		}
+		if err != nil {
+			tools.ApiResponse(resp, 201, r.LogSubsystems(), err.Error())
+			return
+		}
+	}
+	tools.ApiResponse(resp, 200, r.LogLevels(), "")
+}
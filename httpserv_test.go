@@ -0,0 +1,121 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandlerRoutePrefix(t *testing.T) {
+	r := newTestNode(t, func(o *Options) { o.RoutePrefix = "raft/" })
+	cases := []struct {
+		name    string
+		handler http.Handler
+		path    string
+		status  int
+	}{
+		{"全部接口/运维接口", r.Handler(), "/raft/api/v1/get_info", 200},
+		{"全部接口/成员接口", r.Handler(), "/raft/api/v1/election", 200},
+		{"全部接口/没有前缀", r.Handler(), "/api/v1/get_info", 404},
+		{"成员接口/成员接口", r.PeerHandler(), "/raft/api/v1/heartbeat", 200},
+		{"成员接口/运维接口", r.PeerHandler(), "/raft/api/v1/get_info", 404},
+		{"成员接口/指标", r.PeerHandler(), "/raft/metrics", 404},
+		{"运维接口/运维接口", r.AdminHandler(), "/raft/api/v1/get_info", 200},
+		{"运维接口/指标", r.AdminHandler(), "/raft/metrics", 200},
+		{"运维接口/成员接口", r.AdminHandler(), "/raft/api/v1/election", 404},
+	}
+	for _, tc := range cases {
+		// 挂载到应用自己的路由中
+		mux := http.NewServeMux()
+		mux.Handle("/raft/", tc.handler)
+		method := http.MethodGet
+		if strings.Contains(tc.path, "election") || strings.Contains(tc.path, "heartbeat") {
+			method = http.MethodPost
+		}
+		req := httptest.NewRequest(method, tc.path, strings.NewReader("{}"))
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, req)
+		if resp.Code != tc.status {
+			t.Fatalf("%s: %s返回%d", tc.name, tc.path, resp.Code)
+		}
+	}
+}
+
+// 每个节点挂载到一个httptest服务上的集群, 节点之间通过真实的http连接通信
+// 配置了TLS证书时服务使用节点的TLSConfig
+func newHttpCluster(t *testing.T, n int, configure func(*Options)) *testCluster {
+	servers := map[string]*httptest.Server{}
+	c := &testCluster{t: t, servers: servers}
+	var ids []string
+	members := map[string]*Member{}
+	for i := 1; i <= n; i++ {
+		id := fmt.Sprintf("n%d", i)
+		ts := httptest.NewUnstartedServer(nil)
+		ids = append(ids, id)
+		servers[id] = ts
+		members[id] = &Member{Id: id, Address: ts.Listener.Addr().String()}
+	}
+	for _, id := range ids {
+		fsm := &testFSM{}
+		o := &Options{
+			Id:            id,
+			Address:       members[id].Address,
+			Members:       configMembers(members),
+			Timeout:       1,
+			Logger:        testLogger(),
+			StateMachine:  fsm,
+			DisableListen: true,
+		}
+		if configure != nil {
+			configure(o)
+		}
+		r := NewRaft(o)
+		ts := servers[id]
+		ts.Config.Handler = r.Handler()
+		if o.TLSCertFile != "" {
+			startTLS(ts, r.TLSConfig())
+		} else {
+			ts.Start()
+		}
+		c.nodes = append(c.nodes, r)
+		c.fsms = append(c.fsms, fsm)
+	}
+	t.Cleanup(func() {
+		for _, r := range c.nodes {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			_ = r.Shutdown(ctx)
+			cancel()
+		}
+		for _, ts := range servers {
+			ts.Close()
+		}
+	})
+	for _, r := range c.nodes {
+		if err := r.Start(context.Background()); err != nil {
+			t.Fatalf("启动%s错误:%s", r.Id, err.Error())
+		}
+	}
+	return c
+}
+
+func TestHttpTransportWithRoutePrefix(t *testing.T) {
+	c := newHttpCluster(t, 3, func(o *Options) { o.RoutePrefix = "/raft" })
+	c.waitFor("选出leader", 20*time.Second, func() bool { return c.leader() != nil })
+	c.propose("a")
+	// follower通过http向leader请求读索引
+	for i, r := range c.nodes {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := r.LinearizableRead(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("%s读取错误:%s", r.Id, err.Error())
+		}
+		if !containsString(c.fsms[i].commands(), "a") {
+			t.Fatalf("%s读取后状态机中没有已经提交的命令", r.Id)
+		}
+	}
+}
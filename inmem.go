@@ -0,0 +1,231 @@
+// 内存传输
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var ErrUnreachable = errors.New("模拟网络: 成员不可达")
+
+// InmemNetwork 内存网络, 同一个进程中的多个节点不经过端口直接通信, 用于测试
+// 可以模拟丢包、延迟和网络分区, 节点的Address作为网络中的地址
+type InmemNetwork struct {
+	mu       sync.Mutex
+	nodes    map[string]*Raft
+	group    map[string]int // 网络分区时每个地址所在的分区
+	dropRate float64        // 请求或者响应丢失的概率
+	minDelay time.Duration
+	maxDelay time.Duration
+	rand     *rand.Rand
+}
+
+// 使用seed生成丢包和延迟的随机数, 相同的seed得到相同的随机序列
+func NewInmemNetwork(seed int64) *InmemNetwork {
+	return &InmemNetwork{
+		nodes: map[string]*Raft{},
+		group: map[string]int{},
+		rand:  rand.New(rand.NewSource(seed)),
+	}
+}
+
+// Transport 返回地址为address的节点使用的传输, 用这个传输创建的Raft自动加入网络
+func (n *InmemNetwork) Transport(address string) *InmemTransport {
+	return &InmemTransport{network: n, address: address}
+}
+
+// Partition 把网络划分成多个分区, 不同分区的节点不能通信, 没有列出的节点单独处于一个分区
+func (n *InmemNetwork) Partition(groups ...[]string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.group = map[string]int{}
+	for i, g := range groups {
+		for _, address := range g {
+			n.group[address] = i + 1
+		}
+	}
+	for address := range n.nodes {
+		if _, ok := n.group[address]; !ok {
+			n.group[address] = -1
+		}
+	}
+}
+
+// Isolate 把节点和其他所有节点隔离
+func (n *InmemNetwork) Isolate(address string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.group[address] = -1
+}
+
+// Heal 恢复网络分区
+func (n *InmemNetwork) Heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.group = map[string]int{}
+}
+
+// SetDropRate 设置请求或者响应丢失的概率, 0到1之间
+func (n *InmemNetwork) SetDropRate(rate float64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.dropRate = rate
+}
+
+// SetDelay 设置每次请求和响应的延迟范围
+func (n *InmemNetwork) SetDelay(min, max time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.minDelay = min
+	n.maxDelay = max
+}
+
+func (n *InmemNetwork) register(address string, r *Raft) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.nodes[address] = r
+}
+
+// 模拟一次网络传输, 返回目标节点; 不可达或者丢包时返回错误
+func (n *InmemNetwork) deliver(ctx context.Context, from, to string) (*Raft, error) {
+	n.mu.Lock()
+	target, ok := n.nodes[to]
+	if from == to {
+		// 发给自己的请求不经过网络
+		n.mu.Unlock()
+		if !ok {
+			return nil, ErrUnreachable
+		}
+		return target, nil
+	}
+	connected := ok && n.group[from] == n.group[to] && n.group[from] >= 0
+	dropped := n.dropRate > 0 && n.rand.Float64() < n.dropRate
+	delay := n.minDelay
+	if n.maxDelay > n.minDelay {
+		delay += time.Duration(n.rand.Int63n(int64(n.maxDelay - n.minDelay)))
+	}
+	n.mu.Unlock()
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if !connected {
+		return nil, ErrUnreachable
+	}
+	if dropped {
+		// 丢包的请求等到超时才返回, 和真实网络一致
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	select {
+	case <-target.done:
+		return nil, ErrUnreachable
+	default:
+	}
+	return target, nil
+}
+
+// InmemTransport 内存网络中一个节点的传输
+type InmemTransport struct {
+	network *InmemNetwork
+	address string
+}
+
+func (t *InmemTransport) RequestVote(ctx context.Context, m *Member, req *Leader) (*ElectionReply, error) {
+	var body Leader
+	var reply ElectionReply
+	if err := t.call(ctx, m, "election", req, &body, &reply, func(target *Raft) (interface{}, error) {
+		return target.ElectionResponse(&body)
+	}); err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
+
+func (t *InmemTransport) AppendEntries(ctx context.Context, m *Member, req *HeartbeatBody) (*HeartbeatReply, error) {
+	var body HeartbeatBody
+	var reply HeartbeatReply
+	if err := t.call(ctx, m, "heartbeat", req, &body, &reply, func(target *Raft) (interface{}, error) {
+		return target.HeartbeatResponse(&body)
+	}); err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
+
+func (t *InmemTransport) InstallSnapshot(ctx context.Context, m *Member, req *InstallSnapshotBody) (*InstallSnapshotReply, error) {
+	var body InstallSnapshotBody
+	var reply InstallSnapshotReply
+	if err := t.call(ctx, m, "install snapshot", req, &body, &reply, func(target *Raft) (interface{}, error) {
+		return target.InstallSnapshotResponse(&body)
+	}); err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
+
+func (t *InmemTransport) TimeoutNow(ctx context.Context, m *Member, req *TimeoutNowBody) (*TimeoutNowReply, error) {
+	var body TimeoutNowBody
+	var reply TimeoutNowReply
+	if err := t.call(ctx, m, "timeout now", req, &body, &reply, func(target *Raft) (interface{}, error) {
+		return target.TimeoutNowResponse(&body)
+	}); err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
+
+func (t *InmemTransport) ReadIndex(ctx context.Context, m *Member) (*ReadIndexReply, error) {
+	target, err := t.network.deliver(ctx, t.address, m.Address)
+	if err != nil {
+		return nil, err
+	}
+	index, err := target.readIndex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := t.network.deliver(ctx, m.Address, t.address); err != nil {
+		return nil, err
+	}
+	return &ReadIndexReply{Index: index}, nil
+}
+
+// 把请求编码到body后交给目标节点处理, 再把响应编码到reply, 节点之间不共享数据
+// 目标节点拒绝请求时和http接口一样只记录日志, 响应照常返回
+func (t *InmemTransport) call(ctx context.Context, m *Member, name string, req, body, reply interface{}, handle func(*Raft) (interface{}, error)) error {
+	target, err := t.network.deliver(ctx, t.address, m.Address)
+	if err != nil {
+		return err
+	}
+	if err := copyJSON(req, body); err != nil {
+		return err
+	}
+	resp, err := handle(target)
+	if err != nil {
+		target.logWith(LogTransport).Warnf("response %s - %s", name, err.Error())
+	}
+	if _, err := t.network.deliver(ctx, m.Address, t.address); err != nil {
+		return err
+	}
+	return copyJSON(resp, reply)
+}
+
+func (t *InmemTransport) bind(r *Raft) {
+	t.network.register(t.address, r)
+}
+
+func copyJSON(src, dst interface{}) error {
+	data, err := json.Marshal(src)
+	if err != nil {
+		return fmt.Errorf("编码请求错误:%s", err.Error())
+	}
+	return json.Unmarshal(data, dst)
+}
@@ -0,0 +1,116 @@
+package raft
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLearnerReplicatesWithoutVoting(t *testing.T) {
+	c := newTestCluster(t, 3, nil)
+	c.waitFor("选出leader", 20*time.Second, func() bool { return c.leader() != nil })
+	c.propose("a")
+	n4 := c.startNode("n4", nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := c.leader().AddLearner(ctx, "n4", "n4"); err != nil {
+		t.Fatal(err)
+	}
+	c.propose("b")
+	c.waitFor("learner应用日志", 20*time.Second, c.converged)
+	checkLearner(t, n4)
+
+	// 两个有投票权的成员断开后, leader加上learner也不是多数派, 不能提交
+	leader := c.leader()
+	for _, r := range c.nodes {
+		if r != leader && r != n4 {
+			c.net.Isolate(r.Address)
+		}
+	}
+	leader.Mu.Lock()
+	commit := leader.CommitIndex
+	leader.Mu.Unlock()
+	if _, _, err := leader.Propose([]byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Second)
+	leader.Mu.Lock()
+	stuck := leader.CommitIndex
+	leader.Mu.Unlock()
+	if stuck != commit {
+		t.Fatalf("learner计入了多数派,提交索引从%d变成了%d", commit, stuck)
+	}
+	c.net.Heal()
+	c.propose("d")
+	c.waitFor("全部节点应用相同的日志", 20*time.Second, c.converged)
+	checkLearner(t, n4)
+}
+
+// learner的成员配置中自己是learner, 并且没有参与选举
+func checkLearner(t *testing.T, r *Raft) {
+	t.Helper()
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	if m, ok := r.Members[r.Id]; !ok || !m.Learner {
+		t.Fatalf("%s的成员配置中自己不是learner", r.Id)
+	}
+	if r.Role != RoleFollower || r.VotedFor == r.Id {
+		t.Fatalf("learner参与了选举,角色是%s", r.Role)
+	}
+}
+
+func TestPromoteLearner(t *testing.T) {
+	c := newTestCluster(t, 3, nil)
+	c.waitFor("选出leader", 20*time.Second, func() bool { return c.leader() != nil })
+	// 成员变更需要leader先提交本任期的日志
+	c.propose("a")
+	n4 := c.startNode("n4", nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := c.leader().AddLearner(ctx, "n4", "n4"); err != nil {
+		t.Fatal(err)
+	}
+
+	// learner断开期间提交的日志没有复制到learner, 不能提升
+	c.net.Isolate(n4.Address)
+	c.propose("b")
+	err := c.leader().PromoteLearner(ctx, "n4")
+	if err == nil || !strings.Contains(err.Error(), "还没有追上") {
+		t.Fatalf("落后的learner提升返回%v", err)
+	}
+
+	c.net.Heal()
+	c.waitFor("learner追上日志", 20*time.Second, c.converged)
+	if err := c.leader().PromoteLearner(ctx, "n4"); err != nil {
+		t.Fatal(err)
+	}
+	c.waitFor("learner成为follower", 20*time.Second, func() bool {
+		n4.Mu.Lock()
+		defer n4.Mu.Unlock()
+		m, ok := n4.Members["n4"]
+		return ok && !m.Learner && n4.Role == RoleFollower
+	})
+	// 提升后四个有投票权的成员需要三个才能提交, 断开两个后不能提交
+	leader := c.leader()
+	var isolated int
+	for _, r := range c.nodes {
+		if r != leader && isolated < 2 {
+			c.net.Isolate(r.Address)
+			isolated++
+		}
+	}
+	leader.Mu.Lock()
+	commit := leader.CommitIndex
+	leader.Mu.Unlock()
+	if _, _, err := leader.Propose([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Second)
+	leader.Mu.Lock()
+	stuck := leader.CommitIndex
+	leader.Mu.Unlock()
+	if stuck != commit {
+		t.Fatalf("四个成员中两个断开后提交索引从%d变成了%d", commit, stuck)
+	}
+}
@@ -0,0 +1,86 @@
+// CheckQuorum和leader租约
+package raft
+
+import (
+	"sort"
+	"time"
+)
+
+// IsLeader 本节点是否是leader
+// 配置了LeaderLease时只在租约内返回true, 同一时刻最多只有一个节点返回true, 可以用来控制只能单点运行的任务
+func (r *Raft) IsLeader() bool {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	if r.Role != RoleLeader || r.CurrentLeader != r.Id {
+		return false
+	}
+	if r.LeaderLease <= 0 {
+		return true
+	}
+	// 转移期间目标成员随时可能成为新的leader
+	if r.transferee != "" {
+		return false
+	}
+	return time.Since(r.quorumAckTime()) < time.Duration(r.LeaderLease)*time.Second
+}
+
+// 本节点是leader, 或者在Timeout内收到过leader的心跳或者投出过选票, 调用方需持有锁
+// 投出的选票可能让候选人成为leader, 在它的心跳到达之前也不能给其他候选人投票
+func (r *Raft) leaderAlive() bool {
+	if r.Role == RoleLeader {
+		return true
+	}
+	timeout := time.Duration(r.Timeout) * time.Second
+	if r.CurrentLeader != "" && time.Since(r.leaderContact) < timeout {
+		return true
+	}
+	return time.Since(r.voteTime) < timeout
+}
+
+// 本节点或者最近一次收到的leader心跳开启了CheckQuorum, 调用方需持有锁
+func (r *Raft) checkQuorumEnabled() bool {
+	return r.CheckQuorum || r.quorumChecked
+}
+
+// 多数派有投票权的成员都响应过的最近一次心跳的发送时间, 调用方需持有锁
+// 这些成员在该时间之后的Timeout内不会给其他候选人投票
+func (r *Raft) quorumAckTime() time.Time {
+	var acks []time.Time
+	for id, m := range r.Members {
+		if m.Learner {
+			continue
+		}
+		if id == r.Id {
+			acks = append(acks, time.Now())
+			continue
+		}
+		acks = append(acks, r.ackTime[id])
+	}
+	quorum := r.quorum()
+	if len(acks) < quorum {
+		return time.Time{}
+	}
+	sort.Slice(acks, func(i, j int) bool { return acks[i].After(acks[j]) })
+	return acks[quorum-1]
+}
+
+// leader在Timeout内没有收到多数派成员的心跳响应时退位
+func (r *Raft) checkQuorum() {
+	if !r.CheckQuorum {
+		return
+	}
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	if r.Role != RoleLeader {
+		return
+	}
+	timeout := time.Duration(r.Timeout) * time.Second
+	if time.Since(r.leaderSince) < timeout {
+		return
+	}
+	if time.Since(r.quorumAckTime()) < timeout {
+		return
+	}
+	r.logWith(LogElection).Warnf("节点%s在%d秒内没有收到多数派成员的心跳响应,leader退位", r.Id, r.Timeout)
+	r.becomeFollower(r.CurrentTerm, "")
+}
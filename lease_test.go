@@ -0,0 +1,90 @@
+package raft
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCheckQuorumStepDown(t *testing.T) {
+	c := newTestCluster(t, 3, func(o *Options) { o.CheckQuorum = true })
+	c.waitFor("选出leader", 20*time.Second, func() bool { return c.leader() != nil })
+	c.propose("a")
+	old := c.leader()
+
+	// leader收不到多数派的心跳响应, 一个超时时间后退位, 另外两个成员选出新的leader
+	c.net.Isolate(old.Address)
+	c.waitFor("隔离的leader退位", 5*time.Second, func() bool {
+		old.Mu.Lock()
+		defer old.Mu.Unlock()
+		return old.Role != RoleLeader
+	})
+	var others []*Raft
+	for _, r := range c.nodes {
+		if r != old {
+			others = append(others, r)
+		}
+	}
+	c.waitFor("选出新的leader", 20*time.Second, func() bool { return c.leader(others...) != nil })
+	c.net.Heal()
+	c.propose("b")
+	c.waitFor("全部节点应用相同的日志", 20*time.Second, c.converged)
+}
+
+func TestLeaderLease(t *testing.T) {
+	c := newTestCluster(t, 3, func(o *Options) {
+		o.Timeout = 2
+		o.LeaderLease = 1
+	})
+	c.waitFor("leader拿到租约", 20*time.Second, func() bool {
+		l := c.leader()
+		return l != nil && l.IsLeader()
+	})
+	old := c.leader()
+	for _, r := range c.nodes {
+		if r != old && r.IsLeader() {
+			t.Fatalf("follower %s的IsLeader返回true", r.Id)
+		}
+	}
+
+	// 后台检查任何时刻最多只有一个节点的IsLeader返回true
+	var violations int32
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+			n := 0
+			for _, r := range c.nodes {
+				if r.IsLeader() {
+					n++
+				}
+			}
+			if n > 1 {
+				atomic.AddInt32(&violations, 1)
+			}
+		}
+	}()
+
+	// 隔离leader后租约过期, 新的leader拿到租约
+	c.net.Isolate(old.Address)
+	c.waitFor("隔离的leader租约过期", 5*time.Second, func() bool { return !old.IsLeader() })
+	c.waitFor("新的leader拿到租约", 20*time.Second, func() bool {
+		for _, r := range c.nodes {
+			if r != old && r.IsLeader() {
+				return true
+			}
+		}
+		return false
+	})
+	close(stop)
+	<-done
+	if n := atomic.LoadInt32(&violations); n > 0 {
+		t.Fatalf("有%d次同时有两个节点的IsLeader返回true", n)
+	}
+}
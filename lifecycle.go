@@ -0,0 +1,229 @@
+// 启动和停止
+package raft
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+var (
+	ErrStarted = errors.New("节点已经启动过, 停止后需要重新创建Raft")
+	ErrStopped = errors.New("节点已经停止")
+)
+
+// Start 加载TLS证书, 恢复持久化的数据, 开始监听并启动后台任务后立即返回, 配置DisableListen时不监听
+// ctx结束时自动调用Shutdown; 监听失败等启动错误直接返回, 修正后可以重新调用Start
+func (r *Raft) Start(ctx context.Context) (err error) {
+	r.Mu.Lock()
+	if r.started {
+		r.Mu.Unlock()
+		return ErrStarted
+	}
+	if r.isStopped() {
+		r.Mu.Unlock()
+		return ErrStopped
+	}
+	r.started = true
+	r.Mu.Unlock()
+	defer func() {
+		if err != nil {
+			r.Mu.Lock()
+			r.started = false
+			r.Mu.Unlock()
+		}
+	}()
+
+	if r.tls != nil {
+		if err := r.tls.load(); err != nil {
+			return err
+		}
+	}
+	if err := r.restore(); err != nil {
+		return err
+	}
+	if !r.DisableListen {
+		ln, err := net.Listen("tcp", r.Address)
+		if err != nil {
+			return err
+		}
+		if r.tls != nil {
+			ln = tls.NewListener(ln, r.tls.serverConfig())
+		}
+		handler := r.handler
+		if r.AdminAddress != "" {
+			// 运维接口单独监听, 集群通信地址只提供成员之间的接口
+			adminLn, err := net.Listen("tcp", r.AdminAddress)
+			if err != nil {
+				ln.Close()
+				return err
+			}
+			handler = r.peerHandler
+			r.adminServer = &http.Server{Handler: r.adminHandler}
+			r.serve(r.adminServer, adminLn)
+		}
+		r.server = &http.Server{Handler: handler}
+		r.serve(r.server, ln)
+	}
+	r.goBackend(r.BackendElection)
+	r.goBackend(r.BackendHeatbeat)
+	r.BackendReCandidate()
+	r.goBackend(r.BackendDefaultLeader)
+	r.goBackend(r.BackendApply)
+	r.goBackend(r.BackendEvents)
+	r.goBackend(r.BackendMetrics)
+	r.goBackend(r.BackendHealthCheck)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = r.Shutdown(context.Background())
+		case <-r.done:
+		}
+	}()
+	return nil
+}
+
+// Run 启动节点并阻塞, 直到ctx结束或者调用Shutdown后全部后台任务退出
+// 正常停止时返回nil, http服务异常退出时返回对应的错误
+func (r *Raft) Run(ctx context.Context) error {
+	if err := r.Start(ctx); err != nil {
+		return err
+	}
+	<-r.stopped
+	return r.serveErr
+}
+
+// Shutdown 停止节点, 关闭http服务和后台任务, 全部退出并关闭存储后返回
+// 配置了TransferOnShutdown时, leader先把leader转移给心跳在线且日志最新的成员
+func (r *Raft) Shutdown(ctx context.Context) error {
+	if r.TransferOnShutdown {
+		r.transferOnShutdown(ctx)
+	}
+	r.stop()
+	select {
+	case <-r.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// 停止前把leader转移给心跳在线、健康且日志最新的成员, 失败时只记录日志
+func (r *Raft) transferOnShutdown(ctx context.Context) {
+	r.Mu.Lock()
+	if r.Role != RoleLeader {
+		r.Mu.Unlock()
+		return
+	}
+	target := r.transferTarget()
+	r.Mu.Unlock()
+	if target == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(r.Timeout)*time.Second)
+	defer cancel()
+	if err := r.TransferLeadership(ctx, target); err != nil {
+		r.Logger.Warnf("停止前转移leader给%s错误:%s", target, err.Error())
+	}
+}
+
+// 通知后台任务退出, 等待全部退出后关闭存储
+func (r *Raft) stop() {
+	r.stopOnce.Do(func() {
+		// 持有锁关闭, 持有锁的goTracked不会在等待后台任务退出之后再启动新的任务
+		r.Mu.Lock()
+		close(r.done)
+		for conn := range r.streamConns {
+			conn.Close()
+		}
+		r.Mu.Unlock()
+		go func() {
+			for _, server := range []*http.Server{r.server, r.adminServer} {
+				if server == nil {
+					continue
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), time.Duration(r.Timeout)*time.Second)
+				if err := server.Shutdown(ctx); err != nil {
+					_ = server.Close()
+				}
+				cancel()
+			}
+			r.wg.Wait()
+			// 关闭传输保持的长连接
+			if c, ok := r.Transport.(io.Closer); ok {
+				_ = c.Close()
+			}
+			if err := r.Storage.Close(); err != nil {
+				r.Logger.Errorf("关闭存储错误:%s", err.Error())
+			}
+			r.Logger.Infof("节点%s已经停止", r.Id)
+			close(r.stopped)
+		}()
+	})
+}
+
+// 在ln上运行http服务, 异常退出时停止节点
+func (r *Raft) serve(server *http.Server, ln net.Listener) {
+	go func() {
+		if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			r.Logger.Errorf("http服务错误:%s", err.Error())
+			r.serveErr = err
+			r.stop()
+		}
+	}()
+}
+
+// 启动受Shutdown管理的后台任务
+func (r *Raft) goBackend(fn func()) {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		fn()
+	}()
+}
+
+// 在处理请求的过程中启动受Shutdown管理的任务, 节点已经停止时不启动并返回false, 调用方需持有锁
+func (r *Raft) goTracked(fn func()) bool {
+	if r.isStopped() {
+		return false
+	}
+	r.goBackend(fn)
+	return true
+}
+
+// 返回parent结束、超时或者节点停止时结束的context, 处理请求时的等待不会拖慢Shutdown
+func (r *Raft) stopContext(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	go func() {
+		select {
+		case <-r.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// 节点是否已经开始停止
+func (r *Raft) isStopped() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// 等待d时间, 节点停止时返回false
+func (r *Raft) sleep(d time.Duration) bool {
+	select {
+	case <-r.done:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
@@ -0,0 +1,136 @@
+package raft
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 记录关闭之后是否还有写入的存储
+type closeCheckStorage struct {
+	*MemoryStorage
+	closed     int32
+	lateWrites int32
+}
+
+func (s *closeCheckStorage) write() {
+	if atomic.LoadInt32(&s.closed) == 1 {
+		atomic.AddInt32(&s.lateWrites, 1)
+	}
+}
+
+func (s *closeCheckStorage) SaveState(term int64, votedFor string) error {
+	s.write()
+	return s.MemoryStorage.SaveState(term, votedFor)
+}
+
+func (s *closeCheckStorage) AppendEntries(entries []*Entry) error {
+	s.write()
+	return s.MemoryStorage.AppendEntries(entries)
+}
+
+func (s *closeCheckStorage) Close() error {
+	atomic.StoreInt32(&s.closed, 1)
+	return s.MemoryStorage.Close()
+}
+
+func TestStartRetryAfterListenError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRaft(&Options{Id: "n1", Address: ln.Addr().String(), Members: testMembers("n1"), Logger: testLogger()})
+	defer r.Shutdown(context.Background())
+
+	// 地址被占用时启动失败, 再次启动返回同样的错误而不是ErrStarted
+	for i := 0; i < 2; i++ {
+		if err := r.Start(context.Background()); err == nil || err == ErrStarted {
+			t.Fatalf("第%d次启动返回%v", i+1, err)
+		}
+	}
+	ln.Close()
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatalf("地址释放后启动错误:%s", err.Error())
+	}
+	if err := r.Start(context.Background()); err != ErrStarted {
+		t.Fatalf("启动成功后再次启动返回%v", err)
+	}
+}
+
+func TestRunStopsWhenContextDone(t *testing.T) {
+	r := NewRaft(&Options{Id: "n1", Address: "n1", Members: testMembers("n1"), Logger: testLogger(), DisableListen: true})
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() { errCh <- r.Run(ctx) }()
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("Run返回%v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ctx结束后Run没有返回")
+	}
+	if err := r.Start(context.Background()); err != ErrStarted {
+		t.Fatalf("停止后再次启动返回%v", err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	storages := map[string]*closeCheckStorage{}
+	c := newTestCluster(t, 3, func(o *Options) {
+		s := &closeCheckStorage{MemoryStorage: NewMemoryStorage()}
+		storages[o.Id] = s
+		o.Storage = s
+	})
+	c.waitFor("选出leader", 20*time.Second, func() bool { return c.leader() != nil })
+
+	// 持续提交命令时停止leader
+	leader := c.leader()
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			leader.Propose([]byte("x"))
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	time.Sleep(300 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := leader.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	close(stop)
+	<-done
+
+	// Shutdown返回时后台任务已经退出, 存储在最后关闭, 之后的请求返回ErrStopped
+	s := storages[leader.Id]
+	if atomic.LoadInt32(&s.closed) != 1 {
+		t.Fatal("Shutdown返回时存储没有关闭")
+	}
+	if n := atomic.LoadInt32(&s.lateWrites); n > 0 {
+		t.Fatalf("存储关闭后还有%d次写入", n)
+	}
+	if _, err := leader.ElectionResponse(&Leader{Term: 100, LeaderId: "n2"}); err != ErrStopped {
+		t.Fatalf("停止后投票请求返回%v", err)
+	}
+	if _, err := leader.HeartbeatResponse(&HeartbeatBody{Term: 100, Leader: "n2"}); err != ErrStopped {
+		t.Fatalf("停止后心跳请求返回%v", err)
+	}
+	if _, _, err := leader.Propose([]byte("y")); err != ErrStopped {
+		t.Fatalf("停止后提交命令返回%v", err)
+	}
+	if err := leader.Shutdown(ctx); err != nil {
+		t.Fatalf("再次停止返回%v", err)
+	}
+}
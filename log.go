@@ -0,0 +1,219 @@
+// 复制日志
+package raft
+
+import "errors"
+
+var ErrNotLeader = errors.New("本节点不是leader")
+
+// 日志条目类型
+type EntryType uint8
+
+const (
+	EntryCommand EntryType = iota // 业务命令
+	EntryNoop                     // leader上任时写入的空日志, 用于提交之前任期的日志
+	EntryConfig                   // 成员配置, 写入日志后立即生效
+)
+
+// 日志条目
+type Entry struct {
+	Index int64     `json:"index"`
+	Term  int64     `json:"term"`
+	Type  EntryType `json:"type"`
+	Data  []byte    `json:"data"`
+}
+
+// 每次AppendEntries最多携带的日志条数
+const maxAppendEntries = 64
+
+// 内存中的日志, entries[0]是哨兵, 记录日志起点之前最后一条日志的索引和任期, 即快照的位置
+// 所有修改先写入storage再修改内存
+type raftLog struct {
+	entries []*Entry
+	storage Storage
+	size    int64   // 哨兵之后日志数据的总字节数
+	configs []int64 // 哨兵之后成员配置日志的索引, 从小到大, 查找成员配置时不用扫描全部日志
+}
+
+func newRaftLog(storage Storage) *raftLog {
+	return &raftLog{entries: []*Entry{{}}, storage: storage}
+}
+
+// 从storage加载快照之后的日志
+func (l *raftLog) load(snapIndex, snapTerm int64) error {
+	entries, err := l.storage.LoadEntries()
+	if err != nil {
+		return err
+	}
+	l.entries = []*Entry{{Index: snapIndex, Term: snapTerm}}
+	l.size = 0
+	l.configs = nil
+	for _, e := range entries {
+		if e.Index > snapIndex {
+			l.add(e)
+		}
+	}
+	return nil
+}
+
+func (l *raftLog) firstIndex() int64 {
+	return l.entries[0].Index + 1
+}
+
+func (l *raftLog) lastIndex() int64 {
+	return l.entries[len(l.entries)-1].Index
+}
+
+func (l *raftLog) lastTerm() int64 {
+	return l.entries[len(l.entries)-1].Term
+}
+
+// 返回索引对应日志的任期, 索引不在日志中时返回-1
+func (l *raftLog) termAt(index int64) int64 {
+	offset := index - l.entries[0].Index
+	if offset < 0 || offset >= int64(len(l.entries)) {
+		return -1
+	}
+	return l.entries[offset].Term
+}
+
+func (l *raftLog) entry(index int64) *Entry {
+	offset := index - l.entries[0].Index
+	if offset <= 0 || offset >= int64(len(l.entries)) {
+		return nil
+	}
+	return l.entries[offset]
+}
+
+// 返回从index开始最多max条日志
+func (l *raftLog) slice(index int64, max int) []*Entry {
+	offset := index - l.entries[0].Index
+	if offset <= 0 || offset >= int64(len(l.entries)) {
+		return nil
+	}
+	end := offset + int64(max)
+	if end > int64(len(l.entries)) {
+		end = int64(len(l.entries))
+	}
+	entries := make([]*Entry, end-offset)
+	copy(entries, l.entries[offset:end])
+	return entries
+}
+
+func (l *raftLog) append(entries ...*Entry) error {
+	if err := l.storage.AppendEntries(entries); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		l.add(e)
+	}
+	return nil
+}
+
+// 在内存日志末尾添加一条已经持久化的日志
+func (l *raftLog) add(e *Entry) {
+	l.entries = append(l.entries, e)
+	l.size += int64(len(e.Data))
+	if e.Type == EntryConfig {
+		l.configs = append(l.configs, e.Index)
+	}
+}
+
+// 删除index及之后的日志
+func (l *raftLog) truncate(index int64) error {
+	offset := index - l.entries[0].Index
+	if offset <= 0 || offset >= int64(len(l.entries)) {
+		return nil
+	}
+	if err := l.storage.TruncateSuffix(index); err != nil {
+		return err
+	}
+	for _, e := range l.entries[offset:] {
+		l.size -= int64(len(e.Data))
+	}
+	l.entries = l.entries[:offset]
+	for len(l.configs) > 0 && l.configs[len(l.configs)-1] >= index {
+		l.configs = l.configs[:len(l.configs)-1]
+	}
+	return nil
+}
+
+// 删除index及之前的日志, index成为新的哨兵
+func (l *raftLog) compact(index int64) error {
+	offset := index - l.entries[0].Index
+	if offset <= 0 || offset >= int64(len(l.entries)) {
+		return nil
+	}
+	if err := l.storage.TruncatePrefix(index); err != nil {
+		return err
+	}
+	for _, e := range l.entries[1 : offset+1] {
+		l.size -= int64(len(e.Data))
+	}
+	sentinel := &Entry{Index: index, Term: l.entries[offset].Term}
+	l.entries = append([]*Entry{sentinel}, l.entries[offset+1:]...)
+	for len(l.configs) > 0 && l.configs[0] <= index {
+		l.configs = l.configs[1:]
+	}
+	return nil
+}
+
+// 安装leader发来的快照, 本地日志包含快照位置的日志时保留之后的日志, 否则丢弃全部日志
+func (l *raftLog) restoreSnapshot(index, term int64) error {
+	if l.termAt(index) == term && index >= l.entries[0].Index {
+		return l.compact(index)
+	}
+	if err := l.storage.TruncateSuffix(l.firstIndex()); err != nil {
+		return err
+	}
+	if err := l.storage.TruncatePrefix(index); err != nil {
+		return err
+	}
+	l.entries = []*Entry{{Index: index, Term: term}}
+	l.size = 0
+	l.configs = nil
+	return nil
+}
+
+// 候选人的日志是否至少和本节点一样新
+func (l *raftLog) isUpToDate(lastIndex, lastTerm int64) bool {
+	if lastTerm != l.lastTerm() {
+		return lastTerm > l.lastTerm()
+	}
+	return lastIndex >= l.lastIndex()
+}
+
+// 本节点作为follower追加leader发来的日志, 返回追加后与leader一致的最后一条日志索引,
+// 以及是否删除了冲突的日志
+func (l *raftLog) appendFromLeader(prevIndex int64, entries []*Entry) (int64, bool, error) {
+	truncated := false
+	for i, e := range entries {
+		term := l.termAt(e.Index)
+		if term == e.Term {
+			continue
+		}
+		if term != -1 {
+			if err := l.truncate(e.Index); err != nil {
+				return prevIndex, false, err
+			}
+			truncated = true
+		}
+		if err := l.append(entries[i:]...); err != nil {
+			return prevIndex, truncated, err
+		}
+		break
+	}
+	return prevIndex + int64(len(entries)), truncated, nil
+}
+
+// 返回冲突任期在日志中的第一条索引, 帮助leader快速回退nextIndex
+func (l *raftLog) conflictIndex(prevIndex int64) int64 {
+	if prevIndex > l.lastIndex() {
+		return l.lastIndex() + 1
+	}
+	term := l.termAt(prevIndex)
+	index := prevIndex
+	for index > l.firstIndex() && l.termAt(index-1) == term {
+		index--
+	}
+	return index
+}
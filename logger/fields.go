@@ -0,0 +1,137 @@
+package logger
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// FieldLogger 支持附加key/value字段的Logger, With返回的Logger输出的每条日志都带有这些字段
+type FieldLogger interface {
+	Logger
+	With(keyvals ...interface{}) Logger
+}
+
+// With 给日志附加key/value字段, keyvals按key、value交替排列
+// l不支持字段时把字段追加在消息后面
+func With(l Logger, keyvals ...interface{}) Logger {
+	if len(keyvals) == 0 {
+		return l
+	}
+	if fl, ok := l.(FieldLogger); ok {
+		return fl.With(keyvals...)
+	}
+	return &fieldsLogger{next: l, fields: keyvals}
+}
+
+// 把字段追加在消息后面
+type fieldsLogger struct {
+	next   Logger
+	fields []interface{}
+}
+
+func (l *fieldsLogger) Debugf(msg string, args ...interface{}) {
+	l.next.Debugf("%s", l.format(msg, args))
+}
+
+func (l *fieldsLogger) Infof(msg string, args ...interface{}) {
+	l.next.Infof("%s", l.format(msg, args))
+}
+
+func (l *fieldsLogger) Warnf(msg string, args ...interface{}) {
+	l.next.Warnf("%s", l.format(msg, args))
+}
+
+func (l *fieldsLogger) Errorf(msg string, args ...interface{}) {
+	l.next.Errorf("%s", l.format(msg, args))
+}
+
+func (l *fieldsLogger) With(keyvals ...interface{}) Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(fields, l.fields...)
+	return &fieldsLogger{next: l.next, fields: append(fields, keyvals...)}
+}
+
+func (l *fieldsLogger) format(msg string, args []interface{}) string {
+	return fmt.Sprintf(msg, args...) + " " + formatText(l.fields)
+}
+
+// 格式化为key=value, 包含空格或者引号的值加上引号
+func formatText(keyvals []interface{}) string {
+	var b strings.Builder
+	for i := 0; i < len(keyvals); i += 2 {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		key, value := pair(keyvals, i)
+		v := fmt.Sprint(value)
+		if v == "" || strings.ContainsAny(v, " \"=\n") {
+			v = strconv.Quote(v)
+		}
+		b.WriteString(key + "=" + v)
+	}
+	return b.String()
+}
+
+// 返回第i个key和对应的value, 缺少value时为nil
+func pair(keyvals []interface{}, i int) (string, interface{}) {
+	key := fmt.Sprint(keyvals[i])
+	if i+1 >= len(keyvals) {
+		return key, nil
+	}
+	return key, keyvals[i+1]
+}
+
+// Adapt 适配zap.SugaredLogger、logrus.Logger、logrus.Entry等已经实现了Debugf/Infof/Warnf/Errorf的日志库
+// 通过反射使用它们的With(args ...interface{})(zap)或者WithFields(map[string]interface{})(logrus)附加字段, 不需要引入这些库
+// 两种方法都没有时和With一样把字段追加在消息后面
+func Adapt(l Logger) Logger {
+	v := reflect.ValueOf(l)
+	if m := v.MethodByName("With"); m.IsValid() && isZapWith(m.Type()) {
+		return &adapter{Logger: l, with: m}
+	}
+	if m := v.MethodByName("WithFields"); m.IsValid() && isLogrusWithFields(m.Type()) {
+		return &adapter{Logger: l, withFields: m}
+	}
+	return l
+}
+
+var (
+	loggerType    = reflect.TypeOf((*Logger)(nil)).Elem()
+	interfaceType = reflect.TypeOf((*interface{})(nil)).Elem()
+)
+
+// With(args ...interface{}) X, X实现了Logger
+func isZapWith(t reflect.Type) bool {
+	return t.NumIn() == 1 && t.IsVariadic() && t.In(0).Elem() == interfaceType &&
+		t.NumOut() == 1 && t.Out(0).Implements(loggerType)
+}
+
+// WithFields(map[string]interface{}) X, X实现了Logger
+func isLogrusWithFields(t reflect.Type) bool {
+	return t.NumIn() == 1 && t.In(0).Kind() == reflect.Map && t.In(0).Key().Kind() == reflect.String &&
+		t.In(0).Elem() == interfaceType && t.NumOut() == 1 && t.Out(0).Implements(loggerType)
+}
+
+type adapter struct {
+	Logger
+	with       reflect.Value
+	withFields reflect.Value
+}
+
+func (a *adapter) With(keyvals ...interface{}) Logger {
+	var out []reflect.Value
+	if a.with.IsValid() {
+		out = a.with.CallSlice([]reflect.Value{reflect.ValueOf(keyvals)})
+	} else {
+		fields := reflect.MakeMap(a.withFields.Type().In(0))
+		for i := 0; i < len(keyvals); i += 2 {
+			key, value := pair(keyvals, i)
+			v := reflect.ValueOf(&value).Elem()
+			fields.SetMapIndex(reflect.ValueOf(key).Convert(fields.Type().Key()), v)
+		}
+		out = a.withFields.Call([]reflect.Value{fields})
+	}
+	return Adapt(out[0].Interface().(Logger))
+}
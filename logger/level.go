@@ -0,0 +1,105 @@
+package logger
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// Level 日志级别
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LEVEL(%d)", int(l))
+}
+
+// ParseLevel 解析debug、info、warn、error, 不区分大小写
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelDebug, fmt.Errorf("未知的日志级别%s", s)
+}
+
+// LevelVar 可以在运行时修改的日志级别, 并发安全
+type LevelVar struct {
+	v int32
+}
+
+// NewLevelVar 返回初始级别为level的LevelVar
+func NewLevelVar(level Level) *LevelVar {
+	return &LevelVar{v: int32(level)}
+}
+
+func (v *LevelVar) Level() Level {
+	return Level(atomic.LoadInt32(&v.v))
+}
+
+func (v *LevelVar) Set(level Level) {
+	atomic.StoreInt32(&v.v, int32(level))
+}
+
+// WithLevel 过滤低于min级别的日志
+func WithLevel(l Logger, min Level) Logger {
+	return WithLevelVar(l, NewLevelVar(min))
+}
+
+// WithLevelVar 过滤低于v当前级别的日志, 修改v后立即生效
+func WithLevelVar(l Logger, v *LevelVar) Logger {
+	return &levelLogger{next: l, min: v}
+}
+
+type levelLogger struct {
+	next Logger
+	min  *LevelVar
+}
+
+func (l *levelLogger) Debugf(msg string, args ...interface{}) {
+	if l.min.Level() <= LevelDebug {
+		l.next.Debugf(msg, args...)
+	}
+}
+
+func (l *levelLogger) Infof(msg string, args ...interface{}) {
+	if l.min.Level() <= LevelInfo {
+		l.next.Infof(msg, args...)
+	}
+}
+
+func (l *levelLogger) Warnf(msg string, args ...interface{}) {
+	if l.min.Level() <= LevelWarn {
+		l.next.Warnf(msg, args...)
+	}
+}
+
+func (l *levelLogger) Errorf(msg string, args ...interface{}) {
+	l.next.Errorf(msg, args...)
+}
+
+func (l *levelLogger) With(keyvals ...interface{}) Logger {
+	return &levelLogger{next: With(l.next, keyvals...), min: l.min}
+}
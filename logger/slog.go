@@ -0,0 +1,50 @@
+//go:build go1.21
+// +build go1.21
+
+package logger
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// NewSlog 把slog.Logger适配为Logger, 级别由slog的Handler过滤, 字段通过slog.Logger.With附加
+func NewSlog(l *slog.Logger) Logger {
+	return &slogLogger{l: l}
+}
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+func (s *slogLogger) Debugf(msg string, args ...interface{}) {
+	s.log(slog.LevelDebug, msg, args)
+}
+
+func (s *slogLogger) Infof(msg string, args ...interface{}) {
+	s.log(slog.LevelInfo, msg, args)
+}
+
+func (s *slogLogger) Warnf(msg string, args ...interface{}) {
+	s.log(slog.LevelWarn, msg, args)
+}
+
+func (s *slogLogger) Errorf(msg string, args ...interface{}) {
+	s.log(slog.LevelError, msg, args)
+}
+
+func (s *slogLogger) With(keyvals ...interface{}) Logger {
+	return &slogLogger{l: s.l.With(keyvals...)}
+}
+
+func (s *slogLogger) log(level slog.Level, msg string, args []interface{}) {
+	ctx := context.Background()
+	if !s.l.Enabled(ctx, level) {
+		return
+	}
+	if len(args) > 0 {
+		msg = fmt.Sprintf(msg, args...)
+	}
+	s.l.Log(ctx, level, msg)
+}
@@ -0,0 +1,102 @@
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Structured 带级别和字段的日志, 输出文本或者每行一个JSON对象
+// 文本格式和Log一致, 字段以key=value追加在消息后面; JSON格式包含time、level、msg和字段
+type Structured struct {
+	out    io.Writer
+	mu     *sync.Mutex // With返回的日志共用一个锁, 保证每行完整写入
+	min    Level
+	json   bool
+	fields []interface{}
+}
+
+// NewStructured 输出到out, 过滤低于min级别的日志, json为true时输出JSON
+func NewStructured(out io.Writer, min Level, json bool) *Structured {
+	return &Structured{out: out, mu: &sync.Mutex{}, min: min, json: json}
+}
+
+func (s *Structured) Debugf(msg string, args ...interface{}) {
+	s.write(LevelDebug, msg, args)
+}
+
+func (s *Structured) Infof(msg string, args ...interface{}) {
+	s.write(LevelInfo, msg, args)
+}
+
+func (s *Structured) Warnf(msg string, args ...interface{}) {
+	s.write(LevelWarn, msg, args)
+}
+
+func (s *Structured) Errorf(msg string, args ...interface{}) {
+	s.write(LevelError, msg, args)
+}
+
+func (s *Structured) With(keyvals ...interface{}) Logger {
+	fields := make([]interface{}, 0, len(s.fields)+len(keyvals))
+	fields = append(fields, s.fields...)
+	c := *s
+	c.fields = append(fields, keyvals...)
+	return &c
+}
+
+func (s *Structured) write(level Level, msg string, args []interface{}) {
+	if level < s.min {
+		return
+	}
+	now := time.Now()
+	if len(args) > 0 {
+		msg = fmt.Sprintf(msg, args...)
+	}
+	var line string
+	if s.json {
+		line = s.formatJSON(now, level, msg)
+	} else {
+		line = fmt.Sprintf("%-9s%s %s", "["+level.String()+"]", now.Format("2006/01/02 15:04:05"), msg)
+		if len(s.fields) > 0 {
+			line += " " + formatText(s.fields)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, _ = io.WriteString(s.out, line+"\n")
+}
+
+func (s *Structured) formatJSON(now time.Time, level Level, msg string) string {
+	var b strings.Builder
+	b.WriteString(`{"time":`)
+	b.WriteString(jsonValue(now.Format(time.RFC3339Nano)))
+	b.WriteString(`,"level":`)
+	b.WriteString(jsonValue(level.String()))
+	b.WriteString(`,"msg":`)
+	b.WriteString(jsonValue(msg))
+	for i := 0; i < len(s.fields); i += 2 {
+		key, value := pair(s.fields, i)
+		b.WriteString(",")
+		b.WriteString(jsonValue(key))
+		b.WriteString(":")
+		b.WriteString(jsonValue(value))
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+// 编码为JSON, 不能编码的值使用字符串形式
+func jsonValue(v interface{}) string {
+	if err, ok := v.(error); ok {
+		v = err.Error()
+	}
+	d, err := json.Marshal(v)
+	if err != nil {
+		d, _ = json.Marshal(fmt.Sprint(v))
+	}
+	return string(d)
+}
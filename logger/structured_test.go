@@ -0,0 +1,118 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// 记录输出的日志, 不支持字段
+type recordLogger struct {
+	lines []string
+}
+
+func (l *recordLogger) Debugf(msg string, args ...interface{}) { l.add("DEBUG", msg, args) }
+func (l *recordLogger) Infof(msg string, args ...interface{})  { l.add("INFO", msg, args) }
+func (l *recordLogger) Warnf(msg string, args ...interface{})  { l.add("WARN", msg, args) }
+func (l *recordLogger) Errorf(msg string, args ...interface{}) { l.add("ERROR", msg, args) }
+
+func (l *recordLogger) add(level, msg string, args []interface{}) {
+	l.lines = append(l.lines, level+" "+fmt.Sprintf(msg, args...))
+}
+
+// zap.SugaredLogger风格的With
+type zapLike struct {
+	recordLogger
+	fields []interface{}
+}
+
+func (l *zapLike) With(args ...interface{}) *zapLike {
+	return &zapLike{fields: append(append([]interface{}(nil), l.fields...), args...)}
+}
+
+func TestStructuredText(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewStructured(&buf, LevelInfo, false).With("node", "n1", "term", 3)
+	l.Debugf("不输出")
+	l.Infof("成为leader %d", 3)
+	With(l, "peer", "n 2").Warnf("心跳错误")
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("输出了%d行日志:\n%s", len(lines), buf.String())
+	}
+	cases := []struct {
+		line   string
+		prefix string
+		suffix string
+	}{
+		{lines[0], "[INFO]   ", " 成为leader 3 node=n1 term=3"},
+		{lines[1], "[WARN]   ", ` 心跳错误 node=n1 term=3 peer="n 2"`},
+	}
+	for _, tc := range cases {
+		if !strings.HasPrefix(tc.line, tc.prefix) || !strings.HasSuffix(tc.line, tc.suffix) {
+			t.Fatalf("日志%q应该以%q开头,以%q结尾", tc.line, tc.prefix, tc.suffix)
+		}
+	}
+}
+
+func TestStructuredJSON(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewStructured(&buf, LevelDebug, true)
+	With(l, "node", "n1", "err", fmt.Errorf("超时"), "odd").Errorf("发送%s失败", "心跳")
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("不是JSON:%s %s", buf.String(), err.Error())
+	}
+	want := map[string]interface{}{"level": "ERROR", "msg": "发送心跳失败", "node": "n1", "err": "超时", "odd": nil}
+	for k, v := range want {
+		if line[k] != v {
+			t.Fatalf("字段%s是%v,应该是%v:%s", k, line[k], v, buf.String())
+		}
+	}
+	if _, ok := line["time"]; !ok {
+		t.Fatalf("没有time字段:%s", buf.String())
+	}
+}
+
+func TestWithLevelAndFallback(t *testing.T) {
+	rec := &recordLogger{}
+	l := With(WithLevel(rec, LevelWarn), "node", "n1")
+	l.Infof("过滤")
+	l.Warnf("保留%d", 1)
+	if fmt.Sprint(rec.lines) != "[WARN 保留1 node=n1]" {
+		t.Fatalf("输出的日志是%q", rec.lines)
+	}
+	for _, tc := range []struct {
+		in    string
+		level Level
+		ok    bool
+	}{
+		{"debug", LevelDebug, true},
+		{" Info ", LevelInfo, true},
+		{"warning", LevelWarn, true},
+		{"ERROR", LevelError, true},
+		{"trace", LevelDebug, false},
+	} {
+		level, err := ParseLevel(tc.in)
+		if level != tc.level || (err == nil) != tc.ok {
+			t.Fatalf("解析%q得到%s %v", tc.in, level, err)
+		}
+	}
+}
+
+func TestAdaptZapStyleWith(t *testing.T) {
+	l := Adapt(&zapLike{})
+	fl, ok := l.(FieldLogger)
+	if !ok {
+		t.Fatalf("适配后的%T不支持字段", l)
+	}
+	got := fl.With("node", "n1").(*adapter).Logger.(*zapLike)
+	if fmt.Sprint(got.fields) != "[node n1]" {
+		t.Fatalf("通过With附加的字段是%v", got.fields)
+	}
+	if _, ok := Adapt(&recordLogger{}).(*recordLogger); !ok {
+		t.Fatal("没有With方法的日志应该原样返回")
+	}
+}
@@ -0,0 +1,129 @@
+// 子系统的日志级别
+package raft
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kylin-ops/raft/logger"
+)
+
+// 日志子系统, 每个子系统的日志带有subsystem字段, 级别可以单独修改
+const (
+	LogElection  = "election"  // 选举、预投票和leader转移
+	LogHeartbeat = "heartbeat" // 心跳、日志复制和成员在线状态
+	LogHealth    = "health"    // 健康检查
+	LogTransport = "transport" // 长连接和内存网络等传输
+	LogHTTP      = "http"      // http接口
+)
+
+// LogLevelInfo 子系统当前的日志级别
+type LogLevelInfo struct {
+	Level    string `json:"level"`
+	ExpireAt int64  `json:"expire_at"` // 临时级别恢复为配置级别的时间(unix秒), 0表示正在使用配置的级别
+}
+
+// 修改日志级别的请求
+type LogLevelBody struct {
+	Name     string `json:"name"`     // 子系统名称
+	Level    string `json:"level"`    // debug/info/warn/error
+	Duration int64  `json:"duration"` // 多少秒后恢复为配置的级别, 0时使用LogLevelDuration
+}
+
+type logLevels struct {
+	level logger.Level // 配置的级别, 临时级别到期后恢复为这个级别
+	mu    sync.Mutex
+	subs  map[string]*subsystemLogger // 创建后不再增减, 读取不需要加锁
+}
+
+type subsystemLogger struct {
+	logger logger.Logger
+	level  *logger.LevelVar
+	timer  *time.Timer // 恢复级别的定时器
+	expire time.Time
+}
+
+func newLogLevels(base logger.Logger, level logger.Level) *logLevels {
+	l := &logLevels{level: level, subs: map[string]*subsystemLogger{}}
+	for _, name := range []string{LogElection, LogHeartbeat, LogHealth, LogTransport, LogHTTP} {
+		v := logger.NewLevelVar(level)
+		l.subs[name] = &subsystemLogger{
+			logger: logger.WithLevelVar(logger.With(base, "subsystem", name), v),
+			level:  v,
+		}
+	}
+	return l
+}
+
+// 附加本节点id和keyvals字段的子系统日志, 字段按key、value交替排列
+func (r *Raft) logWith(subsystem string, keyvals ...interface{}) logger.Logger {
+	l := r.Logger
+	if sub, ok := r.logLevels.subs[subsystem]; ok {
+		l = sub.logger
+	}
+	return logger.With(l, append([]interface{}{"node", r.Id}, keyvals...)...)
+}
+
+// SetLogLevel 临时修改子系统的日志级别, d之后自动恢复为配置的级别, d小于等于0时使用LogLevelDuration
+// 用于线上排查问题时打开某个子系统的debug日志, 不需要重启节点
+func (r *Raft) SetLogLevel(subsystem string, level logger.Level, d time.Duration) error {
+	sub, ok := r.logLevels.subs[subsystem]
+	if !ok {
+		return fmt.Errorf("未知的日志子系统%s", subsystem)
+	}
+	if d <= 0 {
+		d = time.Duration(r.LogLevelDuration) * time.Second
+	}
+	l := r.logLevels
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if sub.timer != nil {
+		sub.timer.Stop()
+	}
+	sub.level.Set(level)
+	sub.expire = time.Now().Add(d)
+	var timer *time.Timer
+	timer = time.AfterFunc(d, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		// 定时器已经被新的修改替换
+		if sub.timer != timer {
+			return
+		}
+		sub.level.Set(l.level)
+		sub.timer = nil
+		sub.expire = time.Time{}
+		r.Logger.Infof("日志子系统%s的级别恢复为%s", subsystem, l.level)
+	})
+	sub.timer = timer
+	r.Logger.Infof("日志子系统%s的级别修改为%s, %s后恢复为%s", subsystem, level, d, l.level)
+	return nil
+}
+
+// LogLevels 返回每个子系统当前的日志级别
+func (r *Raft) LogLevels() map[string]LogLevelInfo {
+	l := r.logLevels
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	levels := map[string]LogLevelInfo{}
+	for name, sub := range l.subs {
+		info := LogLevelInfo{Level: sub.level.Level().String()}
+		if !sub.expire.IsZero() {
+			info.ExpireAt = sub.expire.Unix()
+		}
+		levels[name] = info
+	}
+	return levels
+}
+
+// LogSubsystems 返回全部日志子系统的名称
+func (r *Raft) LogSubsystems() []string {
+	names := make([]string, 0, len(r.logLevels.subs))
+	for name := range r.logLevels.subs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
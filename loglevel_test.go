@@ -0,0 +1,127 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kylin-ops/raft/logger"
+)
+
+// 并发安全的日志输出
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// 返回并清空已经输出的日志
+func (b *syncBuffer) take() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := b.buf.String()
+	b.buf.Reset()
+	return s
+}
+
+func TestSetLogLevelReverts(t *testing.T) {
+	out := &syncBuffer{}
+	r := newTestNode(t, func(o *Options) {
+		o.Logger = logger.NewStructured(out, logger.LevelDebug, false)
+		o.LogLevel = "warn"
+	})
+	level := func(subsystem string) LogLevelInfo { return r.LogLevels()[subsystem] }
+
+	r.logWith(LogHeartbeat).Debugf("修改前")
+	if err := r.SetLogLevel(LogHeartbeat, logger.LevelDebug, 200*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	r.logWith(LogHeartbeat).Debugf("修改后")
+	r.logWith(LogElection).Debugf("其他子系统")
+	if got := out.take(); strings.Contains(got, "修改前") || strings.Contains(got, "其他子系统") ||
+		!strings.Contains(got, "修改后 subsystem=heartbeat node=n1") {
+		t.Fatalf("修改心跳日志级别后输出的日志:\n%s", got)
+	}
+	if info := level(LogHeartbeat); info.Level != "DEBUG" || info.ExpireAt == 0 {
+		t.Fatalf("修改后心跳日志级别是%+v", info)
+	}
+	if info := level(LogElection); info.Level != "WARN" || info.ExpireAt != 0 {
+		t.Fatalf("选举日志级别是%+v", info)
+	}
+
+	// 到期后恢复为配置的级别
+	deadline := time.Now().Add(5 * time.Second)
+	for level(LogHeartbeat).Level != "WARN" {
+		if time.Now().After(deadline) {
+			t.Fatalf("到期后心跳日志级别是%+v", level(LogHeartbeat))
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if info := level(LogHeartbeat); info.ExpireAt != 0 {
+		t.Fatalf("恢复后还有到期时间%+v", info)
+	}
+	out.take()
+	r.logWith(LogHeartbeat).Debugf("恢复后")
+	if got := out.take(); got != "" {
+		t.Fatalf("恢复后输出了debug日志:\n%s", got)
+	}
+
+	// 再次修改时替换之前的定时器, 之前的定时器到期不会提前恢复
+	_ = r.SetLogLevel(LogHTTP, logger.LevelInfo, 50*time.Millisecond)
+	_ = r.SetLogLevel(LogHTTP, logger.LevelDebug, time.Minute)
+	time.Sleep(200 * time.Millisecond)
+	if info := level(LogHTTP); info.Level != "DEBUG" {
+		t.Fatalf("被替换的定时器恢复了级别:%+v", info)
+	}
+	if err := r.SetLogLevel("unknown", logger.LevelDebug, time.Second); err == nil {
+		t.Fatal("未知的子系统应该返回错误")
+	}
+}
+
+func TestLogLevelHandler(t *testing.T) {
+	r := newTestNode(t, func(o *Options) { o.LogLevel = "info" })
+	cases := []struct {
+		name   string
+		method string
+		body   string
+		code   int
+		level  string // 请求后http子系统的级别
+	}{
+		{"查看级别", http.MethodGet, "", 200, "INFO"},
+		{"请求体错误", http.MethodPost, "{", 201, "INFO"},
+		{"未知的级别", http.MethodPost, `{"name":"http","level":"trace"}`, 201, "INFO"},
+		{"未知的子系统", http.MethodPost, `{"name":"raft","level":"debug"}`, 201, "INFO"},
+		{"修改级别", http.MethodPost, `{"name":"http","level":"debug","duration":60}`, 200, "DEBUG"},
+	}
+	for _, tc := range cases {
+		rec := httptest.NewRecorder()
+		r.Handler().ServeHTTP(rec, httptest.NewRequest(tc.method, "/api/v1/log_level", strings.NewReader(tc.body)))
+		var body struct {
+			Code int                     `json:"code"`
+			Data map[string]LogLevelInfo `json:"data"`
+		}
+		_ = json.Unmarshal(rec.Body.Bytes(), &body)
+		if rec.Code != tc.code || body.Code != tc.code {
+			t.Fatalf("%s: 响应状态%d,应该是%d:%s", tc.name, rec.Code, tc.code, rec.Body.String())
+		}
+		if info := r.LogLevels()[LogHTTP]; info.Level != tc.level {
+			t.Fatalf("%s: http日志级别是%s,应该是%s", tc.name, info.Level, tc.level)
+		}
+		if tc.code == 200 && body.Data[LogHTTP].Level != tc.level {
+			t.Fatalf("%s: 响应中的级别是%+v", tc.name, body.Data)
+		}
+	}
+	if info := r.LogLevels()[LogHTTP]; info.ExpireAt < time.Now().Add(50*time.Second).Unix() {
+		t.Fatalf("修改60秒的级别到期时间是%d", info.ExpireAt)
+	}
+}
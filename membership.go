@@ -0,0 +1,224 @@
+// 集群成员变更
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrConfigChangePending = errors.New("上一次成员变更还没有提交")
+	ErrInvalidMember       = errors.New("成员id和地址不能为空")
+)
+
+// 成员变更请求
+type MemberChangeBody struct {
+	Id      string `json:"id"`      // 添加或者删除的成员id
+	Address string `json:"address"` // 添加成员的通信地址
+	OldId   string `json:"old_id"`  // 替换成员时被替换的成员id
+}
+
+// AddMember 在leader上向集群添加一个成员, 变更提交后返回
+func (r *Raft) AddMember(ctx context.Context, id, address string) error {
+	if address == "" {
+		return ErrInvalidMember
+	}
+	return r.changeMembers(ctx, id, func(members map[string]*Member) error {
+		if _, ok := members[id]; ok {
+			return fmt.Errorf("成员%s已经存在", id)
+		}
+		members[id] = &Member{Id: id, Address: address}
+		return nil
+	})
+}
+
+// RemoveMember 在leader上从集群删除一个成员, 变更提交后返回
+// 删除的是leader自己时, 变更提交后leader退位
+func (r *Raft) RemoveMember(ctx context.Context, id string) error {
+	return r.changeMembers(ctx, id, func(members map[string]*Member) error {
+		if _, ok := members[id]; !ok {
+			return fmt.Errorf("成员%s不存在", id)
+		}
+		delete(members, id)
+		if len(members) == 0 {
+			return errors.New("不能删除集群中最后一个成员")
+		}
+		return nil
+	})
+}
+
+// AddLearner 在leader上向集群添加一个learner, learner接收日志但不投票也不计入多数派
+func (r *Raft) AddLearner(ctx context.Context, id, address string) error {
+	if address == "" {
+		return ErrInvalidMember
+	}
+	return r.changeMembers(ctx, id, func(members map[string]*Member) error {
+		if _, ok := members[id]; ok {
+			return fmt.Errorf("成员%s已经存在", id)
+		}
+		members[id] = &Member{Id: id, Address: address, Learner: true}
+		return nil
+	})
+}
+
+// PromoteLearner 把已经追上leader日志的learner提升为有投票权的成员
+// learner复制的日志需要达到leader的提交索引, 否则提升后可能拖慢提交
+func (r *Raft) PromoteLearner(ctx context.Context, id string) error {
+	return r.changeMembers(ctx, id, func(members map[string]*Member) error {
+		m, ok := members[id]
+		if !ok || !m.Learner {
+			return fmt.Errorf("成员%s不是learner", id)
+		}
+		if match := r.matchIndex[id]; match < r.CommitIndex {
+			return fmt.Errorf("learner %s的日志复制到%d,还没有追上提交索引%d,还不能提升", id, match, r.CommitIndex)
+		}
+		m.Learner = false
+		return nil
+	})
+}
+
+// ReplaceMember 用新成员替换旧成员, 先添加新成员再删除旧成员, 两次变更分别提交
+func (r *Raft) ReplaceMember(ctx context.Context, oldId, id, address string) error {
+	if oldId == "" || id == "" || address == "" {
+		return ErrInvalidMember
+	}
+	r.Mu.Lock()
+	_, ok := r.Members[oldId]
+	r.Mu.Unlock()
+	if !ok {
+		return fmt.Errorf("成员%s不存在", oldId)
+	}
+	if err := r.AddMember(ctx, id, address); err != nil {
+		return err
+	}
+	return r.RemoveMember(ctx, oldId)
+}
+
+// 每次只变更一个成员id, 上一次变更提交之前不允许新的变更
+func (r *Raft) changeMembers(ctx context.Context, id string, change func(map[string]*Member) error) error {
+	if id == "" {
+		return ErrInvalidMember
+	}
+	r.Mu.Lock()
+	if r.Role != RoleLeader {
+		r.Mu.Unlock()
+		return ErrNotLeader
+	}
+	// leader需要先提交本任期的日志, 确认已经拿到最新的成员配置
+	if r.configIndex > r.CommitIndex || r.log.termAt(r.CommitIndex) != r.CurrentTerm {
+		r.Mu.Unlock()
+		return ErrConfigChangePending
+	}
+	members := configMembers(r.Members)
+	if err := change(members); err != nil {
+		r.Mu.Unlock()
+		return err
+	}
+	data, _ := json.Marshal(members)
+	e, err := r.appendEntry(EntryConfig, data)
+	if err != nil {
+		r.Mu.Unlock()
+		return err
+	}
+	p := r.addProposal(e)
+	r.Mu.Unlock()
+	_, err = r.waitProposal(ctx, e.Index, p)
+	return err
+}
+
+func hasConfig(entries []*Entry) bool {
+	for _, e := range entries {
+		if e.Type == EntryConfig {
+			return true
+		}
+	}
+	return false
+}
+
+// 成员配置只保存id、地址和是否是learner
+func configMembers(members map[string]*Member) map[string]*Member {
+	config := map[string]*Member{}
+	for id, m := range members {
+		config[id] = &Member{Id: m.Id, Address: m.Address, Learner: m.Learner}
+	}
+	return config
+}
+
+func decodeConfig(e *Entry) (map[string]*Member, error) {
+	var members map[string]*Member
+	if err := json.Unmarshal(e.Data, &members); err != nil {
+		return nil, fmt.Errorf("索引%d的成员配置日志错误:%s", e.Index, err.Error())
+	}
+	return members, nil
+}
+
+// 切换到新的成员配置, 保留已有成员的状态信息, 调用方需持有锁
+func (r *Raft) setConfig(index int64, members map[string]*Member) {
+	old := r.Members
+	r.configIndex = index
+	r.Members = map[string]*Member{}
+	for id, m := range members {
+		member := &Member{Id: m.Id, Address: m.Address, Learner: m.Learner}
+		if o, ok := old[id]; ok {
+			*member = *o
+			member.Address = m.Address
+			member.Learner = m.Learner
+		} else if index > 0 {
+			r.Logger.Infof("成员%s(%s)加入集群", id, m.Address)
+			r.emit(EventMemberJoined, id)
+		}
+		r.Members[id] = member
+		if _, ok := r.nextIndex[id]; !ok && r.Role == RoleLeader {
+			r.nextIndex[id] = r.log.lastIndex() + 1
+		}
+	}
+	for id := range old {
+		if _, ok := members[id]; !ok {
+			r.Logger.Infof("成员%s离开集群", id)
+			delete(r.nextIndex, id)
+			delete(r.matchIndex, id)
+		}
+	}
+}
+
+// 返回index及之前最新的成员配置和配置所在的索引, 调用方需持有锁
+func (r *Raft) membersAt(index int64) (map[string]*Member, int64) {
+	configs := r.log.configs
+	for j := len(configs) - 1; j >= 0; j-- {
+		i := configs[j]
+		if i > index {
+			continue
+		}
+		members, err := decodeConfig(r.log.entry(i))
+		if err != nil {
+			r.Logger.Errorf("%s", err.Error())
+			continue
+		}
+		return members, i
+	}
+	return configMembers(r.baseMembers), 0
+}
+
+// 日志中的成员配置发生变化后重新加载, 未提交的配置也立即生效, 调用方需持有锁
+func (r *Raft) reloadConfig() {
+	members, index := r.membersAt(r.log.lastIndex())
+	r.setConfig(index, members)
+}
+
+// 成员配置提交后检查leader是否已经被删除, 调用方需持有锁
+func (r *Raft) checkRemoved() {
+	if r.Role != RoleLeader || r.configIndex > r.CommitIndex {
+		return
+	}
+	if _, ok := r.Members[r.Id]; ok {
+		return
+	}
+	if p, ok := r.proposals[r.configIndex]; ok {
+		delete(r.proposals, r.configIndex)
+		p.done <- applyResult{}
+	}
+	r.Logger.Infof("本节点已经从集群中删除,leader退位")
+	r.becomeFollower(r.CurrentTerm, "")
+}
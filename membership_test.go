@@ -0,0 +1,218 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+)
+
+// 启动一个还不在集群配置中的新节点, 成员配置是现有的集群成员
+func (c *testCluster) startNode(id string, configure func(*Options)) *Raft {
+	c.t.Helper()
+	members := map[string]*Member{}
+	for _, r := range c.nodes {
+		members[r.Id] = &Member{Id: r.Id, Address: r.Address}
+	}
+	fsm := &testFSM{}
+	o := &Options{
+		Id:            id,
+		Address:       id,
+		Members:       members,
+		Timeout:       1,
+		Logger:        testLogger(),
+		StateMachine:  fsm,
+		Transport:     c.net.Transport(id),
+		DisableListen: true,
+	}
+	if configure != nil {
+		configure(o)
+	}
+	r := NewRaft(o)
+	if err := r.Start(context.Background()); err != nil {
+		c.t.Fatalf("启动%s错误:%s", id, err.Error())
+	}
+	c.t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_ = r.Shutdown(ctx)
+		cancel()
+	})
+	c.nodes = append(c.nodes, r)
+	c.fsms = append(c.fsms, fsm)
+	return r
+}
+
+// 停止已经从集群删除的节点, 之后不再检查它的状态
+func (c *testCluster) stopNode(r *Raft) {
+	c.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := r.Shutdown(ctx); err != nil {
+		c.t.Fatal(err)
+	}
+	for i, n := range c.nodes {
+		if n == r {
+			c.nodes = append(c.nodes[:i], c.nodes[i+1:]...)
+			c.fsms = append(c.fsms[:i], c.fsms[i+1:]...)
+			return
+		}
+	}
+}
+
+// 节点当前生效的成员id
+func memberIds(r *Raft) string {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	return sortedIds(r.Members)
+}
+
+func sortedIds(members map[string]*Member) string {
+	var ids []string
+	for id := range members {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return fmt.Sprint(ids)
+}
+
+func TestAddAndRemoveMember(t *testing.T) {
+	c := newTestCluster(t, 3, nil)
+	c.waitFor("选出leader", 20*time.Second, func() bool { return c.leader() != nil })
+	c.propose("a")
+
+	// 新节点加入后通过日志追上之前提交的命令
+	n4 := c.startNode("n4", nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := c.leader().AddMember(ctx, "n4", "n4"); err != nil {
+		t.Fatal(err)
+	}
+	c.propose("b")
+	c.waitFor("全部节点应用相同的日志", 20*time.Second, c.converged)
+	if cmds := c.fsms[3].commands(); fmt.Sprint(cmds) != "[a b]" {
+		t.Fatalf("新成员应用的命令是%v", cmds)
+	}
+	for _, r := range c.nodes {
+		if ids := memberIds(r); ids != "[n1 n2 n3 n4]" {
+			t.Fatalf("%s的成员是%s", r.Id, ids)
+		}
+	}
+
+	// 删除一个follower
+	var follower *Raft
+	for _, r := range c.nodes {
+		if r != c.leader() && r != n4 {
+			follower = r
+			break
+		}
+	}
+	if err := c.leader().RemoveMember(ctx, follower.Id); err != nil {
+		t.Fatal(err)
+	}
+	c.stopNode(follower)
+	c.propose("c")
+	c.waitFor("全部节点应用相同的日志", 20*time.Second, c.converged)
+	for _, r := range c.nodes {
+		r.Mu.Lock()
+		_, ok := r.Members[follower.Id]
+		r.Mu.Unlock()
+		if ok {
+			t.Fatalf("%s的成员中还有已经删除的%s", r.Id, follower.Id)
+		}
+	}
+
+	// 删除leader自己, 提交后leader退位, 剩下的成员选出新的leader
+	old := c.leader()
+	if err := old.RemoveMember(ctx, old.Id); err != nil {
+		t.Fatal(err)
+	}
+	c.waitFor("删除的leader退位", 10*time.Second, func() bool {
+		old.Mu.Lock()
+		defer old.Mu.Unlock()
+		return old.Role != RoleLeader
+	})
+	c.stopNode(old)
+	c.waitFor("选出新的leader", 20*time.Second, func() bool { return c.leader() != nil })
+	c.propose("d")
+	c.waitFor("全部节点应用相同的日志", 20*time.Second, c.converged)
+	if ids := memberIds(c.leader()); len(c.nodes) != 2 || ids == "" {
+		t.Fatalf("剩下%d个节点,leader的成员是%s", len(c.nodes), ids)
+	}
+}
+
+func TestChangeMembersRejected(t *testing.T) {
+	c := newTestCluster(t, 3, nil)
+	c.waitFor("选出leader", 20*time.Second, func() bool { return c.leader() != nil })
+	c.propose("a")
+	leader := c.leader()
+	var follower *Raft
+	for _, r := range c.nodes {
+		if r != leader {
+			follower = r
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cases := []struct {
+		name   string
+		change func() error
+	}{
+		{"添加已经存在的成员", func() error { return leader.AddMember(ctx, follower.Id, follower.Address) }},
+		{"添加没有地址的成员", func() error { return leader.AddMember(ctx, "n4", "") }},
+		{"删除不存在的成员", func() error { return leader.RemoveMember(ctx, "n9") }},
+		{"在follower上变更", func() error { return follower.AddMember(ctx, "n4", "n4") }},
+		{"提升不是learner的成员", func() error { return leader.PromoteLearner(ctx, follower.Id) }},
+	}
+	for _, tc := range cases {
+		if err := tc.change(); err == nil {
+			t.Fatalf("%s应该返回错误", tc.name)
+		}
+	}
+	if ids := memberIds(leader); ids != "[n1 n2 n3]" {
+		t.Fatalf("拒绝的变更修改了成员:%s", ids)
+	}
+}
+
+func TestRaftLogConfigIndexes(t *testing.T) {
+	config := func(index int64, ids ...string) *Entry {
+		data, _ := json.Marshal(testMembers(ids...))
+		return &Entry{Index: index, Term: 1, Type: EntryConfig, Data: data}
+	}
+	command := func(index int64) *Entry {
+		return &Entry{Index: index, Term: 1, Type: EntryCommand}
+	}
+	r := newTestNode(t, nil)
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	if err := r.log.append(command(1), config(2, "n1", "n2"), command(3), config(4, "n1", "n2", "n3", "n4"), command(5)); err != nil {
+		t.Fatal(err)
+	}
+	steps := []struct {
+		name    string
+		change  func() error
+		at      int64
+		members string
+		index   int64
+	}{
+		{"最新的配置", nil, 5, "[n1 n2 n3 n4]", 4},
+		{"之前的配置", nil, 3, "[n1 n2]", 2},
+		{"第一个配置之前", nil, 1, "[n1 n2 n3]", 0},
+		{"删除最新的配置", func() error { return r.log.truncate(4) }, 3, "[n1 n2]", 2},
+		{"压缩掉配置", func() error { return r.log.compact(2) }, 3, "[n1 n2 n3]", 0},
+		{"追加新的配置", func() error { return r.log.append(config(4, "n1")) }, 4, "[n1]", 4},
+		{"重新加载", func() error { return r.log.load(2, 1) }, 4, "[n1]", 4},
+	}
+	for _, step := range steps {
+		if step.change != nil {
+			if err := step.change(); err != nil {
+				t.Fatalf("%s: %s", step.name, err.Error())
+			}
+		}
+		members, index := r.membersAt(step.at)
+		if ids := sortedIds(members); ids != step.members || index != step.index {
+			t.Fatalf("%s: 索引%d的成员是%s,配置索引%d", step.name, step.at, ids, index)
+		}
+	}
+}
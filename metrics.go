@@ -0,0 +1,239 @@
+// 监控指标
+package raft
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 指标名称
+const (
+	MetricElectionsStarted      = "raft_elections_started_total"       // 发起的选举次数
+	MetricElectionsWon          = "raft_elections_won_total"           // 赢得的选举次数
+	MetricElectionsLost         = "raft_elections_lost_total"          // 没有赢得的选举次数
+	MetricLeaderChanges         = "raft_leader_changes_total"          // 本节点看到的leader变化次数
+	MetricTerm                  = "raft_term"                          // 当前任期
+	MetricIsLeader              = "raft_is_leader"                     // 本节点是否是leader, 1或者0
+	MetricCommitIndex           = "raft_commit_index"                  // 提交索引
+	MetricLastApplied           = "raft_last_applied"                  // 已经应用到状态机的索引
+	MetricSecondsSinceHeartbeat = "raft_seconds_since_last_heartbeat"  // follower距离最近一次收到leader心跳的秒数, leader为0
+	MetricHeartbeatDuration     = "raft_heartbeat_duration_seconds"    // leader向成员发送心跳的耗时, 标签peer
+	MetricHeartbeatFailures     = "raft_heartbeat_failures_total"      // leader向成员发送心跳失败的次数, 标签peer
+	MetricHealthCheckDuration   = "raft_health_check_duration_seconds" // 健康检查的耗时
+	MetricHealthCheckFailures   = "raft_health_check_failures_total"   // 健康检查失败的次数
+)
+
+// Labels 指标的标签
+type Labels map[string]string
+
+// Metrics 记录监控指标, 可以实现这个接口把指标接入自己的监控系统
+// 方法在选举和心跳的过程中调用, 部分调用时持有Raft的锁, 实现中不能调用Raft的方法, 也不能阻塞
+type Metrics interface {
+	// 计数器加一
+	IncCounter(name string, labels Labels)
+	// 设置当前值
+	SetGauge(name string, labels Labels, value float64)
+	// 记录一次观测值, 例如耗时的秒数
+	ObserveHistogram(name string, labels Labels, value float64)
+}
+
+// 内置指标的说明
+var metricHelps = map[string]string{
+	MetricElectionsStarted:      "Number of elections started by this node.",
+	MetricElectionsWon:          "Number of elections won by this node.",
+	MetricElectionsLost:         "Number of elections this node did not win.",
+	MetricLeaderChanges:         "Number of leader changes observed by this node.",
+	MetricTerm:                  "Current term.",
+	MetricIsLeader:              "Whether this node is the leader.",
+	MetricCommitIndex:           "Highest log index known to be committed.",
+	MetricLastApplied:           "Highest log index applied to the state machine.",
+	MetricSecondsSinceHeartbeat: "Seconds since the last heartbeat from the leader, 0 on the leader.",
+	MetricHeartbeatDuration:     "Latency of heartbeat RPCs sent by the leader.",
+	MetricHeartbeatFailures:     "Number of failed heartbeat RPCs sent by the leader.",
+	MetricHealthCheckDuration:   "Duration of health checks.",
+	MetricHealthCheckFailures:   "Number of failed health checks.",
+}
+
+// 直方图默认的桶, 单位秒
+var defaultBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// PrometheusMetrics 内置的指标实现, 在内存中记录指标, 作为http.Handler输出Prometheus文本格式
+// 没有配置Options.Metrics时默认使用, 通过运维接口/metrics访问
+type PrometheusMetrics struct {
+	mu      sync.Mutex
+	metrics map[string]*metricFamily
+}
+
+type metricFamily struct {
+	typ    string
+	series map[string]*metricSeries // key是格式化后的标签
+}
+
+type metricSeries struct {
+	labels Labels
+	value  float64  // 计数器和当前值
+	counts []uint64 // 直方图每个桶的数量, 不累加
+	sum    float64
+	count  uint64
+}
+
+func NewPrometheusMetrics() *PrometheusMetrics {
+	return &PrometheusMetrics{metrics: map[string]*metricFamily{}}
+}
+
+func (p *PrometheusMetrics) IncCounter(name string, labels Labels) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.series(name, "counter", labels).value++
+}
+
+func (p *PrometheusMetrics) SetGauge(name string, labels Labels, value float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.series(name, "gauge", labels).value = value
+}
+
+func (p *PrometheusMetrics) ObserveHistogram(name string, labels Labels, value float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.series(name, "histogram", labels)
+	if s.counts == nil {
+		s.counts = make([]uint64, len(defaultBuckets))
+	}
+	for i, bound := range defaultBuckets {
+		if value <= bound {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+func (p *PrometheusMetrics) series(name, typ string, labels Labels) *metricSeries {
+	f, ok := p.metrics[name]
+	if !ok {
+		f = &metricFamily{typ: typ, series: map[string]*metricSeries{}}
+		p.metrics[name] = f
+	}
+	key := formatLabels(labels, "", "")
+	s, ok := f.series[key]
+	if !ok {
+		s = &metricSeries{labels: labels}
+		f.series[key] = s
+	}
+	return s
+}
+
+// ServeHTTP 输出Prometheus文本格式的指标
+func (p *PrometheusMetrics) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = resp.Write([]byte(p.Text()))
+}
+
+// Text 返回Prometheus文本格式的全部指标
+func (p *PrometheusMetrics) Text() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	names := make([]string, 0, len(p.metrics))
+	for name := range p.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		f := p.metrics[name]
+		if help, ok := metricHelps[name]; ok {
+			fmt.Fprintf(&b, "# HELP %s %s\n", name, help)
+		}
+		fmt.Fprintf(&b, "# TYPE %s %s\n", name, f.typ)
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s := f.series[key]
+			if f.typ != "histogram" {
+				fmt.Fprintf(&b, "%s%s %s\n", name, key, formatFloat(s.value))
+				continue
+			}
+			var cumulative uint64
+			for i, bound := range defaultBuckets {
+				if s.counts != nil {
+					cumulative += s.counts[i]
+				}
+				fmt.Fprintf(&b, "%s_bucket%s %d\n", name, formatLabels(s.labels, "le", formatFloat(bound)), cumulative)
+			}
+			fmt.Fprintf(&b, "%s_bucket%s %d\n", name, formatLabels(s.labels, "le", "+Inf"), s.count)
+			fmt.Fprintf(&b, "%s_sum%s %s\n", name, key, formatFloat(s.sum))
+			fmt.Fprintf(&b, "%s_count%s %d\n", name, key, s.count)
+		}
+	}
+	return b.String()
+}
+
+// 标签值中需要转义的字符
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// 按名称排序格式化标签, extraName不为空时追加一个标签
+func formatLabels(labels Labels, extraName, extraValue string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, 0, len(names)+1)
+	for _, name := range names {
+		pairs = append(pairs, name+`="`+labelEscaper.Replace(labels[name])+`"`)
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+labelEscaper.Replace(extraValue)+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// 后台每秒更新一次任期、角色和距离最近一次心跳的时间等当前值
+func (r *Raft) BackendMetrics() {
+	for r.sleep(time.Second) {
+		r.Mu.Lock()
+		term := r.CurrentTerm
+		leader := r.Role == RoleLeader
+		commit := r.CommitIndex
+		applied := r.LastApplied
+		contact := r.leaderContact
+		r.Mu.Unlock()
+		isLeader := 0.0
+		if leader {
+			isLeader = 1
+		}
+		r.Metrics.SetGauge(MetricTerm, nil, float64(term))
+		r.Metrics.SetGauge(MetricIsLeader, nil, isLeader)
+		r.Metrics.SetGauge(MetricCommitIndex, nil, float64(commit))
+		r.Metrics.SetGauge(MetricLastApplied, nil, float64(applied))
+		if leader {
+			r.Metrics.SetGauge(MetricSecondsSinceHeartbeat, nil, 0)
+		} else if !contact.IsZero() {
+			r.Metrics.SetGauge(MetricSecondsSinceHeartbeat, nil, time.Since(contact).Seconds())
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package raft
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 通过运维接口读取节点的指标
+func scrapeMetrics(t *testing.T, r *Raft) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != 200 {
+		t.Fatalf("读取指标返回%d", rec.Code)
+	}
+	return rec.Body.String()
+}
+
+func TestHeartbeatMetricsPeerLabels(t *testing.T) {
+	c := newTestCluster(t, 3, nil)
+	c.waitFor("选出leader", 20*time.Second, func() bool { return c.leader() != nil })
+	c.propose("a")
+	leader := c.leader()
+	var follower *Raft
+	for _, r := range c.nodes {
+		if r != leader {
+			follower = r
+		}
+	}
+	c.net.Isolate(follower.Address)
+	c.waitFor("记录心跳失败", 10*time.Second, func() bool {
+		return strings.Contains(scrapeMetrics(t, leader), fmt.Sprintf(`%s{peer="%s"}`, MetricHeartbeatFailures, follower.Id))
+	})
+
+	text := scrapeMetrics(t, leader)
+	for _, r := range c.nodes {
+		series := fmt.Sprintf(`%s_count{peer="%s"}`, MetricHeartbeatDuration, r.Id)
+		if r == leader {
+			if strings.Contains(text, `peer="`+r.Id+`"`) {
+				t.Fatalf("leader记录了发给自己的心跳指标:\n%s", text)
+			}
+		} else if !strings.Contains(text, series) {
+			t.Fatalf("没有%s的心跳耗时:\n%s", r.Id, text)
+		}
+	}
+	if !strings.Contains(text, "# TYPE "+MetricHeartbeatDuration+" histogram") {
+		t.Fatalf("心跳耗时不是直方图:\n%s", text)
+	}
+	// 当前值由后台每秒更新一次
+	c.waitFor("更新leader指标", 5*time.Second, func() bool {
+		return strings.Contains(scrapeMetrics(t, leader), MetricIsLeader+" 1\n")
+	})
+}
+
+func TestPrometheusMetricsText(t *testing.T) {
+	p := NewPrometheusMetrics()
+	p.IncCounter(MetricElectionsStarted, nil)
+	p.IncCounter(MetricElectionsStarted, nil)
+	p.SetGauge(MetricTerm, nil, 3)
+	p.SetGauge("custom", Labels{"name": "a\"b"}, math.Inf(1))
+	p.ObserveHistogram(MetricHeartbeatDuration, Labels{"peer": "n2"}, 0.003)
+	p.ObserveHistogram(MetricHeartbeatDuration, Labels{"peer": "n2"}, 20)
+	text := p.Text()
+	for _, line := range []string{
+		"# TYPE raft_elections_started_total counter",
+		"raft_elections_started_total 2",
+		"raft_term 3",
+		`custom{name="a\"b"} +Inf`,
+		`raft_heartbeat_duration_seconds_bucket{peer="n2",le="0.0025"} 0`,
+		`raft_heartbeat_duration_seconds_bucket{peer="n2",le="0.005"} 1`,
+		`raft_heartbeat_duration_seconds_bucket{peer="n2",le="10"} 1`,
+		`raft_heartbeat_duration_seconds_bucket{peer="n2",le="+Inf"} 2`,
+		`raft_heartbeat_duration_seconds_count{peer="n2"} 2`,
+	} {
+		if !strings.Contains(text, line+"\n") {
+			t.Fatalf("指标中没有%q:\n%s", line, text)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+// 事件通知
+package raft
+
+import (
+	"sync"
+	"time"
+)
+
+// 事件缓冲区大小, 缓冲区满时丢弃新的事件
+const eventBufferSize = 1024
+
+type EventType string
+
+const (
+	EventBecameLeader   EventType = "became_leader"   // 本节点成为leader
+	EventLostLeadership EventType = "lost_leadership" // 本节点不再是leader
+	EventLeaderChanged  EventType = "leader_changed"  // 集群的leader发生变化
+	EventMemberJoined   EventType = "member_joined"   // 新成员加入集群
+	EventMemberDown     EventType = "member_down"     // leader向成员发送心跳失败
+	EventUnhealthy      EventType = "unhealthy"       // 本节点健康检查失败
+	EventHealthy        EventType = "healthy"         // 本节点健康检查恢复正常
+)
+
+// 事件
+type Event struct {
+	Type     EventType `json:"type"`
+	Term     int64     `json:"term"`      // 事件发生时的任期
+	Leader   string    `json:"leader"`    // 事件发生时的leader
+	MemberId string    `json:"member_id"` // 成员事件对应的成员id
+	Time     time.Time `json:"time"`
+}
+
+// 事件分发
+type observers struct {
+	mu       sync.Mutex
+	fns      []func(Event)
+	eventCh  chan Event
+	leaderCh chan bool
+	leaderMu sync.Mutex // 写入leaderCh互斥
+}
+
+func newObservers() *observers {
+	return &observers{
+		eventCh:  make(chan Event, eventBufferSize),
+		leaderCh: make(chan bool, 1),
+	}
+}
+
+// Observe 注册事件回调, 回调在单独的goroutine中按事件发生的顺序调用, 不会阻塞选举和心跳
+// 回调执行太慢导致缓冲区满时新的事件会被丢弃
+func (r *Raft) Observe(fn func(Event)) {
+	r.observers.mu.Lock()
+	defer r.observers.mu.Unlock()
+	r.observers.fns = append(r.observers.fns, fn)
+}
+
+// LeaderCh 本节点成为leader时收到true, 不再是leader时收到false
+// 通道只保留最新的状态, 没有及时读取时旧的状态会被覆盖; 不经过事件缓冲区, 回调太慢时也不会丢失最新的状态
+func (r *Raft) LeaderCh() <-chan bool {
+	return r.observers.leaderCh
+}
+
+// 发出事件, 不阻塞, 调用方需持有锁
+// leader状态直接写入LeaderCh, 不受事件缓冲区影响
+func (r *Raft) emit(typ EventType, memberId string) {
+	switch typ {
+	case EventBecameLeader:
+		r.observers.setLeader(true)
+	case EventLostLeadership:
+		r.observers.setLeader(false)
+	}
+	e := Event{Type: typ, Term: r.CurrentTerm, Leader: r.CurrentLeader, MemberId: memberId, Time: time.Now()}
+	select {
+	case r.observers.eventCh <- e:
+	default:
+		r.Logger.Warnf("事件缓冲区已满,丢弃事件%s", typ)
+	}
+}
+
+// 后台把事件分发给回调
+func (r *Raft) BackendEvents() {
+	for {
+		var e Event
+		select {
+		case e = <-r.observers.eventCh:
+		case <-r.done:
+			return
+		}
+		r.observers.mu.Lock()
+		fns := make([]func(Event), len(r.observers.fns))
+		copy(fns, r.observers.fns)
+		r.observers.mu.Unlock()
+		for _, fn := range fns {
+			fn(e)
+		}
+	}
+}
+
+// 用最新的状态替换通道中没有读取的状态, 不阻塞
+// 写入方都持有leaderMu, 取出旧的状态后通道一定有空位
+func (o *observers) setLeader(leader bool) {
+	o.leaderMu.Lock()
+	defer o.leaderMu.Unlock()
+	select {
+	case <-o.leaderCh:
+	default:
+	}
+	o.leaderCh <- leader
+}
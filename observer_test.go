@@ -0,0 +1,123 @@
+package raft
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// 记录回调收到的事件
+type testObserver struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (o *testObserver) observe(e Event) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events = append(o.events, e)
+}
+
+// 是否收到过满足条件的事件
+func (o *testObserver) has(typ EventType, match func(Event) bool) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, e := range o.events {
+		if e.Type == typ && (match == nil || match(e)) {
+			return true
+		}
+	}
+	return false
+}
+
+// 读出LeaderCh中最新的状态, 通道为空时返回last
+func latestLeaderState(r *Raft, last bool) bool {
+	for {
+		select {
+		case last = <-r.LeaderCh():
+		default:
+			return last
+		}
+	}
+}
+
+func TestLeadershipEvents(t *testing.T) {
+	c := newTestCluster(t, 3, func(o *Options) { o.CheckQuorum = true })
+	c.waitFor("选出leader", 20*time.Second, func() bool { return c.leader() != nil })
+	old := c.leader()
+	if !latestLeaderState(old, false) {
+		t.Fatal("leader的LeaderCh没有收到true")
+	}
+	observers := map[*Raft]*testObserver{}
+	for _, r := range c.nodes {
+		o := &testObserver{}
+		r.Observe(o.observe)
+		observers[r] = o
+	}
+
+	// 隔离leader, 原leader退位, 其他成员选出新的leader
+	c.net.Isolate(old.Address)
+	var others []*Raft
+	for _, r := range c.nodes {
+		if r != old {
+			others = append(others, r)
+		}
+	}
+	c.waitFor("选出新的leader", 20*time.Second, func() bool { return c.leader(others...) != nil })
+	leader := c.leader(others...)
+	var follower *Raft
+	for _, r := range others {
+		if r != leader {
+			follower = r
+		}
+	}
+	c.waitFor("收到全部事件", 10*time.Second, func() bool {
+		return observers[old].has(EventLostLeadership, nil) &&
+			observers[leader].has(EventBecameLeader, func(e Event) bool { return e.Leader == leader.Id }) &&
+			observers[follower].has(EventLeaderChanged, func(e Event) bool { return e.Leader == leader.Id })
+	})
+	if latestLeaderState(old, true) {
+		t.Fatal("退位的leader的LeaderCh没有收到false")
+	}
+	if !latestLeaderState(leader, false) {
+		t.Fatal("新的leader的LeaderCh没有收到true")
+	}
+	if observers[follower].has(EventBecameLeader, nil) {
+		t.Fatal("follower收到了成为leader的事件")
+	}
+
+	// 原leader恢复并在线后再次断开, leader发出成员离线事件
+	c.net.Heal()
+	c.propose("a")
+	c.waitFor("全部节点应用相同的日志", 20*time.Second, c.converged)
+	leader = c.leader()
+	down := c.nodes[0]
+	if down == leader {
+		down = c.nodes[1]
+	}
+	c.waitFor("成员心跳在线", 10*time.Second, func() bool {
+		leader.Mu.Lock()
+		defer leader.Mu.Unlock()
+		return leader.Members[down.Id].HeartbeatStatus == "online"
+	})
+	c.net.Isolate(down.Address)
+	c.waitFor("收到成员离线事件", 10*time.Second, func() bool {
+		return observers[leader].has(EventMemberDown, func(e Event) bool { return e.MemberId == down.Id })
+	})
+}
+
+func TestLeaderChKeepsLatestState(t *testing.T) {
+	o := newObservers()
+	// 没有读取时旧的状态被覆盖, 不会阻塞
+	for _, leader := range []bool{true, false, true, false} {
+		o.setLeader(leader)
+	}
+	select {
+	case leader := <-o.leaderCh:
+		if leader {
+			t.Fatal("LeaderCh中不是最新的状态")
+		}
+	default:
+		t.Fatal("LeaderCh中没有状态")
+	}
+}
@@ -3,7 +3,12 @@ package raft
 
 import (
 	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/kylin-ops/raft/health"
 
@@ -12,20 +17,90 @@ import (
 
 var RaftInstance *Raft
 
+// 节点角色
+const (
+	RoleFollower  = "follower"
+	RoleCandidate = "candidate"
+	RoleLeader    = "leader"
+	RoleLearner   = "learner" // 只接收日志, 不投票也不参与选举
+)
+
 type Options struct {
 	Id            string             `json:"id"`             // 本节点id
 	Address       string             `json:"string"`         // 集群通信地址
 	Members       map[string]*Member `json:"members"`        // raft集群成员
 	Timeout       int64              `json:"timeout"`        // 多少秒没有收到心跳置为超时
 	NoElection    bool               `json:"no_election"`    // 本节点是否不参加leader选举
-	DefaultLeader string             `json:"default_leader"` // 默认leader
+	DefaultLeader string             `json:"default_leader"` // 默认leader, 追上日志后由leader转移给它, 仍然需要选举
 	HealthChecker health.Checker     `json:"-"`
-	Logger        logger.Logger      `json:"-"` // 日志接口
+	Logger        logger.Logger      `json:"-"`          // 日志接口, 为空时输出到标准输出
+	LogLevel      string             `json:"log_level"`  // 最低的日志级别debug/info/warn/error, 为空时输出全部日志
+	LogFormat     string             `json:"log_format"` // Logger为空时的日志格式, text或者json输出结构化日志, 为空时使用logger.Log
+	StateMachine  StateMachine       `json:"-"`          // 业务状态机, 已提交的命令应用到这里
+	Storage       Storage            `json:"-"`          // 持久化存储, 为空时使用DataDir下的文件存储
+	DataDir       string             `json:"data_dir"`   // 数据目录, 和Storage都为空时使用内存存储, 重启后数据丢失
+	// 通过SetLogLevel或者运维接口临时修改子系统日志级别后, 多少秒恢复为LogLevel, 默认600
+	LogLevelDuration int64 `json:"log_level_duration"`
+	// 上次快照之后应用了多少条日志或者多少字节的日志数据时生成新的快照
+	SnapshotEntries int64 `json:"snapshot_entries"`
+	SnapshotBytes   int64 `json:"snapshot_bytes"`
+	// 开启PreVote, 候选人先确认能赢得选举再增加任期, 避免网络恢复的节点打断正常的leader
+	PreVote bool `json:"pre_vote"`
+	// 开启CheckQuorum, leader在Timeout内没有收到多数派成员的心跳响应时退位,
+	// 成员在Timeout内收到过leader心跳或者投出过选票时拒绝其他候选人的投票请求
+	// leader通过心跳把这个设置带给成员, 没有开启的成员跟随开启了的leader时也按同样的规则拒绝投票
+	CheckQuorum bool `json:"check_quorum"`
+	// leader租约(秒), 大于0时自动开启CheckQuorum, IsLeader只在租约内返回true, 需要小于Timeout
+	LeaderLease int64 `json:"leader_lease"`
+	// 停止时如果是leader, 先把leader转移给心跳在线、健康且日志最新的成员
+	TransferOnShutdown bool `json:"transfer_on_shutdown"`
+	// 支持context和详细结果的健康检查, 为空时使用HealthChecker; 内置TCP、DNS、GRPC、File、Process、DiskFree和Func等检查
+	HealthCheckerV2 health.CheckerV2 `json:"-"`
+	// 后台执行HealthChecker的间隔(秒), 默认1; 检查失败的节点不参与选举, leader转移leader后退位
+	HealthCheckInterval int64 `json:"health_check_interval"`
+	// 单次健康检查的超时(秒), 默认等于HealthCheckInterval, 超时记为失败
+	HealthCheckTimeout int64 `json:"health_check_timeout"`
+	// 连续成功Rise次恢复健康(默认2), 连续失败Fall次变为不健康(默认3)
+	HealthCheckRise int64 `json:"health_check_rise"`
+	HealthCheckFall int64 `json:"health_check_fall"`
+	// 保留最近多少次健康检查的结果, 默认10
+	HealthCheckHistory int64 `json:"health_check_history"`
+	// 接口路由的前缀, 例如/raft, 所有成员需要配置相同的前缀
+	RoutePrefix string `json:"route_prefix"`
+	// 不启动自己的http服务, 通过Handler()把接口挂载到应用的http服务中
+	DisableListen bool `json:"disable_listen"`
+	// 向其他成员发送请求的传输, 为空时使用HTTP/JSON, 成员较多时可以使用长连接的StreamTransport
+	Transport Transport `json:"-"`
+	// 成员之间的双向TLS, 证书、私钥和CA都是PEM文件, 文件修改后自动重新加载
+	// 成员证书的CommonName或者DNS名称需要等于成员id, 请求方和响应方都校验对方的身份
+	TLSCertFile string `json:"tls_cert_file"`
+	TLSKeyFile  string `json:"tls_key_file"`
+	TLSCAFile   string `json:"tls_ca_file"`
+	// 集群密钥, 配置后成员之间的请求带有HMAC签名, 拒绝没有签名、签名错误、过期和重放的请求
+	// 比TLS轻量但不加密请求内容, 所有成员需要配置相同的密钥
+	ClusterSecret string `json:"-"`
+	// 运维接口(get_info、成员变更、leader转移)的鉴权, 为空时不鉴权; 内置BasicAuth和BearerToken
+	Authorizer Authorizer `json:"-"`
+	// 运维接口单独监听的地址, 配置后Address只提供成员之间的接口, 运维接口只在这个地址上提供(不使用TLS)
+	AdminAddress string `json:"admin_address"`
+	// 监控指标, 为空时使用内置的PrometheusMetrics; 实现了http.Handler时通过运维接口/metrics输出
+	Metrics Metrics `json:"-"`
 }
 
+// 投票请求
 type Leader struct {
-	Term     int64  `json:"trem"`
-	LeaderId string `json:"leader_id"`
+	Term         int64  `json:"term"`           // 候选人的任期
+	LeaderId     string `json:"leader_id"`      // 候选人id
+	LastLogIndex int64  `json:"last_log_index"` // 候选人最后一条日志的索引
+	LastLogTerm  int64  `json:"last_log_term"`  // 候选人最后一条日志的任期
+	PreVote      bool   `json:"pre_vote"`       // 是否是预投票, 预投票不改变投票方的任期和选票
+	Transfer     bool   `json:"transfer"`       // 是否是leader转移发起的选举, 不受leader租约限制
+}
+
+// 投票响应
+type ElectionReply struct {
+	Term        int64 `json:"term"`         // 投票节点的当前任期，候选人据此更新自己的任期
+	VoteGranted bool  `json:"vote_granted"` // 是否把选票投给了候选人
 }
 
 type Member struct {
@@ -33,15 +108,32 @@ type Member struct {
 	Address           string `json:"address"`
 	Role              string `json:"role"`
 	LeaderId          string `json:"leader_id"`
-	ElectionStatus    string `json:"election_status"`     // 选举状态ok时，竞选者不在发送选举信息
+	ElectionStatus    string `json:"election_status"`     // 本任期的拉票结果 ok/failed/error/unauthorized
 	HeartbeatStatus   string `json:"heartbeat_status"`    // 心跳检测状态
 	LastHeartbeatTime int64  `json:"last_heartbeat_time"` // 最后一次接收时间
-	//Term              int64  `json:"term"`              // leader 发生任期信息
+	Learner           bool   `json:"learner"`             // 是否是learner, learner不投票也不计入多数派
+	Unhealthy         bool   `json:"unhealthy"`           // 健康检查失败, 不会成为leader转移的目标
 }
 
+// 心跳即AppendEntries请求, 不携带日志时只用于维持leader地位
 type HeartbeatBody struct {
-	Leader  string             `json:"leader"`
-	Members map[string]*Member `json:"members"`
+	Term         int64              `json:"term"` // leader的任期
+	Leader       string             `json:"leader"`
+	Members      map[string]*Member `json:"members"`
+	PrevLogIndex int64              `json:"prev_log_index"` // 新日志之前一条日志的索引
+	PrevLogTerm  int64              `json:"prev_log_term"`  // 新日志之前一条日志的任期
+	Entries      []*Entry           `json:"entries"`        // 需要复制的日志, 为空时是单纯的心跳
+	LeaderCommit int64              `json:"leader_commit"`  // leader已提交的日志索引
+	CheckQuorum  bool               `json:"check_quorum"`   // leader开启了CheckQuorum, 成员按同样的规则拒绝其他候选人
+}
+
+// 心跳响应
+type HeartbeatReply struct {
+	Term          int64 `json:"term"`           // 接收节点的当前任期，leader发现更高任期时退位
+	Success       bool  `json:"success"`        // 是否接受了心跳
+	MatchIndex    int64 `json:"match_index"`    // 成功时与leader一致的最后一条日志索引
+	ConflictIndex int64 `json:"conflict_index"` // 日志不一致时leader应该回退到的索引
+	Unhealthy     bool  `json:"unhealthy"`      // 接收节点的健康检查失败
 }
 
 // Raft 声明raft
@@ -49,10 +141,61 @@ type Raft struct {
 	Options
 	Mu                sync.Mutex `json:"-"`                   //锁
 	LastHeartbeatTime int64      `json:"last_heartbeat_time"` // 最后一次更新时间
-	VotedFor          string     `json:"voted_for"`           // 为那个节点投票  "" 代表没投票
-	VotedCount        int        `json:"voted_count"`         // 获得的票数
-	Role              string     `json:"role"`                // 0 follower  1 candidate  2 leader
+	CurrentTerm       int64      `json:"current_term"`        // 节点当前任期，只增不减
+	VotedFor          string     `json:"voted_for"`           // 当前任期投票给了哪个节点  "" 代表没投票
+	VotedCount        int        `json:"voted_count"`         // 当前任期获得的票数
+	Role              string     `json:"role"`                // follower candidate leader
 	CurrentLeader     string     `json:"current_leader"`      // 集群当前的leader
+	CommitIndex       int64      `json:"commit_index"`        // 已经被多数成员复制的最大日志索引
+	LastApplied       int64      `json:"last_applied"`        // 已经应用到状态机的最大日志索引
+	// 本节点的健康状态、连续成功和失败的次数以及最近的结果, 不健康时不参与选举
+	Health HealthStatus `json:"health"`
+
+	log           *raftLog
+	savedTerm     int64               // 已经持久化的任期
+	savedVotedFor string              // 已经持久化的投票
+	nextIndex     map[string]int64    // leader为每个成员记录下一条要发送的日志索引
+	matchIndex    map[string]int64    // leader为每个成员记录已经复制成功的最大日志索引
+	replicateCh   chan struct{}       // 有新日志时通知后台立即复制
+	applyCh       chan struct{}       // 提交索引推进时通知后台应用日志
+	proposals     map[int64]*proposal // leader上等待应用结果的命令
+
+	applyMu         sync.Mutex       // 应用日志和安装快照互斥
+	snapshotIndex   int64            // 最近一次快照的索引
+	appliedBytes    int64            // 最近一次快照之后应用的日志字节数
+	receiving       *pendingSnapshot // follower正在接收的快照
+	sendingSnapshot map[string]bool  // leader正在向哪些成员发送快照
+
+	configIndex int64              // 当前成员配置所在的日志索引, 0表示来自启动配置或者快照
+	baseMembers map[string]*Member // 日志中没有成员配置时使用的成员, 来自启动配置或者快照
+	transferee  string             // leader正在把leader转移给这个成员
+
+	ackTime       map[string]time.Time // leader记录每个成员最近一次响应的心跳的发送时间, 当选时为空
+	leaderSince   time.Time            // 本节点成为leader的时间, 之后的Timeout内CheckQuorum不检查
+	leaderContact time.Time            // 最近一次收到leader心跳的时间
+	voteTime      time.Time            // 最近一次投出选票的时间
+	quorumChecked bool                 // 最近一次收到的leader心跳是否要求CheckQuorum
+
+	observers   *observers // 事件回调和LeaderCh
+	knownLeader string     // 最近一次通知过的leader
+
+	started      bool           // 是否已经启动过
+	handler      http.Handler   // 集群通信和管理接口
+	peerHandler  http.Handler   // 成员之间的接口
+	adminHandler http.Handler   // 运维接口
+	adminServer  *http.Server   // 运维接口单独监听时的http服务
+	tls          *tlsFiles      // 双向TLS的证书, 没有配置时为nil
+	nonces       nonceCache     // 签名中已经使用过的随机数
+	logLevels    *logLevels     // 子系统日志和运行时修改的级别
+	server       *http.Server   // 集群通信的http服务
+	serveErr     error          // http服务异常退出的错误
+	done         chan struct{}  // 关闭时通知后台任务退出
+	stopped      chan struct{}  // 后台任务全部退出后关闭
+	stopOnce     sync.Once      // 只停止一次
+	wg           sync.WaitGroup // 等待后台任务退出
+
+	// 正在处理的长连接, http服务停止时不会关闭已经切换协议的连接, 由节点停止时关闭
+	streamConns map[net.Conn]bool
 
 	// Id            string             `json:"id"`
 	// Address       string             `json:"address"`
@@ -67,33 +210,312 @@ type Raft struct {
 
 func (r *Raft) GetMembers() map[string]*Member {
 	var members map[string]*Member
+	r.Mu.Lock()
 	d, _ := json.Marshal(r.Members)
+	r.Mu.Unlock()
 	_ = json.Unmarshal(d, &members)
 	return members
 }
 
-func (r *Raft) Start() {
-	go r.httpServer()
-	go r.BackendElection()
-	go r.BackendHeatbeat()
-	go r.BackendReCandidate()
-	go r.BackendDefaultLeader()
-	select {}
+// 发现更高的任期或者合法的leader时转为follower, 调用方需持有锁
+func (r *Raft) becomeFollower(term int64, leader string) {
+	if term > r.CurrentTerm {
+		r.CurrentTerm = term
+		r.VotedFor = ""
+		_ = r.persistState()
+	}
+	if r.Role == RoleLeader {
+		r.logWith(LogElection).Infof("节点%s在任期%d退位为follower", r.Id, r.CurrentTerm)
+		r.failProposals(ErrLeadershipLost)
+		r.emit(EventLostLeadership, "")
+	}
+	// 没有leader时候选人以新的任期继续参与选举, 否则任期更高但日志落后的节点不断拉票会让其他节点一直无法发起选举
+	if r.Role != RoleCandidate || leader != "" {
+		r.Role = RoleFollower
+	}
+	r.CurrentLeader = leader
+	r.VotedCount = 0
+	r.transferee = ""
+	r.leaderChanged()
+}
+
+// leader发生变化时发出通知, 调用方需持有锁
+func (r *Raft) leaderChanged() {
+	if r.CurrentLeader == "" || r.CurrentLeader == r.knownLeader {
+		return
+	}
+	r.knownLeader = r.CurrentLeader
+	r.emit(EventLeaderChanged, "")
+	r.Metrics.IncCounter(MetricLeaderChanges, nil)
+}
+
+// 赢得选举成为leader, 调用方需持有锁
+func (r *Raft) becomeLeader() {
+	r.Role = RoleLeader
+	r.CurrentLeader = r.Id
+	r.transferee = ""
+	r.nextIndex = map[string]int64{}
+	r.matchIndex = map[string]int64{}
+	// 选票不算作心跳响应, 租约从多数派成员响应本任期的心跳开始; CheckQuorum给一个超时时间收集心跳响应
+	r.ackTime = map[string]time.Time{}
+	r.leaderSince = time.Now()
+	for id := range r.Members {
+		r.nextIndex[id] = r.log.lastIndex() + 1
+	}
+	// 写入本任期的空日志, 之前任期的日志随它一起提交
+	if _, err := r.appendEntry(EntryNoop, nil); err != nil {
+		r.Logger.Errorf("写入空日志错误:%s", err.Error())
+	}
+	r.logWith(LogElection).Infof("节点%s赢得任期%d的选举成为leader", r.Id, r.CurrentTerm)
+	r.emit(EventBecameLeader, "")
+	r.leaderChanged()
+}
+
+// 多数派成员数量, 只统计有投票权的成员
+func (r *Raft) quorum() int {
+	voters := 0
+	for _, m := range r.Members {
+		if !m.Learner {
+			voters++
+		}
+	}
+	return voters/2 + 1
+}
+
+// 本节点是否是有投票权的成员, 调用方需持有锁
+func (r *Raft) isVoter() bool {
+	m, ok := r.Members[r.Id]
+	return ok && !m.Learner
+}
+
+// leader追加一条本任期的日志, 调用方需持有锁
+func (r *Raft) appendEntry(typ EntryType, data []byte) (*Entry, error) {
+	// 停止之后存储随时会被关闭
+	if r.isStopped() {
+		return nil, ErrStopped
+	}
+	if r.transferee != "" && typ != EntryNoop {
+		return nil, ErrLeadershipTransferring
+	}
+	e := &Entry{Index: r.log.lastIndex() + 1, Term: r.CurrentTerm, Type: typ, Data: data}
+	if err := r.log.append(e); err != nil {
+		return nil, err
+	}
+	if typ == EntryConfig {
+		r.reloadConfig()
+	}
+	r.matchIndex[r.Id] = e.Index
+	r.nextIndex[r.Id] = e.Index + 1
+	r.advanceCommitIndex()
+	r.notifyReplicate()
+	return e, nil
+}
+
+// 持久化任期和投票, 必须在回复请求或者发出拉票之前完成, 调用方需持有锁
+func (r *Raft) persistState() error {
+	if r.CurrentTerm == r.savedTerm && r.VotedFor == r.savedVotedFor {
+		return nil
+	}
+	if err := r.Storage.SaveState(r.CurrentTerm, r.VotedFor); err != nil {
+		r.Logger.Errorf("保存任期%d和投票%s错误:%s", r.CurrentTerm, r.VotedFor, err.Error())
+		return err
+	}
+	r.savedTerm = r.CurrentTerm
+	r.savedVotedFor = r.VotedFor
+	return nil
+}
+
+// 从持久化存储恢复任期、投票和日志
+func (r *Raft) restore() error {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	term, votedFor, err := r.Storage.LoadState()
+	if err != nil {
+		return err
+	}
+	r.CurrentTerm = term
+	r.VotedFor = votedFor
+	r.savedTerm = term
+	r.savedVotedFor = votedFor
+	snapIndex, snapTerm, err := r.restoreSnapshot()
+	if err != nil {
+		return err
+	}
+	if err := r.log.load(snapIndex, snapTerm); err != nil {
+		return err
+	}
+	r.reloadConfig()
+	r.Logger.Infof("恢复任期%d投票%q,最后一条日志索引%d", term, votedFor, r.log.lastIndex())
+	return nil
+}
+
+// 通知后台立即向成员复制日志
+func (r *Raft) notifyReplicate() {
+	select {
+	case r.replicateCh <- struct{}{}:
+	default:
+	}
+}
+
+// leader根据各成员的复制进度推进提交索引, 只能直接提交本任期的日志, 调用方需持有锁
+func (r *Raft) advanceCommitIndex() {
+	for index := r.log.lastIndex(); index > r.CommitIndex; index-- {
+		if r.log.termAt(index) != r.CurrentTerm {
+			break
+		}
+		count := 0
+		for id, m := range r.Members {
+			if !m.Learner && r.matchIndex[id] >= index {
+				count++
+			}
+		}
+		if count >= r.quorum() {
+			r.CommitIndex = index
+			r.notifyApply()
+			r.Logger.Debugf("提交索引推进到%d", index)
+			r.checkRemoved()
+			break
+		}
+	}
+}
+
+// Propose 在leader上提交一条命令, 返回命令的日志索引和任期
+// 命令被多数成员复制后提交, 非leader节点返回ErrNotLeader
+func (r *Raft) Propose(cmd []byte) (int64, int64, error) {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	if r.Role != RoleLeader {
+		return 0, 0, ErrNotLeader
+	}
+	e, err := r.appendEntry(EntryCommand, cmd)
+	if err != nil {
+		return 0, 0, err
+	}
+	return e.Index, e.Term, nil
 }
 
 func NewRaft(o *Options) *Raft {
+	// 在副本上填充默认值, 不修改调用方的Options、成员和传输
+	opts := *o
+	o = &opts
+	members := make(map[string]*Member, len(o.Members))
+	for id, m := range o.Members {
+		member := *m
+		members[id] = &member
+	}
+	o.Members = members
 	if o.Timeout == 0 {
 		o.Timeout = 5
 	}
+	if o.Metrics == nil {
+		o.Metrics = NewPrometheusMetrics()
+	}
 	if o.HealthChecker == nil {
 		o.HealthChecker = &health.Default{}
 	}
-	if o.Logger == nil {
-		o.Logger = &logger.Log{}
+	if o.HealthCheckerV2 == nil {
+		o.HealthCheckerV2 = health.Adapt(o.HealthChecker)
+	}
+	if o.HealthCheckInterval <= 0 {
+		o.HealthCheckInterval = 1
+	}
+	if o.HealthCheckTimeout <= 0 {
+		o.HealthCheckTimeout = o.HealthCheckInterval
+	}
+	if o.HealthCheckRise <= 0 {
+		o.HealthCheckRise = 2
+	}
+	if o.HealthCheckFall <= 0 {
+		o.HealthCheckFall = 3
+	}
+	if o.HealthCheckHistory <= 0 {
+		o.HealthCheckHistory = 10
+	}
+	level, levelErr := logger.LevelDebug, error(nil)
+	if o.LogLevel != "" {
+		level, levelErr = logger.ParseLevel(o.LogLevel)
+	}
+	// 子系统日志基于没有过滤级别的日志, 临时修改的级别可以低于配置的级别
+	base := o.Logger
+	if base == nil && o.LogFormat != "" {
+		base = logger.NewStructured(os.Stdout, logger.LevelDebug, o.LogFormat == "json")
+	}
+	if base == nil {
+		base = &logger.Log{}
+	}
+	o.Logger = base
+	if o.LogLevel != "" {
+		o.Logger = logger.WithLevel(base, level)
+	}
+	if o.LogLevelDuration <= 0 {
+		o.LogLevelDuration = 600
+	}
+	if levelErr != nil {
+		o.Logger.Warnf("日志级别配置错误,输出全部日志:%s", levelErr.Error())
+	}
+	if o.StateMachine == nil {
+		o.StateMachine = &NopStateMachine{}
+	}
+	if o.LeaderLease > 0 {
+		o.CheckQuorum = true
+		if o.LeaderLease >= o.Timeout {
+			o.LeaderLease = o.Timeout - 1
+		}
+	}
+	if o.RoutePrefix != "" {
+		o.RoutePrefix = "/" + strings.Trim(o.RoutePrefix, "/")
+	}
+	tlsFiles := newTLSFiles(o)
+	signer := newSigner(o)
+	if o.Transport == nil {
+		o.Transport = &HttpTransport{RoutePrefix: o.RoutePrefix}
+	}
+	switch t := o.Transport.(type) {
+	case *HttpTransport:
+		o.Transport = &HttpTransport{RoutePrefix: t.RoutePrefix, tls: tlsFiles, signer: signer}
+	case *StreamTransport:
+		prefix := t.RoutePrefix
+		if prefix == "" {
+			prefix = o.RoutePrefix
+		}
+		o.Transport = &StreamTransport{RoutePrefix: prefix, tls: tlsFiles, signer: signer}
+	}
+	if o.SnapshotEntries == 0 {
+		o.SnapshotEntries = 10000
+	}
+	if o.SnapshotBytes == 0 {
+		o.SnapshotBytes = 16 * 1024 * 1024
+	}
+	if o.Storage == nil {
+		if o.DataDir != "" {
+			o.Storage = NewFileStorage(o.DataDir)
+		} else {
+			o.Storage = NewMemoryStorage()
+		}
 	}
 
-	return &Raft{
-		Options: *o,
-		Role: "candidate",
+	r := &Raft{
+		Options:     *o,
+		Role:        RoleCandidate,
+		Health:      HealthStatus{Healthy: true},
+		log:         newRaftLog(o.Storage),
+		replicateCh: make(chan struct{}, 1),
+		applyCh:     make(chan struct{}, 1),
+		proposals:   map[int64]*proposal{},
+
+		sendingSnapshot: map[string]bool{},
+		streamConns:     map[net.Conn]bool{},
+		baseMembers:     configMembers(o.Members),
+		observers:       newObservers(),
+		done:            make(chan struct{}),
+		stopped:         make(chan struct{}),
+		tls:             tlsFiles,
+		logLevels:       newLogLevels(base, level),
+	}
+	r.peerHandler, r.adminHandler, r.handler = r.routes()
+	// 内存传输以及包装了内存传输的测试传输加入内存网络
+	if t, ok := o.Transport.(interface{ bind(*Raft) }); ok {
+		t.bind(r)
 	}
+	return r
 }
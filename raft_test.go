@@ -0,0 +1,489 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kylin-ops/raft/logger"
+)
+
+// 内存网络丢包和延迟的随机数种子, 为0时使用当前时间
+// 测试失败时日志中有使用的种子, 用go test -args -seed=<种子>重现
+var testSeed = flag.Int64("seed", 0, "内存网络的随机数种子")
+
+// 记录已应用命令的状态机
+type testFSM struct {
+	mu      sync.Mutex
+	applied []string
+}
+
+func (f *testFSM) Apply(e *Entry) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.applied = append(f.applied, string(e.Data))
+	return len(f.applied)
+}
+
+func (f *testFSM) Snapshot() (io.Reader, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, err := json.Marshal(f.applied)
+	return bytes.NewReader(d), err
+}
+
+func (f *testFSM) Restore(reader io.Reader) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.applied = nil
+	return json.NewDecoder(reader).Decode(&f.applied)
+}
+
+func (f *testFSM) commands() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.applied...)
+}
+
+func testLogger() logger.Logger {
+	return logger.NewStructured(ioutil.Discard, logger.LevelError, false)
+}
+
+func testMembers(ids ...string) map[string]*Member {
+	members := map[string]*Member{}
+	for _, id := range ids {
+		members[id] = &Member{Id: id, Address: id}
+	}
+	return members
+}
+
+// 内存网络中的集群, 节点id和地址都是n1...nN
+type testCluster struct {
+	t       *testing.T
+	net     *InmemNetwork
+	nodes   []*Raft
+	fsms    []*testFSM
+	servers map[string]*httptest.Server // newHttpCluster创建的每个成员的http服务
+}
+
+func newTestCluster(t *testing.T, n int, configure func(*Options)) *testCluster {
+	seed := *testSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	t.Logf("内存网络的随机数种子%d", seed)
+	c := &testCluster{t: t, net: NewInmemNetwork(seed)}
+	var ids []string
+	for i := 1; i <= n; i++ {
+		ids = append(ids, fmt.Sprintf("n%d", i))
+	}
+	for _, id := range ids {
+		fsm := &testFSM{}
+		o := &Options{
+			Id:            id,
+			Address:       id,
+			Members:       testMembers(ids...),
+			Timeout:       1,
+			Logger:        testLogger(),
+			StateMachine:  fsm,
+			Transport:     c.net.Transport(id),
+			DisableListen: true,
+		}
+		if configure != nil {
+			configure(o)
+		}
+		r := NewRaft(o)
+		if err := r.Start(context.Background()); err != nil {
+			t.Fatalf("启动%s错误:%s", id, err.Error())
+		}
+		c.nodes = append(c.nodes, r)
+		c.fsms = append(c.fsms, fsm)
+	}
+	t.Cleanup(func() {
+		for _, r := range c.nodes {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			_ = r.Shutdown(ctx)
+			cancel()
+		}
+	})
+	return c
+}
+
+// 等待cond成立, 超时后测试失败
+func (c *testCluster) waitFor(what string, timeout time.Duration, cond func() bool) {
+	c.t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			c.t.Fatalf("%s内没有%s", timeout, what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// 任期最高的leader, 没有leader时返回nil
+func (c *testCluster) leader(nodes ...*Raft) *Raft {
+	if len(nodes) == 0 {
+		nodes = c.nodes
+	}
+	var leader *Raft
+	var term int64
+	for _, r := range nodes {
+		r.Mu.Lock()
+		if r.Role == RoleLeader && r.CurrentTerm > term {
+			leader, term = r, r.CurrentTerm
+		}
+		r.Mu.Unlock()
+	}
+	return leader
+}
+
+// 在当前leader上提交命令, leader变化时重试
+func (c *testCluster) propose(cmd string) {
+	c.t.Helper()
+	deadline := time.Now().Add(20 * time.Second)
+	for time.Now().Before(deadline) {
+		if leader := c.leader(); leader != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			_, err := leader.ProposeAndWait(ctx, []byte(cmd))
+			cancel()
+			if err == nil {
+				return
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	c.t.Fatalf("提交命令%s超时", cmd)
+}
+
+// 后台检查每个任期最多只有一个leader, 返回停止检查的函数
+func (c *testCluster) checkElectionSafety() func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		leaders := map[int64]string{}
+		ticker := time.NewTicker(5 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			for _, r := range c.nodes {
+				r.Mu.Lock()
+				role, term, id := r.Role, r.CurrentTerm, r.Id
+				r.Mu.Unlock()
+				if role != RoleLeader {
+					continue
+				}
+				if other, ok := leaders[term]; ok && other != id {
+					c.t.Errorf("任期%d有两个leader: %s和%s", term, other, id)
+				}
+				leaders[term] = id
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// 全部节点应用到同一个索引, 并且等于leader的提交索引
+func (c *testCluster) converged() bool {
+	leader := c.leader()
+	if leader == nil {
+		return false
+	}
+	leader.Mu.Lock()
+	commit := leader.CommitIndex
+	leader.Mu.Unlock()
+	for _, r := range c.nodes {
+		r.Mu.Lock()
+		applied := r.LastApplied
+		r.Mu.Unlock()
+		if applied != commit {
+			return false
+		}
+	}
+	return true
+}
+
+func TestElectionSafetyUnderPartition(t *testing.T) {
+	cases := []struct {
+		name      string
+		configure func(*Options)
+	}{
+		{"default", nil},
+		{"prevote_checkquorum", func(o *Options) {
+			o.PreVote = true
+			o.CheckQuorum = true
+		}},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestCluster(t, 5, tc.configure)
+			c.net.SetDelay(time.Millisecond, 3*time.Millisecond)
+			stop := c.checkElectionSafety()
+			defer stop()
+
+			c.waitFor("选出leader", 20*time.Second, func() bool { return c.leader() != nil })
+			c.propose("before")
+
+			// leader和一个follower在少数派
+			old := c.leader()
+			old.Mu.Lock()
+			oldTerm := old.CurrentTerm
+			old.Mu.Unlock()
+			var minority, majority []*Raft
+			minority = append(minority, old)
+			for _, r := range c.nodes {
+				if r == old {
+					continue
+				}
+				if len(minority) < 2 {
+					minority = append(minority, r)
+				} else {
+					majority = append(majority, r)
+				}
+			}
+			var minorityAddrs, majorityAddrs []string
+			for _, r := range minority {
+				minorityAddrs = append(minorityAddrs, r.Address)
+			}
+			for _, r := range majority {
+				majorityAddrs = append(majorityAddrs, r.Address)
+			}
+			c.net.Partition(minorityAddrs, majorityAddrs)
+
+			// 少数派的leader不能提交命令
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			if _, err := old.ProposeAndWait(ctx, []byte("minority")); err == nil {
+				t.Fatalf("少数派的leader %s提交了命令", old.Id)
+			}
+			cancel()
+
+			c.waitFor("在多数派中选出新的leader", 20*time.Second, func() bool {
+				l := c.leader(majority...)
+				if l == nil {
+					return false
+				}
+				l.Mu.Lock()
+				defer l.Mu.Unlock()
+				return l.CurrentTerm > oldTerm
+			})
+			// 多数派中可能同时有多个候选人, leader在提交前发生变化时向新的leader重试
+			c.waitFor("多数派的leader提交命令", 20*time.Second, func() bool {
+				l := c.leader(majority...)
+				if l == nil {
+					return false
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				_, err := l.ProposeAndWait(ctx, []byte("majority"))
+				return err == nil
+			})
+
+			c.net.Heal()
+			c.propose("after")
+			c.waitFor("全部节点应用相同的日志", 20*time.Second, c.converged)
+
+			want := c.fsms[0].commands()
+			for i, fsm := range c.fsms {
+				got := fsm.commands()
+				if fmt.Sprint(got) != fmt.Sprint(want) {
+					t.Fatalf("%s应用的命令%v和%s不一致%v", c.nodes[i].Id, got, c.nodes[0].Id, want)
+				}
+			}
+			for _, cmd := range []string{"before", "majority", "after"} {
+				if !containsString(want, cmd) {
+					t.Fatalf("已提交的命令%s没有应用:%v", cmd, want)
+				}
+			}
+			// 少数派中没有提交的日志被新leader的日志覆盖
+			if containsString(want, "minority") {
+				t.Fatalf("少数派中没有提交的命令被应用:%v", want)
+			}
+		})
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestHeartbeatTruncatesConflictingEntries(t *testing.T) {
+	r := NewRaft(&Options{Id: "n1", Address: "n1", Members: testMembers("n1", "n2", "n3"), Logger: testLogger()})
+	if err := r.restore(); err != nil {
+		t.Fatal(err)
+	}
+	entry := func(index, term int64, data string) *Entry {
+		return &Entry{Index: index, Term: term, Type: EntryCommand, Data: []byte(data)}
+	}
+	// 任期1的leader n2复制了3条日志, 只提交了第1条
+	reply, err := r.HeartbeatResponse(&HeartbeatBody{
+		Term: 1, Leader: "n2",
+		Entries:      []*Entry{entry(1, 1, "a"), entry(2, 1, "b"), entry(3, 1, "c")},
+		LeaderCommit: 1,
+	})
+	if err != nil || !reply.Success || reply.MatchIndex != 3 {
+		t.Fatalf("追加日志失败:%+v %v", reply, err)
+	}
+
+	// 前一条日志的任期不一致时拒绝, 并返回冲突任期的第一条日志
+	reply, err = r.HeartbeatResponse(&HeartbeatBody{Term: 2, Leader: "n3", PrevLogIndex: 3, PrevLogTerm: 2})
+	if err == nil || reply.Success {
+		t.Fatalf("前一条日志任期不一致时应该拒绝:%+v", reply)
+	}
+	if reply.ConflictIndex != 1 {
+		t.Fatalf("冲突索引是%d,应该是1", reply.ConflictIndex)
+	}
+
+	// 任期2的leader n3在索引2写入了不同的日志, 本节点删除索引2之后的日志
+	reply, err = r.HeartbeatResponse(&HeartbeatBody{
+		Term: 2, Leader: "n3", PrevLogIndex: 1, PrevLogTerm: 1,
+		Entries:      []*Entry{entry(2, 2, "x")},
+		LeaderCommit: 2,
+	})
+	if err != nil || !reply.Success || reply.MatchIndex != 2 {
+		t.Fatalf("覆盖冲突日志失败:%+v %v", reply, err)
+	}
+	r.Mu.Lock()
+	last, term := r.log.lastIndex(), r.log.termAt(2)
+	r.Mu.Unlock()
+	if last != 2 || term != 2 {
+		t.Fatalf("最后一条日志是%d,索引2的任期是%d", last, term)
+	}
+	entries, err := r.Storage.LoadEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || string(entries[1].Data) != "x" {
+		t.Fatalf("存储中的日志没有截断:%v", entries)
+	}
+
+	// 重复的旧请求不能删除已经追加的日志
+	reply, err = r.HeartbeatResponse(&HeartbeatBody{
+		Term: 2, Leader: "n3",
+		Entries: []*Entry{entry(1, 1, "a")},
+	})
+	if err != nil || !reply.Success {
+		t.Fatalf("重复的请求失败:%+v %v", reply, err)
+	}
+	r.Mu.Lock()
+	last = r.log.lastIndex()
+	r.Mu.Unlock()
+	if last != 2 {
+		t.Fatalf("重复的请求删除了日志,最后一条日志是%d", last)
+	}
+}
+
+func TestRestartRestoresTermAndVote(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *Raft {
+		r := NewRaft(&Options{Id: "n1", Address: "n1", Members: testMembers("n1", "n2", "n3"), Logger: testLogger(), DataDir: dir})
+		if err := r.restore(); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	r := open()
+	reply, err := r.ElectionResponse(&Leader{Term: 5, LeaderId: "n2"})
+	if err != nil || !reply.VoteGranted {
+		t.Fatalf("投票失败:%+v %v", reply, err)
+	}
+	if _, err := r.HeartbeatResponse(&HeartbeatBody{
+		Term: 5, Leader: "n2",
+		Entries: []*Entry{{Index: 1, Term: 5, Type: EntryNoop}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r = open()
+	defer r.Storage.Close()
+	r.Mu.Lock()
+	term, votedFor, last := r.CurrentTerm, r.VotedFor, r.log.lastIndex()
+	r.Mu.Unlock()
+	if term != 5 || votedFor != "n2" || last != 1 {
+		t.Fatalf("重启后任期%d投票%q最后一条日志%d,应该是5、n2和1", term, votedFor, last)
+	}
+	// 同一个任期不能再投给其他候选人
+	reply, err = r.ElectionResponse(&Leader{Term: 5, LeaderId: "n3", LastLogIndex: 1, LastLogTerm: 5})
+	if err == nil || reply.VoteGranted {
+		t.Fatalf("重启后在同一个任期再次投票:%+v", reply)
+	}
+	reply, err = r.ElectionResponse(&Leader{Term: 5, LeaderId: "n2", LastLogIndex: 1, LastLogTerm: 5})
+	if err != nil || !reply.VoteGranted {
+		t.Fatalf("同一个候选人重发的投票请求失败:%+v %v", reply, err)
+	}
+}
+
+func TestNewRaftCopiesOptions(t *testing.T) {
+	members := testMembers("n1", "n2", "n3")
+	transport := &HttpTransport{}
+	o := &Options{
+		Id: "n1", Address: "n1", Members: members, Logger: testLogger(), Transport: transport,
+		ClusterSecret: "secret", RoutePrefix: "raft/", LeaderLease: 10,
+	}
+	before := *o
+	r := NewRaft(o)
+	if !reflect.DeepEqual(*o, before) {
+		t.Fatalf("NewRaft修改了调用方的Options:\n%+v\n%+v", *o, before)
+	}
+	if transport.signer != nil || transport.tls != nil {
+		t.Fatal("NewRaft修改了调用方的传输")
+	}
+	if tr, ok := r.Transport.(*HttpTransport); !ok || tr == transport || tr.signer == nil {
+		t.Fatalf("节点使用的传输是%#v", r.Transport)
+	}
+	r.Mu.Lock()
+	r.Members["n2"].HeartbeatStatus = "online"
+	timeout, prefix, lease, quorum := r.Timeout, r.RoutePrefix, r.LeaderLease, r.CheckQuorum
+	r.Mu.Unlock()
+	if members["n2"].HeartbeatStatus != "" {
+		t.Fatal("节点的成员状态写到了调用方的成员中")
+	}
+	if timeout != 5 || prefix != "/raft" || lease != 4 || !quorum {
+		t.Fatalf("默认值Timeout %d RoutePrefix %s LeaderLease %d CheckQuorum %v", timeout, prefix, lease, quorum)
+	}
+}
+
+func TestNewRaftDefaultLogger(t *testing.T) {
+	cases := []struct {
+		format string
+		level  string
+		logger string
+	}{
+		{"", "", "*logger.Log"},
+		{"text", "", "*logger.Structured"},
+		{"json", "", "*logger.Structured"},
+		{"", "warn", "*logger.levelLogger"},
+	}
+	for _, tc := range cases {
+		r := NewRaft(&Options{Id: "n1", Address: "n1", Members: testMembers("n1"), LogFormat: tc.format, LogLevel: tc.level})
+		if got := fmt.Sprintf("%T", r.Logger); got != tc.logger {
+			t.Fatalf("LogFormat %q LogLevel %q的默认日志是%s,应该是%s", tc.format, tc.level, got, tc.logger)
+		}
+	}
+}
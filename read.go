@@ -0,0 +1,114 @@
+// 线性一致读
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrNoLeader = errors.New("当前没有leader")
+
+// ReadIndex响应
+type ReadIndexReply struct {
+	Index int64 `json:"index"`
+}
+
+// LinearizableRead 等待本节点的状态机应用到最新的提交索引, 返回后从状态机读取的数据是线性一致的
+// 不需要写日志, 在follower上调用时向leader获取读索引
+func (r *Raft) LinearizableRead(ctx context.Context) error {
+	index, err := r.ReadIndex(ctx)
+	if err != nil {
+		return err
+	}
+	return r.waitApplied(ctx, index)
+}
+
+// ReadIndex 返回读索引, 状态机应用到读索引之后读取的数据是线性一致的
+// leader记录当前的提交索引, 再通过一轮心跳确认自己仍然是多数派认可的leader; follower转发给leader
+func (r *Raft) ReadIndex(ctx context.Context) (int64, error) {
+	r.Mu.Lock()
+	if r.Role == RoleLeader {
+		r.Mu.Unlock()
+		return r.readIndex(ctx)
+	}
+	leader, ok := r.Members[r.CurrentLeader]
+	if !ok || r.CurrentLeader == r.Id {
+		r.Mu.Unlock()
+		return 0, ErrNoLeader
+	}
+	target := *leader
+	r.Mu.Unlock()
+	return r.requestReadIndex(ctx, &target)
+}
+
+// leader上获取读索引
+func (r *Raft) readIndex(ctx context.Context) (int64, error) {
+	var term, index int64
+	// 本任期的日志提交之后提交索引才是最新的
+	if err := r.waitLeader(ctx, func() bool {
+		term = r.CurrentTerm
+		index = r.CommitIndex
+		return r.log.termAt(index) == term
+	}); err != nil {
+		return 0, err
+	}
+	// 之后发出的心跳得到多数派响应, 说明记录提交索引时本节点仍然是leader
+	start := time.Now()
+	r.notifyReplicate()
+	if err := r.waitLeader(ctx, func() bool {
+		return r.CurrentTerm == term && !r.quorumAckTime().Before(start)
+	}); err != nil {
+		return 0, err
+	}
+	return index, nil
+}
+
+// 等待条件成立, 本节点不再是leader时返回ErrNotLeader
+func (r *Raft) waitLeader(ctx context.Context, done func() bool) error {
+	for {
+		r.Mu.Lock()
+		if r.Role != RoleLeader {
+			r.Mu.Unlock()
+			return ErrNotLeader
+		}
+		ok := done()
+		r.Mu.Unlock()
+		if ok {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// 等待本节点的状态机应用到index
+func (r *Raft) waitApplied(ctx context.Context, index int64) error {
+	for {
+		r.Mu.Lock()
+		applied := r.LastApplied
+		r.Mu.Unlock()
+		if applied >= index {
+			return nil
+		}
+		r.notifyApply()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// 向leader请求读索引
+func (r *Raft) requestReadIndex(ctx context.Context, leader *Member) (int64, error) {
+	reply, err := r.Transport.ReadIndex(ctx, leader)
+	if err != nil {
+		return 0, fmt.Errorf("向leader请求读索引错误:%s", err.Error())
+	}
+	return reply.Index, nil
+}
@@ -0,0 +1,58 @@
+package raft
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLinearizableRead(t *testing.T) {
+	c := newTestCluster(t, 3, nil)
+	c.waitFor("选出leader", 20*time.Second, func() bool { return c.leader() != nil })
+	c.propose("a")
+	leader := c.leader()
+	leader.Mu.Lock()
+	commit := leader.CommitIndex
+	leader.Mu.Unlock()
+
+	// leader和follower上读到的都包含读之前提交的命令
+	for i, r := range c.nodes {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		index, err := r.ReadIndex(ctx)
+		if err == nil {
+			err = r.LinearizableRead(ctx)
+		}
+		cancel()
+		if err != nil {
+			t.Fatalf("%s读取错误:%s", r.Id, err.Error())
+		}
+		if index < commit {
+			t.Fatalf("%s的读索引%d小于读之前的提交索引%d", r.Id, index, commit)
+		}
+		if !containsString(c.fsms[i].commands(), "a") {
+			t.Fatalf("%s读取后状态机中没有已经提交的命令", r.Id)
+		}
+	}
+}
+
+func TestReadIndexFailsWithoutQuorum(t *testing.T) {
+	c := newTestCluster(t, 3, nil)
+	c.waitFor("选出leader", 20*time.Second, func() bool { return c.leader() != nil })
+	c.propose("a")
+	leader := c.leader()
+
+	// 隔离的leader得不到多数派确认, 不能返回可能过期的读索引
+	c.net.Isolate(leader.Address)
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	if _, err := leader.ReadIndex(ctx); err == nil {
+		t.Fatal("少数派的leader返回了读索引")
+	}
+}
+
+func TestReadIndexWithoutLeader(t *testing.T) {
+	r := newTestNode(t, nil)
+	if _, err := r.ReadIndex(context.Background()); err != ErrNoLeader {
+		t.Fatalf("没有leader时返回%v", err)
+	}
+}
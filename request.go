@@ -2,119 +2,428 @@
 package raft
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"sync"
 	"time"
-
-	"github.com/kylin-ops/raft/http/httpclient/grequest"
 )
 
-// 发送选举信息
-func (r *Raft) requestElection(m *Member) {
-	if !(m.Role == "" || m.Role == "error") {
-		return
+// 发送预投票请求, 返回是否得到选票
+func (r *Raft) requestPreVote(m *Member, vote *Leader) bool {
+	log := r.logWith(LogElection, "peer", m.Id, "term", vote.Term, "role", RoleCandidate)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*1)
+	defer cancel()
+	reply, err := r.Transport.RequestVote(ctx, m, vote)
+	if err != nil {
+		log.Warnf("向%s请求预投票错误，错误信息:%s", m.Id, err.Error())
+		return false
 	}
-	if r.Role != "candidate" {
-		r.Logger.Debugf("节点%s的状态不是candidate,不能发送选票", r.Id)
-		return
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	if reply.Term > r.CurrentTerm {
+		log.Infof("%s的任期%d大于当前任期%d,放弃选举", m.Id, reply.Term, r.CurrentTerm)
+		r.becomeFollower(reply.Term, "")
+		return false
 	}
+	return reply.VoteGranted && r.Role == RoleCandidate
+}
 
-	addr := "http://" + m.Address + "/api/v1/election"
-	resp, err := grequest.Post(addr, &grequest.RequestOptions{
-		Data:    Leader{LeaderId: r.Id},
-		Json:    true,
-		Timeout: time.Second * 1,
-	})
+// 发送选举信息
+func (r *Raft) requestElection(m *Member, vote *Leader) {
+	log := r.logWith(LogElection, "peer", m.Id, "term", vote.Term, "role", RoleCandidate)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*1)
+	defer cancel()
+	reply, err := r.Transport.RequestVote(ctx, m, vote)
 	r.Mu.Lock()
 	defer r.Mu.Unlock()
+	member, ok := r.Members[m.Id]
+	if !ok {
+		return
+	}
+	if errors.Is(err, ErrPeerUnauthorized) {
+		member.ElectionStatus = "unauthorized"
+		log.Errorf("向%s请求选票被拒绝，检查集群密钥和证书配置:%s", m.Id, err.Error())
+		return
+	}
 	if err != nil {
-		r.Members[m.Id].ElectionStatus = "error"
-		r.Logger.Warnf("向%s请求选票错误，错误信息:%s", m.Id, err.Error())
+		member.ElectionStatus = "error"
+		log.Warnf("向%s请求选票错误，错误信息:%s", m.Id, err.Error())
 		return
 	}
-	if resp.StatusCode() == 201 {
-		r.Members[m.Id].ElectionStatus = "failed"
-		msg, _ := resp.Text()
-		r.Logger.Warnf("向%s请求选票失败:%s", m.Id, msg)
+	if reply.Term > r.CurrentTerm {
+		log.Infof("%s的任期%d大于当前任期%d,放弃选举", m.Id, reply.Term, r.CurrentTerm)
+		r.becomeFollower(reply.Term, "")
 		return
 	}
-	if resp.StatusCode() != 200 {
-		msg, _ := resp.Text()
-		r.Members[m.Id].ElectionStatus = "error"
-		r.Logger.Warnf("向%s请求选选票错误，错误信息:%s", m.Id, msg)
+	// 已经不是这一轮选举的候选人, 选票作废
+	if r.Role != RoleCandidate || r.CurrentTerm != vote.Term {
+		return
 	}
-
+	if !reply.VoteGranted {
+		member.ElectionStatus = "failed"
+		log.Warnf("向%s请求任期%d的选票失败", m.Id, vote.Term)
+		return
+	}
+	member.ElectionStatus = "ok"
 	r.VotedCount++
-	if r.VotedCount > len(r.Members)/2 {
-		r.Role = "leader"
+	log.Debugf("向%s请求选票成功,当前选票数%d", m.Id, r.VotedCount)
+	if r.VotedCount >= r.quorum() {
+		r.becomeLeader()
 	}
-	r.Members[m.Id].ElectionStatus = "ok"
-	r.LastHeartbeatTime = time.Now().Unix()
-	
-	r.Logger.Debugf("向%s请求选票成功,当前选票数%d", m.Id, r.VotedCount)
 }
 
 // 发送心跳信息
-func (r *Raft) requestHeartbeat(m *Member, heart *HeartbeatBody){
-	if r.Role != "leader" {
-		r.Logger.Debugf("%s不是leader不能发送心跳信息", r.Id)
+func (r *Raft) requestHeartbeat(m *Member, heart *HeartbeatBody) {
+	r.Mu.Lock()
+	leader := r.Role == RoleLeader
+	r.Mu.Unlock()
+	if !leader {
+		r.logWith(LogHeartbeat, "peer", m.Id, "term", heart.Term).Debugf("%s不是leader不能发送心跳信息", r.Id)
 		return
 	}
-	addr := "http://" + m.Address + "/api/v1/heartbeat"
-	resp, err := grequest.Post(addr, &grequest.RequestOptions{
-		Data:    heart,
-		Json:    true,
-		Timeout: time.Second * 1,
-	})
+	sent := time.Now()
+	log := r.logWith(LogHeartbeat, "peer", m.Id, "term", heart.Term, "role", RoleLeader)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*1)
+	defer cancel()
+	reply, err := r.Transport.AppendEntries(ctx, m, heart)
+	r.Metrics.ObserveHistogram(MetricHeartbeatDuration, Labels{"peer": m.Id}, time.Since(sent).Seconds())
+	if errors.Is(err, ErrPeerUnauthorized) {
+		log.Errorf("向%s发送心跳被拒绝，检查集群密钥和证书配置:%s", m.Id, err.Error())
+	} else if err != nil {
+		log.Warnf("向%s发送心跳错误，错误信息:%s", m.Id, err.Error())
+	}
 	if err != nil {
-		r.Logger.Warnf("向%s发送心跳错误，错误信息:%s", m.Id, err.Error())
-		
+		r.Metrics.IncCounter(MetricHeartbeatFailures, Labels{"peer": m.Id})
+		r.memberDown(m.Id)
+		return
+	}
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	if reply.Term > r.CurrentTerm {
+		log.Infof("%s的任期%d大于当前任期%d", m.Id, reply.Term, r.CurrentTerm)
+		r.becomeFollower(reply.Term, "")
 		return
 	}
-	if resp.StatusCode() != 200 {
-		msg, _ := resp.Text()
-		r.Logger.Warnf("向%s发送心跳失败:%s", m.Id, msg)
+	member, ok := r.Members[m.Id]
+	if !ok || r.Role != RoleLeader || r.CurrentTerm != heart.Term {
 		return
 	}
+	// 任期一致说明成员认可本节点是leader, 日志不一致也算作响应
+	if reply.Term == heart.Term && sent.After(r.ackTime[m.Id]) {
+		r.ackTime[m.Id] = sent
+	}
+	member.Unhealthy = reply.Unhealthy
+	if !reply.Success {
+		if next, ok := r.nextIndex[m.Id]; reply.ConflictIndex > 0 && (!ok || reply.ConflictIndex < next) {
+			r.nextIndex[m.Id] = reply.ConflictIndex
+			r.notifyReplicate()
+		}
+		log.Warnf("向%s发送心跳失败", m.Id)
+		return
+	}
+	if reply.MatchIndex > r.matchIndex[m.Id] {
+		r.matchIndex[m.Id] = reply.MatchIndex
+		r.advanceCommitIndex()
+	}
+	r.nextIndex[m.Id] = r.matchIndex[m.Id] + 1
+	if r.nextIndex[m.Id] <= r.log.lastIndex() {
+		r.notifyReplicate()
+	}
+	member.HeartbeatStatus = "online"
+	member.LastHeartbeatTime = time.Now().Unix()
+	member.LeaderId = r.CurrentLeader
+	role := RoleFollower
+	if member.Learner {
+		role = RoleLearner
+	}
+	member.Role = role
+	log.Debugf("向%s发送心跳成功", m.Id)
+}
+
+// 发起新一轮选举, 开启PreVote时先确认能赢得选举
+func (r *Raft) sendElectionToALLMembers() {
+	if r.PreVote && !r.sendPreVoteToAllMembers() {
+		return
+	}
+	r.campaign(false)
+}
+
+// 预投票: 用下一个任期向其他成员询问能否赢得选举, 不增加本节点的任期
+// 得到多数派的预投票后才真正发起选举
+func (r *Raft) sendPreVoteToAllMembers() bool {
 	r.Mu.Lock()
-	defer r.Mu.Unlock()
-	r.Members[m.Id].HeartbeatStatus = "online"
-	r.Members[m.Id].LastHeartbeatTime = time.Now().Unix()
-	r.Members[m.Id].LeaderId = r.CurrentLeader
-	role := "follower"
-	if m.Id == r.Id {
-		role = "leader"
-	}
-	r.Members[m.Id].Role = role
-	r.Logger.Debugf("向%s发送心跳成功", m.Id)
+	if r.Role != RoleCandidate || !r.isVoter() {
+		r.Mu.Unlock()
+		return false
+	}
+	vote := &Leader{
+		Term:         r.CurrentTerm + 1,
+		LeaderId:     r.Id,
+		LastLogIndex: r.log.lastIndex(),
+		LastLogTerm:  r.log.lastTerm(),
+		PreVote:      true,
+	}
+	quorum := r.quorum()
+	r.Mu.Unlock()
+	log := r.logWith(LogElection, "term", vote.Term, "role", RoleCandidate)
+	log.Debugf("节点%s发起任期%d的预投票", r.Id, vote.Term)
+
+	granted := 1
+	mu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for _, member := range r.GetMembers() {
+		if member.Id == r.Id || member.Learner {
+			continue
+		}
+		wg.Add(1)
+		go func(m *Member) {
+			defer wg.Done()
+			if r.requestPreVote(m, vote) {
+				mu.Lock()
+				granted++
+				mu.Unlock()
+			}
+		}(member)
+	}
+	wg.Wait()
+	if granted < quorum {
+		log.Debugf("节点%s任期%d的预投票只得到%d票,不发起选举", r.Id, vote.Term, granted)
+		return false
+	}
+	return true
 }
 
-// 向所有成员发生选举信息
-func(r *Raft) sendElectionToALLMembers(){
+// 发起选举: 任期加一, 先投自己一票, 再向其他成员拉票
+// transfer表示是leader转移发起的选举, 其他成员不因为leader租约拒绝投票
+func (r *Raft) campaign(transfer bool) {
+	r.Mu.Lock()
+	if r.Role != RoleCandidate {
+		r.Mu.Unlock()
+		return
+	}
+	// 还没有加入集群、已经被删除或者是learner的节点不能发起选举
+	if !r.isVoter() {
+		r.Mu.Unlock()
+		return
+	}
+	r.CurrentTerm++
+	r.VotedFor = r.Id
+	r.VotedCount = 1
+	r.CurrentLeader = ""
+	if err := r.persistState(); err != nil {
+		r.Mu.Unlock()
+		return
+	}
+	vote := &Leader{
+		Term:         r.CurrentTerm,
+		LeaderId:     r.Id,
+		LastLogIndex: r.log.lastIndex(),
+		LastLogTerm:  r.log.lastTerm(),
+		Transfer:     transfer,
+	}
+	log := r.logWith(LogElection, "term", vote.Term, "role", RoleCandidate)
+	if r.VotedCount >= r.quorum() {
+		r.becomeLeader()
+	}
+	r.Mu.Unlock()
+	log.Debugf("节点%s发起任期%d的选举", r.Id, vote.Term)
+	r.Metrics.IncCounter(MetricElectionsStarted, nil)
+
 	members := r.GetMembers()
 	wg := sync.WaitGroup{}
 	for _, member := range members {
-		if !(member.Role == "" || member.Role == "error") {
+		if member.Id == r.Id || member.Learner {
 			continue
 		}
 		wg.Add(1)
-		go func (m *Member)  {
+		go func(m *Member) {
 			defer wg.Done()
-			r.requestElection(m)
+			r.requestElection(m, vote)
 		}(member)
 	}
 	wg.Wait()
+
+	r.Mu.Lock()
+	won := r.Role == RoleLeader && r.CurrentTerm == vote.Term
+	r.Mu.Unlock()
+	if won {
+		r.Metrics.IncCounter(MetricElectionsWon, nil)
+	} else {
+		r.Metrics.IncCounter(MetricElectionsLost, nil)
+	}
+}
+
+// 向成员分块发送最新的快照, 成员需要的日志已经被压缩时调用
+func (r *Raft) requestInstallSnapshot(m *Member) {
+	defer func() {
+		r.Mu.Lock()
+		delete(r.sendingSnapshot, m.Id)
+		r.Mu.Unlock()
+	}()
+	meta, data, err := r.Storage.LoadSnapshot()
+	if err != nil || meta == nil {
+		r.logWith(LogHeartbeat, "peer", m.Id).Errorf("读取快照错误,无法向%s发送快照:%v", m.Id, err)
+		return
+	}
+	defer data.Close()
+	r.Mu.Lock()
+	term := r.CurrentTerm
+	r.Mu.Unlock()
+	log := r.logWith(LogHeartbeat, "peer", m.Id, "term", term, "role", RoleLeader)
+	log.Infof("向%s发送快照,快照索引%d任期%d", m.Id, meta.Index, meta.Term)
+
+	buf := make([]byte, snapshotChunkSize)
+	var offset int64
+	for {
+		n, err := io.ReadFull(data, buf)
+		done := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !done {
+			log.Errorf("读取快照错误:%s", err.Error())
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		reply, err := r.Transport.InstallSnapshot(ctx, m, &InstallSnapshotBody{Term: term, Leader: r.Id, Meta: meta, Offset: offset, Data: buf[:n], Done: done})
+		cancel()
+		if errors.Is(err, ErrPeerUnauthorized) {
+			log.Errorf("向%s发送快照被拒绝，检查集群密钥和证书配置:%s", m.Id, err.Error())
+			r.memberDown(m.Id)
+			return
+		}
+		if err != nil {
+			log.Warnf("向%s发送快照错误，错误信息:%s", m.Id, err.Error())
+			return
+		}
+		r.Mu.Lock()
+		if reply.Term > r.CurrentTerm {
+			r.becomeFollower(reply.Term, "")
+		}
+		if r.Role != RoleLeader || r.CurrentTerm != term {
+			r.Mu.Unlock()
+			return
+		}
+		r.Mu.Unlock()
+		if !reply.Success {
+			log.Warnf("%s拒绝接收快照", m.Id)
+			return
+		}
+		offset += int64(n)
+		if done {
+			break
+		}
+	}
+
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	if meta.Index > r.matchIndex[m.Id] {
+		r.matchIndex[m.Id] = meta.Index
+	}
+	r.nextIndex[m.Id] = r.matchIndex[m.Id] + 1
+	r.notifyReplicate()
+	log.Infof("向%s发送快照完成", m.Id)
+}
+
+// 通知目标成员立即发起选举
+func (r *Raft) requestTimeoutNow(m *Member, term int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*1)
+	defer cancel()
+	reply, err := r.Transport.TimeoutNow(ctx, m, &TimeoutNowBody{Term: term, Leader: r.Id})
+	if err != nil {
+		return fmt.Errorf("向%s发送TimeoutNow错误:%s", m.Id, err.Error())
+	}
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	if reply.Term > r.CurrentTerm {
+		r.becomeFollower(reply.Term, "")
+	}
+	if !reply.Success {
+		return fmt.Errorf("%s拒绝了TimeoutNow请求", m.Id)
+	}
+	return nil
+}
+
+// 按成员的复制进度生成心跳, 携带该成员缺少的日志, 调用方需持有锁
+func (r *Raft) heartbeatFor(id string, members map[string]*Member) *HeartbeatBody {
+	next, ok := r.nextIndex[id]
+	if !ok || id == r.Id {
+		next = r.log.lastIndex() + 1
+	}
+	if next < r.log.firstIndex() && !r.sendingSnapshot[id] {
+		// 成员需要的日志已经被压缩, 改为发送快照, 心跳照常发送以维持leader地位
+		m := members[id]
+		r.sendingSnapshot[id] = r.goTracked(func() { r.requestInstallSnapshot(m) })
+	}
+	return &HeartbeatBody{
+		Term:         r.CurrentTerm,
+		Leader:       r.Id,
+		Members:      members,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  r.log.termAt(next - 1),
+		Entries:      r.log.slice(next, maxAppendEntries),
+		LeaderCommit: r.CommitIndex,
+		CheckQuorum:  r.CheckQuorum,
+	}
+}
+
+// leader不给自己发心跳, 发送心跳前直接更新本节点的成员状态, 调用方需持有锁
+func (r *Raft) refreshSelf() {
+	now := time.Now().Unix()
+	r.LastHeartbeatTime = now
+	if m, ok := r.Members[r.Id]; ok {
+		m.Role = RoleLeader
+		m.LeaderId = r.Id
+		m.HeartbeatStatus = "online"
+		m.LastHeartbeatTime = now
+		m.Unhealthy = !r.Health.Healthy
+	}
+}
+
+// 成员心跳从在线变为离线时发出通知
+func (r *Raft) memberDown(id string) {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	member, ok := r.Members[id]
+	if !ok || r.Role != RoleLeader || member.HeartbeatStatus != "online" {
+		return
+	}
+	member.HeartbeatStatus = "offline"
+	r.logWith(LogHeartbeat, "peer", id, "term", r.CurrentTerm, "role", r.Role).Warnf("成员%s心跳离线", id)
+	r.emit(EventMemberDown, id)
 }
 
 // 向所有成员发生心跳信息
-func (r *Raft) sendHeartbeatToAllMembers(){
+func (r *Raft) sendHeartbeatToAllMembers() {
+	r.Mu.Lock()
+	if r.Role != RoleLeader {
+		r.Mu.Unlock()
+		return
+	}
+	r.refreshSelf()
+	r.Mu.Unlock()
 	members := r.GetMembers()
+	r.Mu.Lock()
+	if r.Role != RoleLeader {
+		r.Mu.Unlock()
+		return
+	}
+	hearts := map[string]*HeartbeatBody{}
+	for id := range members {
+		if id != r.Id {
+			hearts[id] = r.heartbeatFor(id, members)
+		}
+	}
+	r.Mu.Unlock()
 	wg := sync.WaitGroup{}
 	for _, member := range members {
+		if member.Id == r.Id {
+			continue
+		}
 		wg.Add(1)
-		go func (m *Member)  {
+		go func(m *Member) {
 			defer wg.Done()
-			r.requestHeartbeat(m, &HeartbeatBody{Leader: r.Id, Members: members})
+			r.requestHeartbeat(m, hearts[m.Id])
 		}(member)
 	}
 	wg.Wait()
-}
\ No newline at end of file
+}
@@ -0,0 +1,109 @@
+package raft
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCommitRequiresMajority(t *testing.T) {
+	c := newTestCluster(t, 3, nil)
+	c.waitFor("选出leader", 20*time.Second, func() bool { return c.leader() != nil })
+	c.propose("a")
+	c.waitFor("全部节点应用相同的日志", 20*time.Second, c.converged)
+
+	// leader和两个follower都断开, 新日志只在leader上, 不能提交
+	leader := c.leader()
+	for _, r := range c.nodes {
+		if r != leader {
+			c.net.Isolate(r.Address)
+		}
+	}
+	leader.Mu.Lock()
+	commit := leader.CommitIndex
+	leader.Mu.Unlock()
+	index, _, err := leader.Propose([]byte("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Second)
+	leader.Mu.Lock()
+	stuck := leader.CommitIndex
+	leader.Mu.Unlock()
+	if stuck != commit {
+		t.Fatalf("没有多数成员时提交索引从%d变成了%d", commit, stuck)
+	}
+
+	// 恢复后多数成员有了这条日志, 提交并应用到全部节点
+	c.net.Heal()
+	c.waitFor("提交隔离期间的日志", 20*time.Second, func() bool {
+		l := c.leader()
+		if l == nil {
+			return false
+		}
+		l.Mu.Lock()
+		defer l.Mu.Unlock()
+		return l.CommitIndex >= index
+	})
+	c.propose("c")
+	c.waitFor("全部节点应用相同的日志", 20*time.Second, c.converged)
+	for i, fsm := range c.fsms {
+		if cmds := fsm.commands(); !containsString(cmds, "a") || !containsString(cmds, "c") {
+			t.Fatalf("n%d应用的命令是%v", i+1, cmds)
+		}
+	}
+}
+
+func TestFollowerRejectsPropose(t *testing.T) {
+	c := newTestCluster(t, 3, nil)
+	c.waitFor("选出leader", 20*time.Second, func() bool { return c.leader() != nil })
+	leader := c.leader()
+	for _, r := range c.nodes {
+		if r == leader {
+			continue
+		}
+		if _, _, err := r.Propose([]byte("x")); err != ErrNotLeader {
+			t.Fatalf("follower %s提交命令返回%v", r.Id, err)
+		}
+		if _, err := r.ProposeAndWait(context.Background(), []byte("x")); err != ErrNotLeader {
+			t.Fatalf("follower %s提交命令返回%v", r.Id, err)
+		}
+	}
+}
+
+func TestPreVoteStopsDisruptiveElections(t *testing.T) {
+	c := newTestCluster(t, 3, func(o *Options) { o.PreVote = true })
+	c.waitFor("选出leader", 20*time.Second, func() bool { return c.leader() != nil })
+	c.propose("a")
+	leader := c.leader()
+	leader.Mu.Lock()
+	term := leader.CurrentTerm
+	leader.Mu.Unlock()
+	var follower *Raft
+	for _, r := range c.nodes {
+		if r != leader {
+			follower = r
+		}
+	}
+
+	// 被隔离的follower预投票得不到多数派, 不会增加任期
+	c.net.Isolate(follower.Address)
+	time.Sleep(4 * time.Second)
+	follower.Mu.Lock()
+	isolatedTerm := follower.CurrentTerm
+	follower.Mu.Unlock()
+	if isolatedTerm != term {
+		t.Fatalf("隔离期间follower的任期从%d变成了%d", term, isolatedTerm)
+	}
+
+	// 恢复后不会打断正常的leader
+	c.net.Heal()
+	c.propose("b")
+	c.waitFor("全部节点应用相同的日志", 20*time.Second, c.converged)
+	leader.Mu.Lock()
+	role, leaderTerm := leader.Role, leader.CurrentTerm
+	leader.Mu.Unlock()
+	if role != RoleLeader || leaderTerm != term {
+		t.Fatalf("恢复后leader的角色是%s,任期从%d变成了%d", role, term, leaderTerm)
+	}
+}
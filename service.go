@@ -2,57 +2,243 @@
 package raft
 
 import (
-	"encoding/json"
 	"fmt"
+	"os"
 	"time"
 )
 
-func (r *Raft) ElectionResponse(leader *Leader) error {
+// 响应投票请求, 每个任期最多投出一票, 更高的任期会让本节点退为follower
+func (r *Raft) ElectionResponse(leader *Leader) (*ElectionReply, error) {
 	r.Mu.Lock()
 	defer r.Mu.Unlock()
-	if r.VotedFor != "" {
-		return fmt.Errorf("响应投票请求 - %s的投票请求失败,选票已经投给%s", leader.LeaderId, r.VotedFor)
+	if r.isStopped() {
+		return &ElectionReply{Term: r.CurrentTerm}, ErrStopped
+	}
+	if leader.PreVote {
+		return r.preVoteResponse(leader)
+	}
+	// 同一个候选人重发的请求不受限制
+	retry := leader.Term == r.CurrentTerm && r.VotedFor == leader.LeaderId
+	if r.checkQuorumEnabled() && !leader.Transfer && !retry && r.leaderAlive() {
+		return &ElectionReply{Term: r.CurrentTerm}, fmt.Errorf("响应投票请求 - 拒绝%s的投票请求,leader %s仍然在线", leader.LeaderId, r.CurrentLeader)
+	}
+	reply := &ElectionReply{Term: r.CurrentTerm}
+	if leader.Term < r.CurrentTerm {
+		return reply, fmt.Errorf("响应投票请求 - %s的任期%d小于当前任期%d", leader.LeaderId, leader.Term, r.CurrentTerm)
+	}
+	if leader.Term > r.CurrentTerm {
+		r.becomeFollower(leader.Term, "")
+		reply.Term = r.CurrentTerm
+	}
+	if _, ok := r.Members[r.Id]; ok && !r.isVoter() {
+		return reply, fmt.Errorf("响应投票请求 - 本节点是learner,不参与投票")
+	}
+	if r.VotedFor != "" && r.VotedFor != leader.LeaderId {
+		return reply, fmt.Errorf("响应投票请求 - %s的投票请求失败,任期%d的选票已经投给%s", leader.LeaderId, r.CurrentTerm, r.VotedFor)
+	}
+	if !r.log.isUpToDate(leader.LastLogIndex, leader.LastLogTerm) {
+		return reply, fmt.Errorf("响应投票请求 - %s的日志(%d/%d)落后于本节点(%d/%d)", leader.LeaderId,
+			leader.LastLogIndex, leader.LastLogTerm, r.log.lastIndex(), r.log.lastTerm())
 	}
-	r.CurrentLeader = leader.LeaderId
 	r.VotedFor = leader.LeaderId
-	if r.Id != leader.LeaderId {
-		r.Role = "follower"
+	if err := r.persistState(); err != nil {
+		r.VotedFor = ""
+		return reply, fmt.Errorf("响应投票请求 - 保存投票错误:%s", err.Error())
 	}
-	return nil
+	// 投出选票后重置超时时间，避免本节点马上发起新的选举
+	r.LastHeartbeatTime = time.Now().Unix()
+	r.voteTime = time.Now()
+	reply.VoteGranted = true
+	return reply, nil
 }
 
-func (r *Raft) HeartbeatResponse(body *HeartbeatBody) error {
-	err := r.HealthChecker.Do()
-	if err != nil {
-		d, _ := json.Marshal(r.HealthChecker)
-		r.Logger.Warnf("心跳check错误,执行信息:%s 错误信息:%s", string(d), err.Error())
+// 响应预投票, 只判断能否投票, 不改变本节点的任期和选票, 调用方需持有锁
+// 本节点在选举超时时间内收到过leader的心跳时拒绝, 避免网络恢复的节点打断正常的leader
+func (r *Raft) preVoteResponse(leader *Leader) (*ElectionReply, error) {
+	reply := &ElectionReply{Term: r.CurrentTerm}
+	if leader.Term < r.CurrentTerm {
+		return reply, fmt.Errorf("响应预投票请求 - %s的任期%d小于当前任期%d", leader.LeaderId, leader.Term, r.CurrentTerm)
+	}
+	if _, ok := r.Members[r.Id]; ok && !r.isVoter() {
+		return reply, fmt.Errorf("响应预投票请求 - 本节点是learner,不参与投票")
+	}
+	if r.Role == RoleLeader || (r.CurrentLeader != "" && time.Now().Unix()-r.LastHeartbeatTime <= r.Timeout) {
+		return reply, fmt.Errorf("响应预投票请求 - 拒绝%s的预投票,leader %s仍然在线", leader.LeaderId, r.CurrentLeader)
+	}
+	if !r.log.isUpToDate(leader.LastLogIndex, leader.LastLogTerm) {
+		return reply, fmt.Errorf("响应预投票请求 - %s的日志(%d/%d)落后于本节点(%d/%d)", leader.LeaderId,
+			leader.LastLogIndex, leader.LastLogTerm, r.log.lastIndex(), r.log.lastTerm())
 	}
+	reply.VoteGranted = true
+	return reply, nil
+}
 
+func (r *Raft) HeartbeatResponse(body *HeartbeatBody) (*HeartbeatReply, error) {
 	r.Mu.Lock()
 	defer r.Mu.Unlock()
-	if r.DefaultLeader == r.Id && r.Id != body.Leader {
-		return fmt.Errorf("本节点设置默认leader与心跳leader不一致")
+	reply := &HeartbeatReply{Term: r.CurrentTerm, Unhealthy: !r.Health.Healthy}
+	if r.isStopped() {
+		return reply, ErrStopped
+	}
+	if body.Term < r.CurrentTerm {
+		return reply, fmt.Errorf("%s的心跳任期%d小于当前任期%d", body.Leader, body.Term, r.CurrentTerm)
+	}
+	if r.Id != body.Leader {
+		r.becomeFollower(body.Term, body.Leader)
+		r.leaderContact = time.Now()
+		r.quorumChecked = body.CheckQuorum
 	}
-	r.VotedFor = body.Leader
+	reply.Term = r.CurrentTerm
+	// 成员配置来自日志, 心跳只同步成员的状态信息; leader自己的成员状态是最新的, 不需要同步
+	for id, m := range body.Members {
+		if member, ok := r.Members[id]; ok && r.Id != body.Leader {
+			member.Role = m.Role
+			member.LeaderId = m.LeaderId
+			member.HeartbeatStatus = m.HeartbeatStatus
+			member.LastHeartbeatTime = m.LastHeartbeatTime
+			// 本节点的健康状态以自己的检查结果为准
+			if id != r.Id {
+				member.Unhealthy = m.Unhealthy
+			}
+		}
+	}
+	r.LastHeartbeatTime = time.Now().Unix()
+	r.logWith(LogHeartbeat).Debugf("接收到来自%s的心跳信息", body.Leader)
+	// leader发给自己的心跳不需要处理日志
 	if r.Id == body.Leader {
-		r.Role = "leader"
-	} else {
-		r.Role = "follower"
+		reply.Success = true
+		reply.MatchIndex = r.log.lastIndex()
+		return reply, nil
+	}
+	// 快照之前的日志都已经提交, 一定和leader一致
+	if compacted := r.log.firstIndex() - 1; body.PrevLogIndex < compacted {
+		for len(body.Entries) > 0 && body.Entries[0].Index <= compacted {
+			body.Entries = body.Entries[1:]
+		}
+		body.PrevLogIndex = compacted
+		body.PrevLogTerm = r.log.termAt(compacted)
+	}
+	if r.log.termAt(body.PrevLogIndex) != body.PrevLogTerm {
+		reply.ConflictIndex = r.log.conflictIndex(body.PrevLogIndex)
+		return reply, fmt.Errorf("日志不一致,本节点没有索引%d任期%d的日志", body.PrevLogIndex, body.PrevLogTerm)
+	}
+	matchIndex, truncated, appendErr := r.log.appendFromLeader(body.PrevLogIndex, body.Entries)
+	if truncated || hasConfig(body.Entries) {
+		r.reloadConfig()
+	}
+	if appendErr != nil {
+		r.logWith(LogHeartbeat).Errorf("保存%s复制的日志错误:%s", body.Leader, appendErr.Error())
+		return reply, appendErr
+	}
+	reply.MatchIndex = matchIndex
+	// 只能提交已经确认与leader一致的日志
+	commit := body.LeaderCommit
+	if commit > reply.MatchIndex {
+		commit = reply.MatchIndex
 	}
-	r.CurrentLeader = body.Leader
-	if err == nil {
-		r.Members = body.Members
-		r.LastHeartbeatTime = time.Now().Unix()
-		r.Logger.Debugf("接收到来自%s的心跳信息", body.Leader)
+	if commit > r.CommitIndex {
+		r.CommitIndex = commit
+		r.notifyApply()
 	}
-	return nil
+	reply.Success = true
+	return reply, nil
 }
 
-func (r *Raft) SetLeaderResponse(id string) error {
+// 接收leader分块发来的快照, 收到最后一块后安装到状态机
+func (r *Raft) InstallSnapshotResponse(body *InstallSnapshotBody) (*InstallSnapshotReply, error) {
+	r.Mu.Lock()
+	reply := &InstallSnapshotReply{Term: r.CurrentTerm}
+	if r.isStopped() {
+		r.Mu.Unlock()
+		return reply, ErrStopped
+	}
+	if body.Term < r.CurrentTerm {
+		r.Mu.Unlock()
+		return reply, fmt.Errorf("%s的快照任期%d小于当前任期%d", body.Leader, body.Term, r.CurrentTerm)
+	}
+	if body.Meta == nil {
+		r.Mu.Unlock()
+		return reply, fmt.Errorf("%s发来的快照缺少元数据", body.Leader)
+	}
+	r.becomeFollower(body.Term, body.Leader)
+	reply.Term = r.CurrentTerm
+	r.LastHeartbeatTime = time.Now().Unix()
+
+	// 本节点已经应用到快照的位置, 快照是旧的, 直接丢弃并返回成功, 不能用它回退状态机
+	if body.Meta.Index <= r.LastApplied {
+		if r.receiving != nil && r.receiving.meta.Index == body.Meta.Index {
+			r.receiving.file.Close()
+			os.Remove(r.receiving.file.Name())
+			r.receiving = nil
+		}
+		r.Mu.Unlock()
+		if body.Done {
+			r.Logger.Infof("快照索引%d不大于已经应用的索引,丢弃%s发来的快照", body.Meta.Index, body.Leader)
+		}
+		reply.Success = true
+		return reply, nil
+	}
+
+	if body.Offset == 0 {
+		if r.receiving != nil {
+			r.receiving.file.Close()
+			os.Remove(r.receiving.file.Name())
+		}
+		p, err := r.newPendingSnapshot(body.Meta)
+		if err != nil {
+			r.receiving = nil
+			r.Mu.Unlock()
+			return reply, err
+		}
+		r.receiving = p
+	}
+	p := r.receiving
+	if p == nil || p.offset != body.Offset || p.meta.Index != body.Meta.Index {
+		r.Mu.Unlock()
+		return reply, fmt.Errorf("快照数据块偏移%d不连续", body.Offset)
+	}
+	if _, err := p.file.Write(body.Data); err != nil {
+		r.Mu.Unlock()
+		return reply, err
+	}
+	p.offset += int64(len(body.Data))
+	if !body.Done {
+		r.Mu.Unlock()
+		reply.Success = true
+		return reply, nil
+	}
+	r.receiving = nil
+	r.Mu.Unlock()
+
+	if err := r.installSnapshot(p); err != nil {
+		r.Logger.Errorf("安装快照错误:%s", err.Error())
+		return reply, err
+	}
+	reply.Success = true
+	return reply, nil
+}
+
+// 响应leader转移, 本节点立即发起选举
+func (r *Raft) TimeoutNowResponse(body *TimeoutNowBody) (*TimeoutNowReply, error) {
 	r.Mu.Lock()
 	defer r.Mu.Unlock()
-	if _, ok := r.Members[id]; !ok {
-		return fmt.Errorf("设置leader指定的成员%s不存在", id)
+	reply := &TimeoutNowReply{Term: r.CurrentTerm}
+	if r.isStopped() {
+		return reply, ErrStopped
+	}
+	if body.Term < r.CurrentTerm {
+		return reply, fmt.Errorf("%s的TimeoutNow任期%d小于当前任期%d", body.Leader, body.Term, r.CurrentTerm)
+	}
+	if !r.isVoter() {
+		return reply, fmt.Errorf("本节点没有投票权,不能成为leader")
+	}
+	if !r.Health.Healthy {
+		return reply, fmt.Errorf("本节点健康检查错误,不能成为leader")
 	}
-	return nil
+	r.logWith(LogElection).Infof("收到%s的leader转移请求,立即发起选举", body.Leader)
+	r.Role = RoleCandidate
+	// leader转移是现任leader发起的, 不需要PreVote, 也不受leader租约限制
+	r.goTracked(func() { r.campaign(true) })
+	reply.Success = true
+	return reply, nil
 }
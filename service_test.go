@@ -0,0 +1,114 @@
+package raft
+
+import "testing"
+
+// 没有启动后台任务的节点, 直接调用请求的处理函数
+func newTestNode(t *testing.T, configure func(*Options)) *Raft {
+	t.Helper()
+	o := &Options{Id: "n1", Address: "n1", Members: testMembers("n1", "n2", "n3"), Logger: testLogger()}
+	if configure != nil {
+		configure(o)
+	}
+	r := NewRaft(o)
+	if err := r.restore(); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestElectionResponseGrantsOneVotePerTerm(t *testing.T) {
+	r := newTestNode(t, nil)
+	steps := []struct {
+		name    string
+		vote    Leader
+		granted bool
+		term    int64 // 处理后本节点的任期
+	}{
+		{"第一个候选人", Leader{Term: 1, LeaderId: "n2"}, true, 1},
+		{"同一个任期的其他候选人", Leader{Term: 1, LeaderId: "n3"}, false, 1},
+		{"同一个候选人重发", Leader{Term: 1, LeaderId: "n2"}, true, 1},
+		{"更高的任期重新投票", Leader{Term: 2, LeaderId: "n3"}, true, 2},
+		{"过期的任期", Leader{Term: 1, LeaderId: "n2"}, false, 2},
+	}
+	for _, step := range steps {
+		vote := step.vote
+		reply, err := r.ElectionResponse(&vote)
+		if reply.VoteGranted != step.granted || (err == nil) != step.granted {
+			t.Fatalf("%s: 投票结果%v错误%v", step.name, reply.VoteGranted, err)
+		}
+		if reply.Term != step.term {
+			t.Fatalf("%s: 响应的任期是%d,应该是%d", step.name, reply.Term, step.term)
+		}
+	}
+}
+
+func TestElectionResponseRejectsStaleLog(t *testing.T) {
+	r := newTestNode(t, nil)
+	if _, err := r.HeartbeatResponse(&HeartbeatBody{
+		Term: 2, Leader: "n3",
+		Entries: []*Entry{{Index: 1, Term: 1}, {Index: 2, Term: 2}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name    string
+		vote    Leader
+		granted bool
+	}{
+		{"最后一条日志的任期更小", Leader{Term: 3, LeaderId: "n2", LastLogIndex: 5, LastLogTerm: 1}, false},
+		{"任期相同但日志更短", Leader{Term: 4, LeaderId: "n2", LastLogIndex: 1, LastLogTerm: 2}, false},
+		{"日志一样新", Leader{Term: 5, LeaderId: "n2", LastLogIndex: 2, LastLogTerm: 2}, true},
+	}
+	for _, tc := range cases {
+		vote := tc.vote
+		reply, err := r.ElectionResponse(&vote)
+		if reply.VoteGranted != tc.granted {
+			t.Fatalf("%s: 投票结果%v错误%v", tc.name, reply.VoteGranted, err)
+		}
+		// 拒绝投票时也要更新到候选人的任期
+		if reply.Term != vote.Term {
+			t.Fatalf("%s: 响应的任期是%d,应该是%d", tc.name, reply.Term, vote.Term)
+		}
+	}
+}
+
+func TestPreVoteResponseKeepsTermAndVote(t *testing.T) {
+	r := newTestNode(t, nil)
+	steps := []struct {
+		name    string
+		before  func()
+		vote    Leader
+		granted bool
+	}{
+		{"没有leader", nil, Leader{Term: 3, LeaderId: "n2", PreVote: true}, true},
+		{"日志落后", func() {
+			r.HeartbeatResponse(&HeartbeatBody{Term: 1, Leader: "n3", Entries: []*Entry{{Index: 1, Term: 1}}})
+			r.Mu.Lock()
+			r.LastHeartbeatTime = 0
+			r.Mu.Unlock()
+		}, Leader{Term: 3, LeaderId: "n2", PreVote: true}, false},
+		{"leader仍然在线", func() {
+			r.HeartbeatResponse(&HeartbeatBody{Term: 1, Leader: "n3", PrevLogIndex: 1, PrevLogTerm: 1})
+		}, Leader{Term: 3, LeaderId: "n2", LastLogIndex: 1, LastLogTerm: 1, PreVote: true}, false},
+	}
+	for _, step := range steps {
+		if step.before != nil {
+			step.before()
+		}
+		r.Mu.Lock()
+		term, votedFor := r.CurrentTerm, r.VotedFor
+		r.Mu.Unlock()
+		vote := step.vote
+		reply, err := r.ElectionResponse(&vote)
+		if reply.VoteGranted != step.granted {
+			t.Fatalf("%s: 预投票结果%v错误%v", step.name, reply.VoteGranted, err)
+		}
+		// 预投票不改变任期和选票
+		r.Mu.Lock()
+		changed := r.CurrentTerm != term || r.VotedFor != votedFor
+		r.Mu.Unlock()
+		if changed {
+			t.Fatalf("%s: 预投票改变了任期或者选票", step.name)
+		}
+	}
+}
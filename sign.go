@@ -0,0 +1,196 @@
+// 集群内部请求的HMAC签名
+package raft
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 签名使用的请求头
+const (
+	headerSender    = "X-Raft-Sender"
+	headerTimestamp = "X-Raft-Timestamp"
+	headerNonce     = "X-Raft-Nonce"
+	headerSignature = "X-Raft-Signature"
+)
+
+// 签名的有效时间, 成员之间的时钟误差需要小于这个时间
+const signatureWindow = 30 * time.Second
+
+var ErrUnsigned = errors.New("请求没有签名")
+
+// 用集群密钥给发出的请求签名
+type signer struct {
+	id     string // 本节点id, 作为签名的发送方
+	secret []byte
+}
+
+func newSigner(o *Options) *signer {
+	if o.ClusterSecret == "" {
+		return nil
+	}
+	return &signer{id: o.Id, secret: []byte(o.ClusterSecret)}
+}
+
+// 返回请求path和body的签名请求头
+func (s *signer) sign(path string, body []byte) map[string]string {
+	nonce := make([]byte, 16)
+	_, _ = rand.Read(nonce)
+	header := map[string]string{
+		headerSender:    s.id,
+		headerTimestamp: strconv.FormatInt(time.Now().UnixNano(), 10),
+		headerNonce:     hex.EncodeToString(nonce),
+	}
+	header[headerSignature] = signature(s.secret, header[headerSender], header[headerTimestamp], header[headerNonce], path, body)
+	return header
+}
+
+// HMAC-SHA256(发送方, 时间戳, 随机数, 路径, 请求体)
+func signature(secret []byte, sender, timestamp, nonce, path string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	for _, s := range []string{sender, timestamp, nonce, path} {
+		mac.Write([]byte(s))
+		mac.Write([]byte{'\n'})
+	}
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// 长连接帧签名的长度
+const frameMACSize = sha256.Size
+
+// 长连接帧的签名, 每个帧后面附加HMAC-SHA256(连接随机数, 方向, 帧序号, 帧内容)
+// 随机数来自建立连接时签过名的请求, 每个连接不同; 每个方向的帧从1开始编号, 拒绝篡改、重放和调换顺序的帧
+type frameSigner struct {
+	secret  []byte
+	nonce   string
+	client  bool   // 是否是发起连接的一方
+	sendSeq uint64 // 最近一次发出的帧序号
+	recvSeq uint64 // 最近一次收到的帧序号
+}
+
+func newFrameSigner(secret, nonce string, client bool) *frameSigner {
+	return &frameSigner{secret: []byte(secret), nonce: nonce, client: client}
+}
+
+// 客户端发出的帧方向为c, 服务端发出的帧方向为s
+func (s *frameSigner) mac(fromClient bool, seq uint64, payload []byte) []byte {
+	dir := "s"
+	if fromClient {
+		dir = "c"
+	}
+	mac := hmac.New(sha256.New, s.secret)
+	for _, v := range []string{streamProtocol, s.nonce, dir} {
+		mac.Write([]byte(v))
+		mac.Write([]byte{'\n'})
+	}
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], seq)
+	mac.Write(b[:])
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// 在帧后面附加签名, 调用方需按写入连接的顺序调用; 没有配置ClusterSecret时s为nil, 不签名
+func (s *frameSigner) seal(payload []byte) []byte {
+	if s == nil {
+		return payload
+	}
+	s.sendSeq++
+	return append(payload, s.mac(s.client, s.sendSeq, payload)...)
+}
+
+// 校验收到的帧的签名并返回去掉签名的内容, 调用方需按从连接读取的顺序调用
+func (s *frameSigner) open(frame []byte) ([]byte, error) {
+	if s == nil {
+		return frame, nil
+	}
+	if len(frame) < frameMACSize {
+		return nil, errors.New("长连接帧没有签名")
+	}
+	payload, sum := frame[:len(frame)-frameMACSize], frame[len(frame)-frameMACSize:]
+	s.recvSeq++
+	if !hmac.Equal(sum, s.mac(!s.client, s.recvSeq, payload)) {
+		return nil, fmt.Errorf("长连接第%d个帧的签名错误", s.recvSeq)
+	}
+	return payload, nil
+}
+
+// 记录有效时间内已经使用过的随机数, 拒绝重放的请求
+type nonceCache struct {
+	mu     sync.Mutex
+	seen   map[string]time.Time
+	pruned time.Time
+}
+
+// 随机数没有使用过时记录下来并返回true
+func (c *nonceCache) add(nonce string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.seen == nil {
+		c.seen = map[string]time.Time{}
+	}
+	if now.Sub(c.pruned) > signatureWindow {
+		for n, t := range c.seen {
+			if now.Sub(t) > 2*signatureWindow {
+				delete(c.seen, n)
+			}
+		}
+		c.pruned = now
+	}
+	if _, ok := c.seen[nonce]; ok {
+		return false
+	}
+	c.seen[nonce] = now
+	return true
+}
+
+// 校验请求的签名, id不为空时签名的发送方必须是id, 为空时必须是集群成员; 没有配置ClusterSecret时不校验
+func (r *Raft) checkSignature(req *http.Request, body []byte, id string) error {
+	if r.ClusterSecret == "" {
+		return nil
+	}
+	sender := req.Header.Get(headerSender)
+	timestamp := req.Header.Get(headerTimestamp)
+	nonce := req.Header.Get(headerNonce)
+	sign := req.Header.Get(headerSignature)
+	if sender == "" || timestamp == "" || nonce == "" || sign == "" {
+		return ErrUnsigned
+	}
+	expected := signature([]byte(r.ClusterSecret), sender, timestamp, nonce, req.URL.Path, body)
+	if !hmac.Equal([]byte(sign), []byte(expected)) {
+		return fmt.Errorf("%s的请求签名错误", sender)
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%s的请求时间戳错误", sender)
+	}
+	now := time.Now()
+	if d := now.Sub(time.Unix(0, ts)); d > signatureWindow || d < -signatureWindow {
+		return fmt.Errorf("%s的请求已经过期,时间相差%s", sender, d)
+	}
+	if id != "" && sender != id {
+		return fmt.Errorf("签名的发送方%s和请求中的%s不一致", sender, id)
+	}
+	if id == "" {
+		r.Mu.Lock()
+		_, ok := r.Members[sender]
+		r.Mu.Unlock()
+		if !ok {
+			return fmt.Errorf("签名的发送方%s不是集群成员", sender)
+		}
+	}
+	if !r.nonces.add(nonce, now) {
+		return fmt.Errorf("%s的请求是重放的请求", sender)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// 按指定的发送方、时间和随机数签名的请求头
+func signedHeader(secret, sender string, at time.Time, nonce, path string, body []byte) map[string]string {
+	timestamp := strconv.FormatInt(at.UnixNano(), 10)
+	return map[string]string{
+		headerSender:    sender,
+		headerTimestamp: timestamp,
+		headerNonce:     nonce,
+		headerSignature: signature([]byte(secret), sender, timestamp, nonce, path, body),
+	}
+}
+
+func postSigned(ts *httptest.Server, path string, body []byte, header map[string]string) (int, error) {
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+path, bytes.NewReader(body))
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func TestSignatureRejectsRequests(t *testing.T) {
+	r := newTestNode(t, func(o *Options) { o.ClusterSecret = "secret" })
+	ts := httptest.NewServer(r.Handler())
+	defer ts.Close()
+	const election = "/api/v1/election"
+	vote, _ := json.Marshal(&Leader{Term: 1, LeaderId: "n2"})
+	now := time.Now()
+	replayed := signedHeader("secret", "n2", now, "replayed", election, vote)
+	cases := []struct {
+		name   string
+		path   string
+		body   []byte
+		header map[string]string
+		status int
+	}{
+		{"正确的签名", election, vote, signedHeader("secret", "n2", now, "n1", election, vote), 200},
+		{"没有签名", election, vote, nil, 403},
+		{"错误的密钥", election, vote, signedHeader("wrong", "n2", now, "n2", election, vote), 403},
+		{"篡改请求体", election, []byte(`{"term":9,"leader_id":"n2"}`), signedHeader("secret", "n2", now, "n3", election, vote), 403},
+		{"签名的路径不同", election, vote, signedHeader("secret", "n2", now, "n4", "/api/v1/heartbeat", vote), 403},
+		{"时间戳过期", election, vote, signedHeader("secret", "n2", now.Add(-time.Minute), "n5", election, vote), 403},
+		{"时间戳超前", election, vote, signedHeader("secret", "n2", now.Add(time.Minute), "n6", election, vote), 403},
+		{"发送方和候选人不一致", election, vote, signedHeader("secret", "n3", now, "n7", election, vote), 403},
+		{"非成员请求读索引", "/api/v1/read_index", nil, signedHeader("secret", "n9", now, "n8", "/api/v1/read_index", nil), 403},
+		{"第一次使用随机数", election, vote, replayed, 200},
+		{"重放的随机数", election, vote, replayed, 403},
+	}
+	for _, tc := range cases {
+		status, err := postSigned(ts, tc.path, tc.body, tc.header)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err.Error())
+		}
+		if status != tc.status {
+			t.Fatalf("%s: 响应状态%d,应该是%d", tc.name, status, tc.status)
+		}
+	}
+}
+
+func TestFrameSigner(t *testing.T) {
+	client := newFrameSigner("secret", "nonce", true)
+	server := newFrameSigner("secret", "nonce", false)
+
+	first := client.seal([]byte("first"))
+	second := client.seal([]byte("second"))
+	if payload, err := server.open(first); err != nil || string(payload) != "first" {
+		t.Fatalf("校验第一个帧失败:%q %v", payload, err)
+	}
+	// 重放已经收到的帧
+	replayed := newFrameSigner("secret", "nonce", false)
+	replayed.recvSeq = server.recvSeq
+	if _, err := replayed.open(append([]byte(nil), first...)); err == nil {
+		t.Fatal("重放的帧应该校验失败")
+	}
+	// 篡改内容
+	tampered := append([]byte(nil), second...)
+	tampered[0] ^= 1
+	if _, err := newFrameSigner("secret", "nonce", false).open(tampered); err == nil {
+		t.Fatal("篡改的帧应该校验失败")
+	}
+	if payload, err := server.open(second); err != nil || string(payload) != "second" {
+		t.Fatalf("校验第二个帧失败:%q %v", payload, err)
+	}
+	// 服务端发出的帧不能当作客户端的帧
+	reflected := server.seal([]byte("reply"))
+	if _, err := newFrameSigner("secret", "nonce", false).open(reflected); err == nil {
+		t.Fatal("反射回来的帧应该校验失败")
+	}
+	if payload, err := client.open(reflected); err != nil || string(payload) != "reply" {
+		t.Fatalf("校验响应帧失败:%q %v", payload, err)
+	}
+	// 其他连接或者其他密钥
+	for _, s := range []*frameSigner{newFrameSigner("secret", "other", false), newFrameSigner("wrong", "nonce", false)} {
+		if _, err := s.open(client.seal([]byte("x"))); err == nil {
+			t.Fatal("其他连接或者错误密钥的帧应该校验失败")
+		}
+	}
+	// 没有配置ClusterSecret时不签名
+	var none *frameSigner
+	if payload := none.seal([]byte("plain")); string(payload) != "plain" {
+		t.Fatalf("没有密钥时帧被修改:%q", payload)
+	}
+}
+
+func TestRotatedSecretMarksMemberDown(t *testing.T) {
+	c := newHttpCluster(t, 3, func(o *Options) { o.ClusterSecret = "secret" })
+	c.waitFor("选出leader", 20*time.Second, func() bool { return c.leader() != nil })
+	c.propose("a")
+	leader := c.leader()
+	var follower *Raft
+	for _, r := range c.nodes {
+		if r != leader {
+			follower = r
+		}
+	}
+	c.waitFor("follower心跳在线", 10*time.Second, func() bool {
+		leader.Mu.Lock()
+		defer leader.Mu.Unlock()
+		return leader.Members[follower.Id].HeartbeatStatus == "online"
+	})
+	observer := &testObserver{}
+	leader.Observe(observer.observe)
+
+	// follower换了密钥后在原地址重新启动, leader的请求被拒绝
+	address := follower.Address
+	c.servers[follower.Id].Close()
+	c.stopNode(follower)
+	rotated := newTestNode(t, func(o *Options) {
+		o.Id = follower.Id
+		o.Address = address
+		o.Members = configMembers(leader.GetMembers())
+		o.ClusterSecret = "rotated"
+	})
+	ts := httptest.NewUnstartedServer(rotated.Handler())
+	ts.Listener.Close()
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.Listener = ln
+	ts.Start()
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream := &StreamTransport{signer: &signer{id: leader.Id, secret: []byte("secret")}}
+	defer stream.Close()
+	for _, transport := range []Transport{leader.Transport, stream} {
+		if _, err := transport.AppendEntries(ctx, &Member{Id: follower.Id, Address: address}, &HeartbeatBody{Leader: leader.Id}); !errors.Is(err, ErrPeerUnauthorized) {
+			t.Fatalf("%T在密钥不一致时返回%v", transport, err)
+		}
+	}
+	c.waitFor("leader发出member_down事件", 10*time.Second, func() bool {
+		return observer.has(EventMemberDown, func(e Event) bool { return e.MemberId == follower.Id })
+	})
+	leader.Mu.Lock()
+	status := leader.Members[follower.Id].HeartbeatStatus
+	leader.Mu.Unlock()
+	if status != "offline" {
+		t.Fatalf("被拒绝的成员心跳状态是%s", status)
+	}
+}
@@ -0,0 +1,170 @@
+// 快照
+package raft
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// 快照的数据块大小
+const snapshotChunkSize = 1024 * 1024
+
+// 生成快照后保留的日志条数, 稍微落后的成员仍然可以通过日志追上
+const snapshotTrailingEntries = 1024
+
+// 快照元数据
+type SnapshotMeta struct {
+	Index   int64              `json:"index"`   // 快照包含的最后一条日志索引
+	Term    int64              `json:"term"`    // 快照包含的最后一条日志任期
+	Members map[string]*Member `json:"members"` // 生成快照时的集群成员
+}
+
+// InstallSnapshot请求, 快照按数据块顺序发送
+type InstallSnapshotBody struct {
+	Term   int64         `json:"term"`   // leader的任期
+	Leader string        `json:"leader"` // leader id
+	Meta   *SnapshotMeta `json:"meta"`
+	Offset int64         `json:"offset"` // 数据块在快照中的偏移
+	Data   []byte        `json:"data"`
+	Done   bool          `json:"done"` // 是否是最后一个数据块
+}
+
+// InstallSnapshot响应
+type InstallSnapshotReply struct {
+	Term    int64 `json:"term"`
+	Success bool  `json:"success"` // 数据块是否接收成功
+}
+
+// 正在接收的快照
+type pendingSnapshot struct {
+	meta   *SnapshotMeta
+	file   *os.File
+	offset int64
+}
+
+// 上次快照之后应用了足够多的日志时生成快照并压缩日志, 调用方需持有applyMu
+func (r *Raft) maybeSnapshot() {
+	r.Mu.Lock()
+	need := r.LastApplied-r.snapshotIndex >= r.SnapshotEntries || r.appliedBytes >= r.SnapshotBytes
+	r.Mu.Unlock()
+	if !need {
+		return
+	}
+	if err := r.takeSnapshot(); err != nil {
+		r.Logger.Errorf("生成快照错误:%s", err.Error())
+	}
+}
+
+// 生成快照, 调用方需持有applyMu, 保证快照是LastApplied时刻的状态
+func (r *Raft) takeSnapshot() error {
+	r.Mu.Lock()
+	members, _ := r.membersAt(r.LastApplied)
+	meta := &SnapshotMeta{
+		Index:   r.LastApplied,
+		Term:    r.log.termAt(r.LastApplied),
+		Members: members,
+	}
+	r.Mu.Unlock()
+
+	data, err := r.StateMachine.Snapshot()
+	if err != nil {
+		return err
+	}
+	if c, ok := data.(io.Closer); ok {
+		defer c.Close()
+	}
+	if err := r.Storage.SaveSnapshot(meta, data); err != nil {
+		return err
+	}
+
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	r.snapshotIndex = meta.Index
+	r.appliedBytes = 0
+	compactIndex := meta.Index - snapshotTrailingEntries
+	if compactIndex >= r.log.firstIndex() {
+		base, _ := r.membersAt(compactIndex)
+		if err := r.log.compact(compactIndex); err != nil {
+			return err
+		}
+		r.baseMembers = base
+	}
+	r.Logger.Infof("生成快照,快照索引%d任期%d,日志压缩到%d", meta.Index, meta.Term, r.log.firstIndex()-1)
+	return nil
+}
+
+// 启动时从存储中恢复快照, 返回快照的索引和任期, 调用方需持有锁
+func (r *Raft) restoreSnapshot() (int64, int64, error) {
+	meta, data, err := r.Storage.LoadSnapshot()
+	if err != nil || meta == nil {
+		return 0, 0, err
+	}
+	defer data.Close()
+	if err := r.StateMachine.Restore(data); err != nil {
+		return 0, 0, err
+	}
+	if len(meta.Members) > 0 {
+		r.baseMembers = meta.Members
+	}
+	r.CommitIndex = meta.Index
+	r.LastApplied = meta.Index
+	r.snapshotIndex = meta.Index
+	return meta.Index, meta.Term, nil
+}
+
+// 把接收完成的快照保存到存储并应用到状态机
+func (r *Raft) installSnapshot(p *pendingSnapshot) error {
+	defer os.Remove(p.file.Name())
+	defer p.file.Close()
+	r.applyMu.Lock()
+	defer r.applyMu.Unlock()
+
+	// 接收快照期间本节点已经通过日志应用到快照的位置, 丢弃旧的快照
+	r.Mu.Lock()
+	applied := r.LastApplied
+	r.Mu.Unlock()
+	if p.meta.Index <= applied {
+		r.Logger.Infof("快照索引%d不大于已经应用的索引%d,丢弃快照", p.meta.Index, applied)
+		return nil
+	}
+	if _, err := p.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := r.Storage.SaveSnapshot(p.meta, p.file); err != nil {
+		return err
+	}
+	if _, err := p.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := r.StateMachine.Restore(p.file); err != nil {
+		return err
+	}
+
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	if err := r.log.restoreSnapshot(p.meta.Index, p.meta.Term); err != nil {
+		return err
+	}
+	if len(p.meta.Members) > 0 {
+		r.baseMembers = p.meta.Members
+	}
+	r.reloadConfig()
+	if r.CommitIndex < p.meta.Index {
+		r.CommitIndex = p.meta.Index
+	}
+	r.LastApplied = p.meta.Index
+	r.snapshotIndex = p.meta.Index
+	r.appliedBytes = 0
+	r.Logger.Infof("安装快照完成,快照索引%d任期%d", p.meta.Index, p.meta.Term)
+	return nil
+}
+
+// 创建接收快照的临时文件
+func (r *Raft) newPendingSnapshot(meta *SnapshotMeta) (*pendingSnapshot, error) {
+	f, err := ioutil.TempFile(r.DataDir, "snapshot-recv-")
+	if err != nil {
+		return nil, err
+	}
+	return &pendingSnapshot{meta: meta, file: f}, nil
+}
@@ -0,0 +1,121 @@
+package raft
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestInstallSnapshotInChunks(t *testing.T) {
+	fsm := &testFSM{}
+	r := newTestNode(t, func(o *Options) { o.StateMachine = fsm })
+	meta := &SnapshotMeta{Index: 5, Term: 2, Members: testMembers("n1", "n2", "n3")}
+	data, _ := json.Marshal([]string{"a", "b", "c"})
+	chunks := []struct {
+		name    string
+		offset  int64
+		data    []byte
+		done    bool
+		success bool
+	}{
+		{"第一个数据块", 0, data[:4], false, true},
+		{"偏移不连续", 8, data[4:], true, false},
+		{"最后一个数据块", 4, data[4:], true, true},
+	}
+	for _, c := range chunks {
+		reply, err := r.InstallSnapshotResponse(&InstallSnapshotBody{
+			Term: 2, Leader: "n2", Meta: meta, Offset: c.offset, Data: c.data, Done: c.done,
+		})
+		if reply.Success != c.success {
+			t.Fatalf("%s: 结果%v错误%v", c.name, reply.Success, err)
+		}
+	}
+	if fmt.Sprint(fsm.commands()) != "[a b c]" {
+		t.Fatalf("安装快照后状态机是%v", fsm.commands())
+	}
+	r.Mu.Lock()
+	applied, commit, last, term := r.LastApplied, r.CommitIndex, r.log.lastIndex(), r.log.lastTerm()
+	r.Mu.Unlock()
+	if applied != 5 || commit != 5 || last != 5 || term != 2 {
+		t.Fatalf("安装快照后LastApplied %d CommitIndex %d 最后一条日志%d任期%d", applied, commit, last, term)
+	}
+
+	// 快照之后的日志可以接着快照追加
+	reply, err := r.HeartbeatResponse(&HeartbeatBody{
+		Term: 2, Leader: "n2", PrevLogIndex: 5, PrevLogTerm: 2,
+		Entries: []*Entry{{Index: 6, Term: 2, Type: EntryCommand, Data: []byte("d")}},
+	})
+	if err != nil || !reply.Success || reply.MatchIndex != 6 {
+		t.Fatalf("快照之后追加日志失败:%+v %v", reply, err)
+	}
+}
+
+func TestInstallStaleSnapshotIsIgnored(t *testing.T) {
+	fsm := &testFSM{applied: []string{"a", "b"}}
+	r := newTestNode(t, func(o *Options) { o.StateMachine = fsm })
+	r.Mu.Lock()
+	r.LastApplied = 10
+	r.CommitIndex = 10
+	r.Mu.Unlock()
+
+	data, _ := json.Marshal([]string{"old"})
+	reply, err := r.InstallSnapshotResponse(&InstallSnapshotBody{
+		Term: 1, Leader: "n2",
+		Meta: &SnapshotMeta{Index: 5, Term: 1, Members: testMembers("n1", "n2", "n3")},
+		Data: data, Done: true,
+	})
+	if err != nil || !reply.Success {
+		t.Fatalf("过期的快照应该直接返回成功:%+v %v", reply, err)
+	}
+	r.Mu.Lock()
+	applied := r.LastApplied
+	r.Mu.Unlock()
+	if applied != 10 || fmt.Sprint(fsm.commands()) != "[a b]" {
+		t.Fatalf("过期的快照覆盖了状态机:LastApplied %d 状态%v", applied, fsm.commands())
+	}
+}
+
+func TestSnapshotRestoredOnRestart(t *testing.T) {
+	storage := NewMemoryStorage()
+	fsm := &testFSM{}
+	r := newTestNode(t, func(o *Options) {
+		o.Storage = storage
+		o.StateMachine = fsm
+	})
+	if _, err := r.HeartbeatResponse(&HeartbeatBody{
+		Term: 1, Leader: "n2",
+		Entries: []*Entry{
+			{Index: 1, Term: 1, Type: EntryCommand, Data: []byte("a")},
+			{Index: 2, Term: 1, Type: EntryCommand, Data: []byte("b")},
+		},
+		LeaderCommit: 2,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// 后台任务没有启动, 手动应用已提交的日志
+	r.Mu.Lock()
+	for i := r.LastApplied + 1; i <= r.CommitIndex; i++ {
+		fsm.Apply(r.log.entry(i))
+	}
+	r.LastApplied = r.CommitIndex
+	r.Mu.Unlock()
+	r.applyMu.Lock()
+	err := r.takeSnapshot()
+	r.applyMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 用同一个存储重新创建节点, 状态机从快照恢复
+	restored := &testFSM{}
+	r = newTestNode(t, func(o *Options) {
+		o.Storage = storage
+		o.StateMachine = restored
+	})
+	r.Mu.Lock()
+	applied, commit := r.LastApplied, r.CommitIndex
+	r.Mu.Unlock()
+	if applied != 2 || commit != 2 || fmt.Sprint(restored.commands()) != "[a b]" {
+		t.Fatalf("重启后LastApplied %d CommitIndex %d 状态%v", applied, commit, restored.commands())
+	}
+}
@@ -0,0 +1,130 @@
+// 持久化存储
+package raft
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// Storage 持久化任期、投票和日志, 方法返回时数据必须已经落盘
+// 节点重启后从这里恢复, 保证同一个任期不会投出两张选票
+type Storage interface {
+	// 读取保存的任期和投票
+	LoadState() (term int64, votedFor string, err error)
+	// 保存任期和投票
+	SaveState(term int64, votedFor string) error
+	// 按索引顺序读取全部日志
+	LoadEntries() ([]*Entry, error)
+	// 在日志末尾追加日志
+	AppendEntries(entries []*Entry) error
+	// 删除index及之后的日志
+	TruncateSuffix(index int64) error
+	// 删除index及之前的日志, 生成快照后压缩日志时调用
+	TruncatePrefix(index int64) error
+	// 保存快照, 保存成功后替换旧的快照
+	SaveSnapshot(meta *SnapshotMeta, data io.Reader) error
+	// 读取最新的快照, 没有快照时返回的meta为nil
+	LoadSnapshot() (*SnapshotMeta, io.ReadCloser, error)
+	Close() error
+}
+
+// 内存存储, 不落盘, 用于测试或者不需要重启恢复的场景
+type MemoryStorage struct {
+	mu       sync.Mutex
+	term     int64
+	votedFor string
+	entries  []*Entry
+	snapMeta *SnapshotMeta
+	snapData []byte
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{}
+}
+
+func (s *MemoryStorage) LoadState() (int64, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.term, s.votedFor, nil
+}
+
+func (s *MemoryStorage) SaveState(term int64, votedFor string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.term = term
+	s.votedFor = votedFor
+	return nil
+}
+
+func (s *MemoryStorage) LoadEntries() ([]*Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := make([]*Entry, len(s.entries))
+	copy(entries, s.entries)
+	return entries, nil
+}
+
+func (s *MemoryStorage) AppendEntries(entries []*Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range entries {
+		if n := len(s.entries); n > 0 && s.entries[n-1].Index+1 != e.Index {
+			return fmt.Errorf("追加的日志索引%d不连续,最后一条日志索引是%d", e.Index, s.entries[n-1].Index)
+		}
+		s.entries = append(s.entries, e)
+	}
+	return nil
+}
+
+func (s *MemoryStorage) TruncateSuffix(index int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, e := range s.entries {
+		if e.Index >= index {
+			s.entries = s.entries[:i]
+			break
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStorage) TruncatePrefix(index int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, e := range s.entries {
+		if e.Index > index {
+			s.entries = s.entries[i:]
+			return nil
+		}
+	}
+	s.entries = nil
+	return nil
+}
+
+func (s *MemoryStorage) SaveSnapshot(meta *SnapshotMeta, data io.Reader) error {
+	d, err := ioutil.ReadAll(data)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snapMeta = meta
+	s.snapData = d
+	return nil
+}
+
+func (s *MemoryStorage) LoadSnapshot() (*SnapshotMeta, io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.snapMeta == nil {
+		return nil, nil, nil
+	}
+	return s.snapMeta, ioutil.NopCloser(bytes.NewReader(s.snapData)), nil
+}
+
+func (s *MemoryStorage) Close() error {
+	return nil
+}
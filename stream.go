@@ -0,0 +1,495 @@
+// 长连接二进制传输
+package raft
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 升级为长连接时使用的协议名
+const streamProtocol = "raft-stream"
+
+// 每个长连接上同时处理的心跳之外的请求数, 达到上限后暂停读取新的请求
+const streamWorkers = 16
+
+var ErrStreamClosed = errors.New("长连接已经关闭")
+
+// 请求和响应的类型
+const (
+	streamVote uint8 = iota + 1
+	streamAppendEntries
+	streamInstallSnapshot
+	streamTimeoutNow
+	streamReadIndex
+)
+
+// 长连接上传输的帧, 请求和响应使用同一个结构, 只填写对应类型的字段
+// 帧按stream.proto中的StreamFrame用protobuf编码, 其他语言的实现可以用这个定义生成代码
+type streamFrame struct {
+	Id    uint64 // 请求id, 响应和请求的id相同
+	Type  uint8
+	Error string // 请求失败的原因, 不为空时响应中没有数据
+
+	Vote                 *Leader
+	ElectionReply        *ElectionReply
+	AppendEntries        *HeartbeatBody
+	HeartbeatReply       *HeartbeatReply
+	InstallSnapshot      *InstallSnapshotBody
+	InstallSnapshotReply *InstallSnapshotReply
+	TimeoutNow           *TimeoutNowBody
+	TimeoutNowReply      *TimeoutNowReply
+	ReadIndexReply       *ReadIndexReply
+}
+
+// StreamTransport 长连接二进制传输
+// 每个成员只建立一个长连接, 所有请求在连接上并发发送, 按请求id匹配响应, 心跳不再重复建立连接和编码JSON
+// 长连接通过HTTP Upgrade建立在Handler()提供的接口上, 和HTTP传输使用相同的地址和路由前缀
+type StreamTransport struct {
+	RoutePrefix string // 接口路由的前缀, 和Options.RoutePrefix一致
+
+	tls    *tlsFiles // 双向TLS, 由NewRaft按Options设置
+	signer *signer   // 建立连接的请求签名, 由NewRaft按Options设置
+	mu     sync.Mutex
+	conns  map[string]*streamConn
+	closed bool
+}
+
+func (t *StreamTransport) RequestVote(ctx context.Context, m *Member, req *Leader) (*ElectionReply, error) {
+	resp, err := t.call(ctx, m, &streamFrame{Type: streamVote, Vote: req})
+	if err != nil {
+		return nil, err
+	}
+	return resp.ElectionReply, nil
+}
+
+func (t *StreamTransport) AppendEntries(ctx context.Context, m *Member, req *HeartbeatBody) (*HeartbeatReply, error) {
+	resp, err := t.call(ctx, m, &streamFrame{Type: streamAppendEntries, AppendEntries: req})
+	if err != nil {
+		return nil, err
+	}
+	return resp.HeartbeatReply, nil
+}
+
+func (t *StreamTransport) InstallSnapshot(ctx context.Context, m *Member, req *InstallSnapshotBody) (*InstallSnapshotReply, error) {
+	resp, err := t.call(ctx, m, &streamFrame{Type: streamInstallSnapshot, InstallSnapshot: req})
+	if err != nil {
+		return nil, err
+	}
+	return resp.InstallSnapshotReply, nil
+}
+
+func (t *StreamTransport) TimeoutNow(ctx context.Context, m *Member, req *TimeoutNowBody) (*TimeoutNowReply, error) {
+	resp, err := t.call(ctx, m, &streamFrame{Type: streamTimeoutNow, TimeoutNow: req})
+	if err != nil {
+		return nil, err
+	}
+	return resp.TimeoutNowReply, nil
+}
+
+func (t *StreamTransport) ReadIndex(ctx context.Context, m *Member) (*ReadIndexReply, error) {
+	resp, err := t.call(ctx, m, &streamFrame{Type: streamReadIndex})
+	if err != nil {
+		return nil, err
+	}
+	return resp.ReadIndexReply, nil
+}
+
+// Close 关闭所有长连接, 节点停止时调用
+func (t *StreamTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	for address, c := range t.conns {
+		c.close(ErrStreamClosed)
+		delete(t.conns, address)
+	}
+	return nil
+}
+
+func (t *StreamTransport) call(ctx context.Context, m *Member, req *streamFrame) (*streamFrame, error) {
+	c, err := t.conn(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.call(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Type != req.Type {
+		return nil, fmt.Errorf("%s的响应类型%d和请求类型%d不一致", m.Id, resp.Type, req.Type)
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return resp, nil
+}
+
+// 返回到成员的长连接, 没有连接或者连接已经断开时重新建立
+func (t *StreamTransport) conn(ctx context.Context, m *Member) (*streamConn, error) {
+	address := m.Address
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil, ErrStreamClosed
+	}
+	if c, ok := t.conns[address]; ok && !c.isClosed() {
+		t.mu.Unlock()
+		return c, nil
+	}
+	t.mu.Unlock()
+
+	c, err := t.dial(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conns == nil {
+		t.conns = map[string]*streamConn{}
+	}
+	// 并发建立了多个连接时只保留一个
+	if old, ok := t.conns[address]; ok && !old.isClosed() {
+		c.close(ErrStreamClosed)
+		return old, nil
+	}
+	t.conns[address] = c
+	return c, nil
+}
+
+// 建立TCP连接并通过HTTP Upgrade切换到长连接协议, 配置了TLS时先完成TLS握手并校验对方是成员m
+func (t *StreamTransport) dial(ctx context.Context, m *Member) (*streamConn, error) {
+	address := m.Address
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	nc, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = nc.SetDeadline(deadline)
+	}
+	scheme := "http://"
+	if t.tls != nil {
+		tc := tls.Client(nc, t.tls.clientConfig(m.Id))
+		if err := tc.Handshake(); err != nil {
+			nc.Close()
+			return nil, err
+		}
+		nc = tc
+		scheme = "https://"
+	}
+	req, _ := http.NewRequest(http.MethodGet, scheme+address+t.RoutePrefix+"/api/v1/stream", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", streamProtocol)
+	var fs *frameSigner
+	if t.signer != nil {
+		header := t.signer.sign(req.URL.Path, nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		fs = newFrameSigner(string(t.signer.secret), header[headerNonce], true)
+	}
+	if err := req.Write(nc); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(nc)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		nc.Close()
+		return nil, fmt.Errorf("%w:%s拒绝建立长连接", ErrPeerUnauthorized, address)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		nc.Close()
+		return nil, fmt.Errorf("%s不支持长连接,响应状态%s", address, resp.Status)
+	}
+	_ = nc.SetDeadline(time.Time{})
+	c := newStreamConn(nc, br, fs)
+	go c.readLoop()
+	return c, nil
+}
+
+// 客户端的长连接
+type streamConn struct {
+	conn    net.Conn
+	br      *bufio.Reader
+	writeMu sync.Mutex
+	signer  *frameSigner // 配置ClusterSecret时给帧签名, 发送时需持有writeMu
+
+	mu      sync.Mutex
+	nextId  uint64
+	pending map[uint64]chan *streamFrame
+	err     error // 连接断开的原因, 不为空时连接不能再使用
+}
+
+func newStreamConn(conn net.Conn, br *bufio.Reader, signer *frameSigner) *streamConn {
+	return &streamConn{
+		conn:    conn,
+		br:      br,
+		signer:  signer,
+		pending: map[uint64]chan *streamFrame{},
+	}
+}
+
+// 发送请求并等待响应
+func (c *streamConn) call(ctx context.Context, req *streamFrame) (*streamFrame, error) {
+	ch := make(chan *streamFrame, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	c.nextId++
+	req.Id = c.nextId
+	c.pending[req.Id] = ch
+	c.mu.Unlock()
+
+	c.writeMu.Lock()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = c.conn.SetWriteDeadline(deadline)
+	}
+	err := writeStreamFrame(c.conn, c.signer.seal(encodeStreamFrame(req)))
+	_ = c.conn.SetWriteDeadline(time.Time{})
+	c.writeMu.Unlock()
+	if err != nil {
+		// 写入一半的帧会破坏后续的数据, 连接不能再使用
+		c.close(err)
+		return nil, err
+	}
+
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return nil, c.closeErr()
+		}
+		return resp, nil
+	case <-ctx.Done():
+		c.mu.Lock()
+		delete(c.pending, req.Id)
+		c.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// 读取响应交给等待的请求, 连接断开后失败所有等待中的请求
+func (c *streamConn) readLoop() {
+	for {
+		data, err := readStreamFrame(c.br)
+		if err == nil {
+			data, err = c.signer.open(data)
+		}
+		if err != nil {
+			c.close(err)
+			return
+		}
+		resp, err := decodeStreamFrame(data)
+		if err != nil {
+			c.close(err)
+			return
+		}
+		c.mu.Lock()
+		ch, ok := c.pending[resp.Id]
+		delete(c.pending, resp.Id)
+		c.mu.Unlock()
+		if ok {
+			ch <- resp
+		}
+	}
+}
+
+func (c *streamConn) close(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	c.conn.Close()
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
+
+func (c *streamConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err != nil
+}
+
+func (c *streamConn) closeErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// 接收长连接, 把http连接切换到长连接协议后按帧处理请求
+// 心跳按接收顺序处理, 其他请求最多streamWorkers个并发处理
+// 切换协议后的连接不再由http服务管理, 登记到节点中, 节点停止时关闭并等待处理结束
+func (r *Raft) streamRequest(resp http.ResponseWriter, req *http.Request) {
+	if !r.authorizePeer(resp, req, r.checkRequest(req, nil, "")) {
+		return
+	}
+	if req.Header.Get("Upgrade") != streamProtocol {
+		http.Error(resp, "需要升级为"+streamProtocol+"协议", http.StatusUpgradeRequired)
+		return
+	}
+	hj, ok := resp.(http.Hijacker)
+	if !ok {
+		http.Error(resp, "http服务不支持长连接", http.StatusInternalServerError)
+		return
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		r.logWith(LogTransport).Warnf("切换长连接错误:%s", err.Error())
+		return
+	}
+	defer conn.Close()
+	r.Mu.Lock()
+	if r.isStopped() {
+		r.Mu.Unlock()
+		return
+	}
+	r.streamConns[conn] = true
+	r.wg.Add(1)
+	r.Mu.Unlock()
+	defer func() {
+		r.Mu.Lock()
+		delete(r.streamConns, conn)
+		r.Mu.Unlock()
+		r.wg.Done()
+	}()
+	_, _ = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: " + streamProtocol + "\r\n\r\n")
+	if err := brw.Flush(); err != nil {
+		return
+	}
+
+	// 建立连接的请求已经校验过签名, 之后的帧用请求中的随机数签名
+	var fs *frameSigner
+	if r.ClusterSecret != "" {
+		fs = newFrameSigner(r.ClusterSecret, req.Header.Get(headerNonce), false)
+	}
+	var writeMu sync.Mutex
+	var workers sync.WaitGroup
+	defer workers.Wait()
+	sem := make(chan struct{}, streamWorkers)
+	reply := func(f *streamFrame) {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		if err := writeStreamFrame(conn, fs.seal(encodeStreamFrame(f))); err != nil {
+			conn.Close()
+		}
+	}
+	for {
+		data, err := readStreamFrame(brw.Reader)
+		if err == nil {
+			data, err = fs.open(data)
+		}
+		if err != nil {
+			if err != io.EOF {
+				r.logWith(LogTransport).Warnf("%s的长连接错误:%s", req.RemoteAddr, err.Error())
+			}
+			return
+		}
+		f, err := decodeStreamFrame(data)
+		if err != nil {
+			r.logWith(LogTransport).Warnf("%s的长连接帧错误:%s", req.RemoteAddr, err.Error())
+			return
+		}
+		if f.Type == streamAppendEntries {
+			reply(r.handleStreamFrame(req, f))
+			continue
+		}
+		sem <- struct{}{}
+		workers.Add(1)
+		go func(f *streamFrame) {
+			defer func() {
+				<-sem
+				workers.Done()
+			}()
+			reply(r.handleStreamFrame(req, f))
+		}(f)
+	}
+}
+
+// 处理一个请求帧, 返回响应帧; req是建立长连接的请求, 用来校验发送方的身份
+func (r *Raft) handleStreamFrame(req *http.Request, f *streamFrame) *streamFrame {
+	resp := &streamFrame{Id: f.Id, Type: f.Type}
+	if err := r.checkStreamSender(req, f); err != nil {
+		r.logWith(LogTransport).Warnf("拒绝%s的请求:%s", req.RemoteAddr, err.Error())
+		resp.Error = err.Error()
+		return resp
+	}
+	var err error
+	switch {
+	case f.Type == streamVote && f.Vote != nil:
+		resp.ElectionReply, err = r.ElectionResponse(f.Vote)
+		if err != nil {
+			r.logWith(LogTransport).Warnf("response election - %s", err.Error())
+		}
+	case f.Type == streamAppendEntries && f.AppendEntries != nil:
+		resp.HeartbeatReply, err = r.HeartbeatResponse(f.AppendEntries)
+		if err != nil {
+			r.logWith(LogTransport).Warnf("response heartbeat - %s", err.Error())
+		}
+	case f.Type == streamInstallSnapshot && f.InstallSnapshot != nil:
+		resp.InstallSnapshotReply, err = r.InstallSnapshotResponse(f.InstallSnapshot)
+		if err != nil {
+			r.logWith(LogTransport).Warnf("response install snapshot - %s", err.Error())
+		}
+	case f.Type == streamTimeoutNow && f.TimeoutNow != nil:
+		resp.TimeoutNowReply, err = r.TimeoutNowResponse(f.TimeoutNow)
+		if err != nil {
+			r.logWith(LogTransport).Warnf("response timeout now - %s", err.Error())
+		}
+	case f.Type == streamReadIndex:
+		ctx, cancel := r.stopContext(context.Background(), time.Duration(r.Timeout)*time.Second)
+		index, err := r.readIndex(ctx)
+		cancel()
+		if err != nil {
+			resp.Error = err.Error()
+		} else {
+			resp.ReadIndexReply = &ReadIndexReply{Index: index}
+		}
+	default:
+		resp.Error = fmt.Sprintf("未知的请求类型%d", f.Type)
+	}
+	return resp
+}
+
+// 校验请求帧中的发送方和建立长连接时的客户端证书、签名的发送方一致
+// 帧的签名在读取时已经校验过, 这里只需要确认帧中的发送方
+func (r *Raft) checkStreamSender(req *http.Request, f *streamFrame) error {
+	var id string
+	switch {
+	case f.Vote != nil:
+		id = f.Vote.LeaderId
+	case f.AppendEntries != nil:
+		id = f.AppendEntries.Leader
+	case f.InstallSnapshot != nil:
+		id = f.InstallSnapshot.Leader
+	case f.TimeoutNow != nil:
+		id = f.TimeoutNow.Leader
+	default:
+		return nil
+	}
+	if err := r.checkPeer(req, id); err != nil {
+		return err
+	}
+	if sender := req.Header.Get(headerSender); r.ClusterSecret != "" && sender != id {
+		return fmt.Errorf("签名的发送方%s和请求中的%s不一致", sender, id)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package raft
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestStreamTransportCluster(t *testing.T) {
+	c := newHttpCluster(t, 3, func(o *Options) { o.Transport = &StreamTransport{} })
+	c.waitFor("选出leader", 20*time.Second, func() bool { return c.leader() != nil })
+	c.propose("a")
+	c.propose("b")
+	c.waitFor("全部节点应用相同的日志", 20*time.Second, c.converged)
+	// follower通过长连接向leader请求读索引
+	for _, r := range c.nodes {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := r.LinearizableRead(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("%s读取错误:%s", r.Id, err.Error())
+		}
+	}
+}
+
+func TestShutdownClosesStreamConns(t *testing.T) {
+	c := newHttpCluster(t, 3, func(o *Options) { o.Transport = &StreamTransport{} })
+	c.waitFor("选出leader", 20*time.Second, func() bool { return c.leader() != nil })
+	c.propose("a")
+	leader := c.leader()
+	var follower *Raft
+	for _, r := range c.nodes {
+		if r != leader {
+			follower = r
+		}
+	}
+	c.waitFor("leader建立长连接", 5*time.Second, func() bool {
+		follower.Mu.Lock()
+		defer follower.Mu.Unlock()
+		return len(follower.streamConns) > 0
+	})
+
+	// 切换协议后的连接不受http服务管理, 由Shutdown关闭并等待处理结束
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := follower.Shutdown(ctx); err != nil {
+		t.Fatalf("停止错误:%s", err.Error())
+	}
+	follower.Mu.Lock()
+	n := len(follower.streamConns)
+	follower.Mu.Unlock()
+	if n != 0 {
+		t.Fatalf("停止后还有%d个长连接", n)
+	}
+	transport := leader.Transport.(*StreamTransport)
+	c.waitFor("leader发现连接断开", 5*time.Second, func() bool {
+		transport.mu.Lock()
+		conn, ok := transport.conns[follower.Address]
+		transport.mu.Unlock()
+		return !ok || conn.isClosed()
+	})
+}
@@ -0,0 +1,546 @@
+// 长连接帧的protobuf编解码, 按stream.proto手写, 不依赖protobuf库
+package raft
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// 单个帧的最大长度, 超过时认为数据错误并断开连接
+const maxStreamFrameSize = 64 * 1024 * 1024
+
+// protobuf的wire type
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errProtoFormat = errors.New("长连接帧的protobuf编码错误")
+
+// 写入一个帧: 4字节大端长度 + 数据
+func writeStreamFrame(w io.Writer, payload []byte) error {
+	buf := make([]byte, 4, 4+len(payload))
+	binary.BigEndian.PutUint32(buf, uint32(len(payload)))
+	_, err := w.Write(append(buf, payload...))
+	return err
+}
+
+// 读取一个帧的数据
+func readStreamFrame(r io.Reader) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(header[:])
+	if n > maxStreamFrameSize {
+		return nil, fmt.Errorf("长连接帧长度%d超过%d", n, maxStreamFrameSize)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// protobuf编码, 和proto3一样不写入默认值的字段
+type pbWriter struct {
+	b []byte
+}
+
+func (w *pbWriter) varint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	w.b = append(w.b, buf[:n]...)
+}
+
+func (w *pbWriter) tag(field, wire int) {
+	w.varint(uint64(field)<<3 | uint64(wire))
+}
+
+func (w *pbWriter) uint(field int, v uint64) {
+	if v != 0 {
+		w.tag(field, wireVarint)
+		w.varint(v)
+	}
+}
+
+// int64按补码编码为varint, 和protobuf的int64一致
+func (w *pbWriter) int(field int, v int64) {
+	w.uint(field, uint64(v))
+}
+
+func (w *pbWriter) bool(field int, v bool) {
+	if v {
+		w.uint(field, 1)
+	}
+}
+
+func (w *pbWriter) bytes(field int, v []byte) {
+	if len(v) > 0 {
+		w.tag(field, wireBytes)
+		w.varint(uint64(len(v)))
+		w.b = append(w.b, v...)
+	}
+}
+
+func (w *pbWriter) string(field int, v string) {
+	if v != "" {
+		w.tag(field, wireBytes)
+		w.varint(uint64(len(v)))
+		w.b = append(w.b, v...)
+	}
+}
+
+// 写入嵌套消息, 空消息也写入, 解码后得到非nil的空结构
+func (w *pbWriter) message(field int, encode func(*pbWriter)) {
+	var m pbWriter
+	encode(&m)
+	w.tag(field, wireBytes)
+	w.varint(uint64(len(m.b)))
+	w.b = append(w.b, m.b...)
+}
+
+// map<string, Member>的每一项编码为key=1、value=2的嵌套消息
+func (w *pbWriter) members(field int, members map[string]*Member) {
+	for id, m := range members {
+		m := m
+		w.message(field, func(e *pbWriter) {
+			e.string(1, id)
+			e.message(2, func(v *pbWriter) { encodeMember(v, m) })
+		})
+	}
+}
+
+// 解码出的一个字段, varint类型的值在v中, 长度类型的值在data中
+type pbField struct {
+	num  int
+	wire int
+	v    uint64
+	data []byte
+}
+
+func (f *pbField) int() int64 {
+	return int64(f.v)
+}
+
+func (f *pbField) bool() bool {
+	return f.v != 0
+}
+
+func (f *pbField) string() string {
+	return string(f.data)
+}
+
+// 复制数据, 不引用整个帧的缓冲区
+func (f *pbField) bytes() []byte {
+	if len(f.data) == 0 {
+		return nil
+	}
+	return append([]byte(nil), f.data...)
+}
+
+// 依次解码消息中的字段, 跳过不认识的字段
+func pbDecode(b []byte, fn func(f *pbField) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errProtoFormat
+		}
+		b = b[n:]
+		f := &pbField{num: int(key >> 3), wire: int(key & 7)}
+		switch f.wire {
+		case wireVarint:
+			f.v, n = binary.Uvarint(b)
+			if n <= 0 {
+				return errProtoFormat
+			}
+			b = b[n:]
+		case wireBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return errProtoFormat
+			}
+			f.data = b[n : n+int(l)]
+			b = b[n+int(l):]
+		case wireFixed64, wireFixed32:
+			size := 8
+			if f.wire == wireFixed32 {
+				size = 4
+			}
+			if len(b) < size {
+				return errProtoFormat
+			}
+			b = b[size:]
+			continue
+		default:
+			return errProtoFormat
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeStreamFrame(f *streamFrame) []byte {
+	w := &pbWriter{}
+	w.uint(1, f.Id)
+	w.uint(2, uint64(f.Type))
+	w.string(3, f.Error)
+	if v := f.Vote; v != nil {
+		w.message(4, func(w *pbWriter) {
+			w.int(1, v.Term)
+			w.string(2, v.LeaderId)
+			w.int(3, v.LastLogIndex)
+			w.int(4, v.LastLogTerm)
+			w.bool(5, v.PreVote)
+			w.bool(6, v.Transfer)
+		})
+	}
+	if v := f.ElectionReply; v != nil {
+		w.message(5, func(w *pbWriter) {
+			w.int(1, v.Term)
+			w.bool(2, v.VoteGranted)
+		})
+	}
+	if v := f.AppendEntries; v != nil {
+		w.message(6, func(w *pbWriter) {
+			w.int(1, v.Term)
+			w.string(2, v.Leader)
+			w.members(3, v.Members)
+			w.int(4, v.PrevLogIndex)
+			w.int(5, v.PrevLogTerm)
+			for _, e := range v.Entries {
+				e := e
+				w.message(6, func(w *pbWriter) { encodeEntry(w, e) })
+			}
+			w.int(7, v.LeaderCommit)
+			w.bool(8, v.CheckQuorum)
+		})
+	}
+	if v := f.HeartbeatReply; v != nil {
+		w.message(7, func(w *pbWriter) {
+			w.int(1, v.Term)
+			w.bool(2, v.Success)
+			w.int(3, v.MatchIndex)
+			w.int(4, v.ConflictIndex)
+			w.bool(5, v.Unhealthy)
+		})
+	}
+	if v := f.InstallSnapshot; v != nil {
+		w.message(8, func(w *pbWriter) {
+			w.int(1, v.Term)
+			w.string(2, v.Leader)
+			if meta := v.Meta; meta != nil {
+				w.message(3, func(w *pbWriter) {
+					w.int(1, meta.Index)
+					w.int(2, meta.Term)
+					w.members(3, meta.Members)
+				})
+			}
+			w.int(4, v.Offset)
+			w.bytes(5, v.Data)
+			w.bool(6, v.Done)
+		})
+	}
+	if v := f.InstallSnapshotReply; v != nil {
+		w.message(9, func(w *pbWriter) {
+			w.int(1, v.Term)
+			w.bool(2, v.Success)
+		})
+	}
+	if v := f.TimeoutNow; v != nil {
+		w.message(10, func(w *pbWriter) {
+			w.int(1, v.Term)
+			w.string(2, v.Leader)
+		})
+	}
+	if v := f.TimeoutNowReply; v != nil {
+		w.message(11, func(w *pbWriter) {
+			w.int(1, v.Term)
+			w.bool(2, v.Success)
+		})
+	}
+	if v := f.ReadIndexReply; v != nil {
+		w.message(12, func(w *pbWriter) {
+			w.int(1, v.Index)
+		})
+	}
+	return w.b
+}
+
+func encodeMember(w *pbWriter, m *Member) {
+	if m == nil {
+		return
+	}
+	w.string(1, m.Id)
+	w.string(2, m.Address)
+	w.string(3, m.Role)
+	w.string(4, m.LeaderId)
+	w.string(5, m.ElectionStatus)
+	w.string(6, m.HeartbeatStatus)
+	w.int(7, m.LastHeartbeatTime)
+	w.bool(8, m.Learner)
+	w.bool(9, m.Unhealthy)
+}
+
+func encodeEntry(w *pbWriter, e *Entry) {
+	w.int(1, e.Index)
+	w.int(2, e.Term)
+	w.uint(3, uint64(e.Type))
+	w.bytes(4, e.Data)
+}
+
+func decodeStreamFrame(b []byte) (*streamFrame, error) {
+	f := &streamFrame{}
+	err := pbDecode(b, func(field *pbField) error {
+		var err error
+		switch field.num {
+		case 1:
+			f.Id = field.v
+		case 2:
+			f.Type = uint8(field.v)
+		case 3:
+			f.Error = field.string()
+		case 4:
+			f.Vote = &Leader{}
+			err = pbDecode(field.data, func(x *pbField) error {
+				switch x.num {
+				case 1:
+					f.Vote.Term = x.int()
+				case 2:
+					f.Vote.LeaderId = x.string()
+				case 3:
+					f.Vote.LastLogIndex = x.int()
+				case 4:
+					f.Vote.LastLogTerm = x.int()
+				case 5:
+					f.Vote.PreVote = x.bool()
+				case 6:
+					f.Vote.Transfer = x.bool()
+				}
+				return nil
+			})
+		case 5:
+			f.ElectionReply = &ElectionReply{}
+			err = pbDecode(field.data, func(x *pbField) error {
+				switch x.num {
+				case 1:
+					f.ElectionReply.Term = x.int()
+				case 2:
+					f.ElectionReply.VoteGranted = x.bool()
+				}
+				return nil
+			})
+		case 6:
+			f.AppendEntries, err = decodeAppendEntries(field.data)
+		case 7:
+			f.HeartbeatReply = &HeartbeatReply{}
+			err = pbDecode(field.data, func(x *pbField) error {
+				switch x.num {
+				case 1:
+					f.HeartbeatReply.Term = x.int()
+				case 2:
+					f.HeartbeatReply.Success = x.bool()
+				case 3:
+					f.HeartbeatReply.MatchIndex = x.int()
+				case 4:
+					f.HeartbeatReply.ConflictIndex = x.int()
+				case 5:
+					f.HeartbeatReply.Unhealthy = x.bool()
+				}
+				return nil
+			})
+		case 8:
+			f.InstallSnapshot, err = decodeInstallSnapshot(field.data)
+		case 9:
+			f.InstallSnapshotReply = &InstallSnapshotReply{}
+			err = pbDecode(field.data, func(x *pbField) error {
+				switch x.num {
+				case 1:
+					f.InstallSnapshotReply.Term = x.int()
+				case 2:
+					f.InstallSnapshotReply.Success = x.bool()
+				}
+				return nil
+			})
+		case 10:
+			f.TimeoutNow = &TimeoutNowBody{}
+			err = pbDecode(field.data, func(x *pbField) error {
+				switch x.num {
+				case 1:
+					f.TimeoutNow.Term = x.int()
+				case 2:
+					f.TimeoutNow.Leader = x.string()
+				}
+				return nil
+			})
+		case 11:
+			f.TimeoutNowReply = &TimeoutNowReply{}
+			err = pbDecode(field.data, func(x *pbField) error {
+				switch x.num {
+				case 1:
+					f.TimeoutNowReply.Term = x.int()
+				case 2:
+					f.TimeoutNowReply.Success = x.bool()
+				}
+				return nil
+			})
+		case 12:
+			f.ReadIndexReply = &ReadIndexReply{}
+			err = pbDecode(field.data, func(x *pbField) error {
+				if x.num == 1 {
+					f.ReadIndexReply.Index = x.int()
+				}
+				return nil
+			})
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func decodeAppendEntries(b []byte) (*HeartbeatBody, error) {
+	v := &HeartbeatBody{}
+	err := pbDecode(b, func(x *pbField) error {
+		switch x.num {
+		case 1:
+			v.Term = x.int()
+		case 2:
+			v.Leader = x.string()
+		case 3:
+			if v.Members == nil {
+				v.Members = map[string]*Member{}
+			}
+			return decodeMemberEntry(x.data, v.Members)
+		case 4:
+			v.PrevLogIndex = x.int()
+		case 5:
+			v.PrevLogTerm = x.int()
+		case 6:
+			e, err := decodeEntry(x.data)
+			if err != nil {
+				return err
+			}
+			v.Entries = append(v.Entries, e)
+		case 7:
+			v.LeaderCommit = x.int()
+		case 8:
+			v.CheckQuorum = x.bool()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func decodeInstallSnapshot(b []byte) (*InstallSnapshotBody, error) {
+	v := &InstallSnapshotBody{}
+	err := pbDecode(b, func(x *pbField) error {
+		switch x.num {
+		case 1:
+			v.Term = x.int()
+		case 2:
+			v.Leader = x.string()
+		case 3:
+			v.Meta = &SnapshotMeta{}
+			return pbDecode(x.data, func(m *pbField) error {
+				switch m.num {
+				case 1:
+					v.Meta.Index = m.int()
+				case 2:
+					v.Meta.Term = m.int()
+				case 3:
+					if v.Meta.Members == nil {
+						v.Meta.Members = map[string]*Member{}
+					}
+					return decodeMemberEntry(m.data, v.Meta.Members)
+				}
+				return nil
+			})
+		case 4:
+			v.Offset = x.int()
+		case 5:
+			v.Data = x.bytes()
+		case 6:
+			v.Done = x.bool()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// 解码map<string, Member>的一项并加入members
+func decodeMemberEntry(b []byte, members map[string]*Member) error {
+	var id string
+	m := &Member{}
+	err := pbDecode(b, func(x *pbField) error {
+		switch x.num {
+		case 1:
+			id = x.string()
+		case 2:
+			return pbDecode(x.data, func(f *pbField) error {
+				switch f.num {
+				case 1:
+					m.Id = f.string()
+				case 2:
+					m.Address = f.string()
+				case 3:
+					m.Role = f.string()
+				case 4:
+					m.LeaderId = f.string()
+				case 5:
+					m.ElectionStatus = f.string()
+				case 6:
+					m.HeartbeatStatus = f.string()
+				case 7:
+					m.LastHeartbeatTime = f.int()
+				case 8:
+					m.Learner = f.bool()
+				case 9:
+					m.Unhealthy = f.bool()
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	members[id] = m
+	return nil
+}
+
+func decodeEntry(b []byte) (*Entry, error) {
+	e := &Entry{}
+	err := pbDecode(b, func(x *pbField) error {
+		switch x.num {
+		case 1:
+			e.Index = x.int()
+		case 2:
+			e.Term = x.int()
+		case 3:
+			e.Type = EntryType(x.v)
+		case 4:
+			e.Data = x.bytes()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
@@ -0,0 +1,68 @@
+package raft
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestStreamFrameRoundTrip(t *testing.T) {
+	members := map[string]*Member{
+		"n1": {Id: "n1", Address: "127.0.0.1:9180", Role: RoleLeader, LeaderId: "n1", HeartbeatStatus: "online", LastHeartbeatTime: 1700000000},
+		"n2": {Id: "n2", Address: "127.0.0.1:9181", Learner: true, Unhealthy: true},
+	}
+	frames := []*streamFrame{
+		{Id: 1, Type: streamVote, Vote: &Leader{Term: 3, LeaderId: "n1", LastLogIndex: 10, LastLogTerm: 2, PreVote: true, Transfer: true}},
+		{Id: 1, Type: streamVote, ElectionReply: &ElectionReply{Term: 3, VoteGranted: true}},
+		{Id: 2, Type: streamAppendEntries, AppendEntries: &HeartbeatBody{
+			Term: 3, Leader: "n1", Members: members, PrevLogIndex: 9, PrevLogTerm: 2,
+			Entries: []*Entry{
+				{Index: 10, Term: 3, Type: EntryNoop},
+				{Index: 11, Term: 3, Type: EntryCommand, Data: []byte("set x 1")},
+			},
+			LeaderCommit: 9, CheckQuorum: true,
+		}},
+		{Id: 2, Type: streamAppendEntries, HeartbeatReply: &HeartbeatReply{Term: 3, MatchIndex: 11, ConflictIndex: 4, Unhealthy: true}},
+		{Id: 3, Type: streamInstallSnapshot, InstallSnapshot: &InstallSnapshotBody{
+			Term: 3, Leader: "n1", Meta: &SnapshotMeta{Index: 100, Term: 2, Members: members},
+			Offset: 4096, Data: []byte{0, 1, 2}, Done: true,
+		}},
+		{Id: 3, Type: streamInstallSnapshot, InstallSnapshotReply: &InstallSnapshotReply{Term: 3, Success: true}},
+		{Id: 4, Type: streamTimeoutNow, TimeoutNow: &TimeoutNowBody{Term: 3, Leader: "n1"}},
+		{Id: 4, Type: streamTimeoutNow, TimeoutNowReply: &TimeoutNowReply{Term: 3, Success: true}},
+		{Id: 5, Type: streamReadIndex, ReadIndexReply: &ReadIndexReply{Index: 11}},
+		{Id: 6, Type: streamReadIndex, Error: "不是leader"},
+	}
+	for _, want := range frames {
+		var buf bytes.Buffer
+		if err := writeStreamFrame(&buf, encodeStreamFrame(want)); err != nil {
+			t.Fatal(err)
+		}
+		payload, err := readStreamFrame(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := decodeStreamFrame(payload)
+		if err != nil {
+			t.Fatalf("解码类型%d的帧错误:%s", want.Type, err.Error())
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("类型%d的帧解码后不一致:\n%+v\n%+v", want.Type, got, want)
+		}
+	}
+}
+
+func TestStreamFrameMalformed(t *testing.T) {
+	payload := encodeStreamFrame(&streamFrame{Id: 1, Type: streamAppendEntries, AppendEntries: &HeartbeatBody{
+		Term: 1, Leader: "n1", Entries: []*Entry{{Index: 1, Term: 1, Data: []byte("data")}},
+	}})
+	// 最后一个字段是嵌套的消息, 少一个字节时长度超过剩下的数据
+	if _, err := decodeStreamFrame(payload[:len(payload)-1]); err == nil {
+		t.Fatal("截断的帧应该返回错误")
+	}
+	var buf bytes.Buffer
+	buf.Write([]byte{0xff, 0xff, 0xff, 0xff})
+	if _, err := readStreamFrame(&buf); err == nil {
+		t.Fatal("超过长度上限的帧应该返回错误")
+	}
+}
@@ -0,0 +1,221 @@
+// 成员之间的双向TLS
+package raft
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kylin-ops/raft/logger"
+)
+
+var ErrNoPeerCertificate = errors.New("请求没有携带客户端证书")
+
+// 证书文件, 文件修改后在下一次握手时重新加载, 不需要重启节点
+type tlsFiles struct {
+	certFile string
+	keyFile  string
+	caFile   string
+	logger   logger.Logger
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+	modTime time.Time // 已加载文件中最新的修改时间
+	checked time.Time // 最近一次检查文件修改的时间
+}
+
+func newTLSFiles(o *Options) *tlsFiles {
+	if o.TLSCertFile == "" && o.TLSKeyFile == "" && o.TLSCAFile == "" {
+		return nil
+	}
+	return &tlsFiles{certFile: o.TLSCertFile, keyFile: o.TLSKeyFile, caFile: o.TLSCAFile, logger: o.Logger}
+}
+
+// 加载证书文件, 启动时调用, 文件不完整或者格式错误时返回错误
+func (f *tlsFiles) load() error {
+	if f.certFile == "" || f.keyFile == "" || f.caFile == "" {
+		return errors.New("TLS需要同时配置证书、私钥和CA文件")
+	}
+	modTime, err := f.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+	if err != nil {
+		return fmt.Errorf("加载证书错误:%s", err.Error())
+	}
+	ca, err := ioutil.ReadFile(f.caFile)
+	if err != nil {
+		return fmt.Errorf("加载CA错误:%s", err.Error())
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return fmt.Errorf("CA文件%s中没有证书", f.caFile)
+	}
+	f.mu.Lock()
+	f.cert = &cert
+	f.pool = pool
+	f.modTime = modTime
+	f.checked = time.Now()
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *tlsFiles) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{f.certFile, f.keyFile, f.caFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// 返回当前的证书和CA, 每秒最多检查一次文件修改, 重新加载失败时继续使用原来的证书
+func (f *tlsFiles) current() (*tls.Certificate, *x509.CertPool) {
+	f.mu.Lock()
+	reload := false
+	if time.Since(f.checked) >= time.Second {
+		f.checked = time.Now()
+		modTime, err := f.latestModTime()
+		reload = err == nil && modTime.After(f.modTime)
+	}
+	f.mu.Unlock()
+	if reload {
+		if err := f.load(); err != nil {
+			f.logger.Errorf("重新加载TLS证书错误:%s", err.Error())
+		} else {
+			f.logger.Infof("TLS证书文件已修改,重新加载完成")
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.cert, f.pool
+}
+
+// 用当前的CA校验对方的证书链, 返回对方的证书
+func (f *tlsFiles) verify(rawCerts [][]byte, usage x509.ExtKeyUsage) (*x509.Certificate, error) {
+	if len(rawCerts) == 0 {
+		return nil, ErrNoPeerCertificate
+	}
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	_, pool := f.current()
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	}); err != nil {
+		return nil, err
+	}
+	return certs[0], nil
+}
+
+// 服务端配置, 要求对方提供CA签发的证书, 对方是哪个成员在处理请求时检查
+func (f *tlsFiles) serverConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientAuth: tls.RequireAnyClientCert,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, _ := f.current()
+			return cert, nil
+		},
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			_, err := f.verify(rawCerts, x509.ExtKeyUsageClientAuth)
+			return err
+		},
+	}
+}
+
+// 连接成员id的客户端配置, 对方的证书必须是CA签发给这个成员的
+// 地址通常是IP, 不使用主机名校验, 由VerifyPeerCertificate用当前的CA和成员id校验
+func (f *tlsFiles) clientConfig(id string) *tls.Config {
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: true,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := f.current()
+			return cert, nil
+		},
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			cert, err := f.verify(rawCerts, x509.ExtKeyUsageServerAuth)
+			if err != nil {
+				return err
+			}
+			return checkCertIdentity(cert, id)
+		},
+	}
+}
+
+// 证书的CommonName或者DNS名称中有一个等于成员id
+func checkCertIdentity(cert *x509.Certificate, id string) error {
+	if cert.Subject.CommonName == id {
+		return nil
+	}
+	for _, name := range cert.DNSNames {
+		if name == id {
+			return nil
+		}
+	}
+	return fmt.Errorf("证书%s不属于成员%s", cert.Subject.CommonName, id)
+}
+
+// TLSConfig 返回集群接口使用的服务端TLS配置, 没有配置证书时返回nil
+// 配置DisableListen时应用的http服务需要使用这个配置, 成员的身份才能在请求中得到校验
+func (r *Raft) TLSConfig() *tls.Config {
+	if r.tls == nil {
+		return nil
+	}
+	return r.tls.serverConfig()
+}
+
+// 检查请求的客户端证书属于成员id, 没有配置TLS时不检查
+func (r *Raft) checkPeer(req *http.Request, id string) error {
+	if r.tls == nil {
+		return nil
+	}
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return ErrNoPeerCertificate
+	}
+	return checkCertIdentity(req.TLS.PeerCertificates[0], id)
+}
+
+// 检查请求的客户端证书属于集群中的某个成员
+func (r *Raft) checkMemberPeer(req *http.Request) error {
+	if r.tls == nil {
+		return nil
+	}
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return ErrNoPeerCertificate
+	}
+	cert := req.TLS.PeerCertificates[0]
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	for id := range r.Members {
+		if checkCertIdentity(cert, id) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("证书%s不属于集群成员", cert.Subject.CommonName)
+}
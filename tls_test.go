@@ -0,0 +1,226 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 测试用的CA, 签发成员证书
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// 签发成员id的证书, 同时用于服务端和客户端, 返回证书和私钥的PEM
+func (ca *testCA) issue(t *testing.T, id string, notAfter time.Time) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: id},
+		DNSNames:     []string{id},
+		NotBefore:    time.Now().Add(-2 * time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func (ca *testCA) keyPair(t *testing.T, id string, notAfter time.Time) tls.Certificate {
+	t.Helper()
+	certPEM, keyPEM := ca.issue(t, id, notAfter)
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pair
+}
+
+// 把成员id的证书、私钥和CA写入dir, 设置Options中的TLS文件
+func (ca *testCA) writeFiles(t *testing.T, dir, id string, o *Options) {
+	t.Helper()
+	certPEM, keyPEM := ca.issue(t, id, time.Now().Add(time.Hour))
+	o.TLSCertFile = filepath.Join(dir, id+".crt")
+	o.TLSKeyFile = filepath.Join(dir, id+".key")
+	o.TLSCAFile = filepath.Join(dir, "ca.crt")
+	for name, data := range map[string][]byte{o.TLSCertFile: certPEM, o.TLSKeyFile: keyPEM, o.TLSCAFile: ca.pem} {
+		if err := ioutil.WriteFile(name, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// 用TLS配置启动httptest服务
+// 不使用StartTLS, 它会加入httptest自己的证书, 没有SNI的握手不会调用GetCertificate
+func startTLS(ts *httptest.Server, config *tls.Config) {
+	ts.Listener = tls.NewListener(ts.Listener, config)
+	ts.Start()
+	ts.URL = "https://" + ts.Listener.Addr().String()
+}
+
+// 使用TLSConfig的httptest服务上的节点n1
+func newTLSNode(t *testing.T, ca *testCA) (*Raft, *httptest.Server) {
+	t.Helper()
+	dir := t.TempDir()
+	r := newTestNode(t, func(o *Options) { ca.writeFiles(t, dir, "n1", o) })
+	if err := r.tls.load(); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(r.Handler())
+	startTLS(ts, r.TLSConfig())
+	t.Cleanup(ts.Close)
+	return r, ts
+}
+
+// 用客户端证书向节点发送请求, 返回http状态码, 握手失败时返回错误
+func postTLS(ts *httptest.Server, certs []tls.Certificate, path string, body interface{}) (int, error) {
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{Certificates: certs, InsecureSkipVerify: true},
+	}}
+	data, _ := json.Marshal(body)
+	resp, err := client.Post(ts.URL+path, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func TestTLSRejectsPeers(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	_, ts := newTLSNode(t, ca)
+	valid := time.Now().Add(time.Hour)
+	vote := &Leader{Term: 1, LeaderId: "n2"}
+	cases := []struct {
+		name   string
+		certs  []tls.Certificate
+		path   string
+		body   interface{}
+		status int // 0表示握手失败
+	}{
+		{"成员证书", []tls.Certificate{ca.keyPair(t, "n2", valid)}, "/api/v1/election", vote, 200},
+		{"没有证书", nil, "/api/v1/election", vote, 0},
+		{"其他CA签发", []tls.Certificate{newTestCA(t, "other").keyPair(t, "n2", valid)}, "/api/v1/election", vote, 0},
+		{"证书过期", []tls.Certificate{ca.keyPair(t, "n2", time.Now().Add(-time.Hour))}, "/api/v1/election", vote, 0},
+		{"证书和发送方不一致", []tls.Certificate{ca.keyPair(t, "n3", valid)}, "/api/v1/election", vote, 403},
+		{"不是成员的证书", []tls.Certificate{ca.keyPair(t, "n9", valid)}, "/api/v1/read_index", nil, 403},
+	}
+	for _, tc := range cases {
+		status, err := postTLS(ts, tc.certs, tc.path, tc.body)
+		if tc.status == 0 {
+			if err == nil {
+				t.Fatalf("%s: 握手应该失败,响应状态%d", tc.name, status)
+			}
+			continue
+		}
+		if err != nil || status != tc.status {
+			t.Fatalf("%s: 响应状态%d错误%v", tc.name, status, err)
+		}
+	}
+}
+
+func TestTLSReloadsRotatedFiles(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	r, ts := newTLSNode(t, ca)
+	valid := time.Now().Add(time.Hour)
+	vote := &Leader{Term: 1, LeaderId: "n2"}
+	oldCert := ca.keyPair(t, "n2", valid)
+	if status, err := postTLS(ts, []tls.Certificate{oldCert}, "/api/v1/election", vote); err != nil || status != 200 {
+		t.Fatalf("轮换前响应状态%d错误%v", status, err)
+	}
+
+	// 换成新的CA和证书, 文件修改时间更新后下一次握手重新加载
+	rotated := newTestCA(t, "rotated")
+	o := &Options{}
+	rotated.writeFiles(t, filepath.Dir(r.tls.caFile), "n1", o)
+	future := time.Now().Add(time.Minute)
+	for _, name := range []string{o.TLSCertFile, o.TLSKeyFile, o.TLSCAFile} {
+		if err := os.Chtimes(name, future, future); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.tls.mu.Lock()
+	r.tls.checked = time.Time{}
+	r.tls.mu.Unlock()
+
+	if _, err := postTLS(ts, []tls.Certificate{oldCert}, "/api/v1/election", vote); err == nil {
+		t.Fatal("轮换后原来CA签发的证书应该握手失败")
+	}
+	if status, err := postTLS(ts, []tls.Certificate{rotated.keyPair(t, "n2", valid)}, "/api/v1/election", vote); err != nil || status != 200 {
+		t.Fatalf("轮换后新证书响应状态%d错误%v", status, err)
+	}
+}
+
+func TestTLSClientChecksServerIdentity(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	_, ts := newTLSNode(t, ca)
+	o := &Options{Logger: testLogger()}
+	ca.writeFiles(t, t.TempDir(), "n2", o)
+	files := newTLSFiles(o)
+	if err := files.load(); err != nil {
+		t.Fatal(err)
+	}
+	transport := &HttpTransport{tls: files}
+	address := ts.Listener.Addr().String()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	vote := &Leader{Term: 1, LeaderId: "n2"}
+	if _, err := transport.RequestVote(ctx, &Member{Id: "n1", Address: address}, vote); err != nil {
+		t.Fatalf("连接证书属于n1的服务错误:%s", err.Error())
+	}
+	// 地址上的服务证书不属于要连接的成员
+	if _, err := transport.RequestVote(ctx, &Member{Id: "n3", Address: address}, vote); err == nil {
+		t.Fatal("服务证书不属于n3时应该返回错误")
+	}
+}
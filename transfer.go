@@ -0,0 +1,111 @@
+// leader转移
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrLeadershipTransferring = errors.New("正在转移leader,暂停接收新的命令")
+
+// TimeoutNow请求, 让目标节点立即发起选举
+type TimeoutNowBody struct {
+	Term   int64  `json:"term"`
+	Leader string `json:"leader"`
+}
+
+// TimeoutNow响应
+type TimeoutNowReply struct {
+	Term    int64 `json:"term"`
+	Success bool  `json:"success"` // 是否已经开始选举
+}
+
+// TransferLeadership 把leader转移给指定成员
+// 转移期间leader不接收新的命令, 等目标成员追上日志后通知它立即发起选举, 本节点退位后返回
+// 通知之后目标成员在Timeout内没有成为leader时放弃转移并返回错误
+func (r *Raft) TransferLeadership(ctx context.Context, id string) error {
+	if id == "" {
+		return ErrInvalidMember
+	}
+	r.Mu.Lock()
+	if r.Role != RoleLeader {
+		r.Mu.Unlock()
+		return ErrNotLeader
+	}
+	if id == r.Id {
+		r.Mu.Unlock()
+		return nil
+	}
+	m, ok := r.Members[id]
+	if !ok || m.Learner {
+		r.Mu.Unlock()
+		return fmt.Errorf("成员%s不存在或者是learner,不能转移leader", id)
+	}
+	if r.transferee != "" {
+		r.Mu.Unlock()
+		return fmt.Errorf("正在把leader转移给%s", r.transferee)
+	}
+	r.transferee = id
+	term := r.CurrentTerm
+	target := *m
+	r.Mu.Unlock()
+	r.logWith(LogElection).Infof("开始把leader转移给%s", id)
+
+	defer func() {
+		r.Mu.Lock()
+		if r.transferee == id {
+			r.transferee = ""
+		}
+		r.Mu.Unlock()
+	}()
+
+	// 等待目标成员追上全部日志
+	if err := r.waitTransfer(ctx, term, func() bool {
+		return r.matchIndex[id] >= r.log.lastIndex()
+	}); err != nil {
+		return err
+	}
+	r.Mu.Lock()
+	stillLeader := r.Role == RoleLeader && r.CurrentTerm == term
+	r.Mu.Unlock()
+	if !stillLeader {
+		return nil
+	}
+	if err := r.requestTimeoutNow(&target, term); err != nil {
+		return err
+	}
+	// 等待目标成员赢得选举, 本节点收到更高的任期后退位
+	// 目标成员在一个超时时间内没有成为leader时放弃转移, 恢复接收新的命令
+	waitCtx, cancel := context.WithTimeout(ctx, time.Duration(r.Timeout)*time.Second)
+	defer cancel()
+	err := r.waitTransfer(waitCtx, term, func() bool { return false })
+	if err != nil && ctx.Err() == nil {
+		r.logWith(LogElection).Warnf("%s在%d秒内没有成为leader,放弃转移", id, r.Timeout)
+		return fmt.Errorf("%s在%d秒内没有成为leader,放弃转移", id, r.Timeout)
+	}
+	return err
+}
+
+// 等待条件成立, 本节点已经不是term任期的leader时结束等待
+func (r *Raft) waitTransfer(ctx context.Context, term int64, done func() bool) error {
+	for {
+		r.Mu.Lock()
+		if r.Role != RoleLeader || r.CurrentTerm != term {
+			r.Mu.Unlock()
+			return nil
+		}
+		ok := done()
+		r.Mu.Unlock()
+		if ok {
+			return nil
+		}
+		r.notifyReplicate()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package raft
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 不转发TimeoutNow的传输, 目标成员不会发起选举
+type lostTimeoutNowTransport struct {
+	*InmemTransport
+}
+
+func (t *lostTimeoutNowTransport) TimeoutNow(ctx context.Context, m *Member, req *TimeoutNowBody) (*TimeoutNowReply, error) {
+	return &TimeoutNowReply{Term: req.Term, Success: true}, nil
+}
+
+func TestTransferLeadership(t *testing.T) {
+	c := newTestCluster(t, 3, nil)
+	c.waitFor("选出leader", 20*time.Second, func() bool { return c.leader() != nil })
+	c.propose("a")
+	leader := c.leader()
+	var target *Raft
+	for _, r := range c.nodes {
+		if r != leader {
+			target = r
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := leader.TransferLeadership(ctx, target.Id); err != nil {
+		t.Fatal(err)
+	}
+	c.waitFor("目标成员成为leader", 10*time.Second, func() bool { return c.leader() == target })
+	leader.Mu.Lock()
+	role, transferee := leader.Role, leader.transferee
+	leader.Mu.Unlock()
+	if role == RoleLeader || transferee != "" {
+		t.Fatalf("转移后原leader的角色是%s,转移目标是%q", role, transferee)
+	}
+	c.propose("b")
+	c.waitFor("全部节点应用相同的日志", 20*time.Second, c.converged)
+
+	cases := []struct {
+		name string
+		r    *Raft
+		id   string
+		ok   bool
+	}{
+		{"转移给自己", target, target.Id, true},
+		{"在follower上转移", leader, target.Id, false},
+		{"转移给不存在的成员", target, "n9", false},
+	}
+	for _, tc := range cases {
+		if err := tc.r.TransferLeadership(ctx, tc.id); (err == nil) != tc.ok {
+			t.Fatalf("%s返回%v", tc.name, err)
+		}
+	}
+}
+
+func TestTransferLeadershipTimeout(t *testing.T) {
+	c := newTestCluster(t, 3, func(o *Options) {
+		o.Transport = &lostTimeoutNowTransport{InmemTransport: o.Transport.(*InmemTransport)}
+	})
+	c.waitFor("选出leader", 20*time.Second, func() bool { return c.leader() != nil })
+	c.propose("a")
+	leader := c.leader()
+	var target *Raft
+	for _, r := range c.nodes {
+		if r != leader {
+			target = r
+		}
+	}
+	// 目标成员没有收到TimeoutNow, 一个超时时间后放弃转移, 原leader恢复接收命令
+	start := time.Now()
+	err := leader.TransferLeadership(context.Background(), target.Id)
+	if err == nil || !strings.Contains(err.Error(), "没有成为leader") {
+		t.Fatalf("转移超时返回%v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Fatalf("放弃转移用了%s", elapsed)
+	}
+	leader.Mu.Lock()
+	role, transferee := leader.Role, leader.transferee
+	leader.Mu.Unlock()
+	if role != RoleLeader || transferee != "" {
+		t.Fatalf("放弃转移后角色是%s,转移目标是%q", role, transferee)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := leader.ProposeAndWait(ctx, []byte("b")); err != nil {
+		t.Fatalf("放弃转移后提交命令错误:%s", err.Error())
+	}
+}
@@ -0,0 +1,166 @@
+// 成员之间的通信
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/kylin-ops/raft/http/httpclient/grequest"
+)
+
+// 对方校验本节点的签名或证书失败, 返回401/403, 通常是ClusterSecret或证书配置不一致
+var ErrPeerUnauthorized = errors.New("对方拒绝了本节点的身份")
+
+// Transport 向其他成员发送请求
+// 对方收到请求后即使拒绝也返回响应, error只表示请求没有送达或者没有收到响应; ReadIndex被拒绝时也返回error
+// 对方拒绝本节点的身份时返回包装了ErrPeerUnauthorized的error
+type Transport interface {
+	// 请求投票, 包括预投票
+	RequestVote(ctx context.Context, m *Member, req *Leader) (*ElectionReply, error)
+	// 发送心跳和日志
+	AppendEntries(ctx context.Context, m *Member, req *HeartbeatBody) (*HeartbeatReply, error)
+	// 发送一个快照数据块
+	InstallSnapshot(ctx context.Context, m *Member, req *InstallSnapshotBody) (*InstallSnapshotReply, error)
+	// 通知目标成员立即发起选举
+	TimeoutNow(ctx context.Context, m *Member, req *TimeoutNowBody) (*TimeoutNowReply, error)
+	// 向leader请求读索引
+	ReadIndex(ctx context.Context, m *Member) (*ReadIndexReply, error)
+}
+
+// HTTP/JSON传输, 默认的传输方式, 请求发送到成员Address上Handler()提供的接口
+type HttpTransport struct {
+	RoutePrefix string // 接口路由的前缀, 和Options.RoutePrefix一致
+
+	tls     *tlsFiles // 双向TLS, 由NewRaft按Options设置
+	signer  *signer   // 请求签名, 由NewRaft按Options设置
+	mu      sync.Mutex
+	clients map[string]*http.Transport // 配置TLS时每个成员使用单独的连接池, 校验对方是这个成员
+}
+
+func (t *HttpTransport) RequestVote(ctx context.Context, m *Member, req *Leader) (*ElectionReply, error) {
+	var reply ElectionReply
+	if _, err := t.post(ctx, m, "/api/v1/election", req, &reply); err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
+
+func (t *HttpTransport) AppendEntries(ctx context.Context, m *Member, req *HeartbeatBody) (*HeartbeatReply, error) {
+	var reply HeartbeatReply
+	if _, err := t.post(ctx, m, "/api/v1/heartbeat", req, &reply); err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
+
+func (t *HttpTransport) InstallSnapshot(ctx context.Context, m *Member, req *InstallSnapshotBody) (*InstallSnapshotReply, error) {
+	var reply InstallSnapshotReply
+	if _, err := t.post(ctx, m, "/api/v1/install_snapshot", req, &reply); err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
+
+func (t *HttpTransport) TimeoutNow(ctx context.Context, m *Member, req *TimeoutNowBody) (*TimeoutNowReply, error) {
+	var reply TimeoutNowReply
+	if _, err := t.post(ctx, m, "/api/v1/timeout_now", req, &reply); err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
+
+func (t *HttpTransport) ReadIndex(ctx context.Context, m *Member) (*ReadIndexReply, error) {
+	var reply ReadIndexReply
+	info, err := t.post(ctx, m, "/api/v1/read_index", nil, &reply)
+	if err != nil {
+		return nil, err
+	}
+	if info != "" {
+		return nil, fmt.Errorf("%s", info)
+	}
+	return &reply, nil
+}
+
+// 发送请求并把tools.ApiResponse格式响应的data字段解析到reply, 返回响应中的错误信息
+func (t *HttpTransport) post(ctx context.Context, m *Member, path string, req, reply interface{}) (string, error) {
+	timeout := 10 * time.Second
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	scheme := "http://"
+	var transport http.RoundTripper
+	if t.tls != nil {
+		scheme = "https://"
+		transport = t.client(m.Id)
+	}
+	// 签名需要和发出的请求体完全一致, 这里先编码, grequest编码json.RawMessage时内容不变
+	data, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	var header grequest.Header
+	if t.signer != nil {
+		header = t.signer.sign(t.RoutePrefix+path, data)
+	}
+	resp, err := grequest.Post(scheme+m.Address+t.RoutePrefix+path, &grequest.RequestOptions{
+		Header:    header,
+		Data:      json.RawMessage(data),
+		Json:      true,
+		Timeout:   timeout,
+		Transport: transport,
+	})
+	// grequest在状态码大于等于400时同时返回响应和错误
+	if err != nil && resp != nil {
+		if code := resp.StatusCode(); code == http.StatusUnauthorized || code == http.StatusForbidden {
+			return "", fmt.Errorf("%w:%s", ErrPeerUnauthorized, err.Error())
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	var body struct {
+		Code int             `json:"code"`
+		Data json.RawMessage `json:"data"`
+		Info string          `json:"info"`
+	}
+	if err := resp.Json(&body); err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal(body.Data, reply); err != nil {
+		return "", err
+	}
+	if body.Code != 200 {
+		return body.Info, nil
+	}
+	return "", nil
+}
+
+// 返回连接成员id使用的连接池
+func (t *HttpTransport) client(id string) *http.Transport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.clients == nil {
+		t.clients = map[string]*http.Transport{}
+	}
+	c, ok := t.clients[id]
+	if !ok {
+		c = &http.Transport{TLSClientConfig: t.tls.clientConfig(id), IdleConnTimeout: 90 * time.Second}
+		t.clients[id] = c
+	}
+	return c
+}
+
+// Close 关闭空闲的TLS连接, 节点停止时调用
+func (t *HttpTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, c := range t.clients {
+		c.CloseIdleConnections()
+	}
+	return nil
+}